@@ -0,0 +1,6 @@
+#!/bin/sh
+
+# lock-free readers of concurrent must stay race free, e.g. during shrink.
+# vet is off because of the known vet failure in performance_test.go,
+# the tests of concurrent need goconvey in GOPATH like run_tests.sh.
+go test -race -vet=off concurrent/...
@@ -0,0 +1,85 @@
+package concurrent
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+//codedKey is a Hashable that still has the deprecated HashBytes, it is hashed from HashCode
+type codedKey struct{ id uint64 }
+
+func (this codedKey) HashBytes() []byte {
+	return binary.LittleEndian.AppendUint64(nil, this.id)
+}
+
+func (this codedKey) HashCode() uint64 {
+	return this.id
+}
+
+func (this codedKey) Equals(v2 interface{}) bool {
+	return this == v2
+}
+
+type codedPair struct {
+	Tenant int32
+	Key    codedKey
+}
+
+type ifacePair struct {
+	Tenant int32
+	Key    Hashable
+}
+
+func TestHashCodeEncoding(t *testing.T) {
+	//a Hashable is encoded from HashCode, the same bytes as its HashBytes here
+	if got, want := encodeKey(t, codedKey{7}), le(7); string(got) != string(want) {
+		t.Errorf("encoding of codedKey is %v, want %v", got, want)
+	}
+	if got, want := encodeKey(t, codedPair{1, codedKey{7}}), cat(le(1), le(8), le(7)); string(got) != string(want) {
+		t.Errorf("encoding of codedPair is %v, want %v", got, want)
+	}
+}
+
+func TestNoAllocs(t *testing.T) {
+	keys := map[string]func(i int) interface{}{
+		"int": func(i int) interface{} { return i },
+		"string": func(i int) interface{} {
+			return "a key longer than the scratch buffer of hashKey, " + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		},
+		"struct":   func(i int) interface{} { return tenantKey{int32(i % 7), int64(i)} },
+		"array":    func(i int) interface{} { return [3]uint16{uint16(i), 1, 2} },
+		"Hashable": func(i int) interface{} { return codedKey{uint64(i)} },
+		"nested":   func(i int) interface{} { return codedPair{int32(i % 3), codedKey{uint64(i)}} },
+		"iface":    func(i int) interface{} { return ifacePair{int32(i % 3), codedKey{uint64(i)}} },
+	}
+	for _, alg := range []HashAlgorithm{FNV1a, SipHash} {
+		for name, key := range keys {
+			m := NewConcurrentMapWithSeed(1, alg)
+			n := 100
+			for i := 0; i < n; i++ {
+				m.Put(key(i), i)
+			}
+			//keys and values are boxed up front, the map itself must not allocate
+			hit, miss, value := key(42), key(n+1), interface{}(-1)
+			ops := map[string]func(){
+				"Get":         func() { m.Get(hit) },
+				"Get miss":    func() { m.Get(miss) },
+				"ContainsKey": func() { m.ContainsKey(hit) },
+				"PutIfAbsent": func() { m.PutIfAbsent(hit, value) },
+				"Remove miss": func() { m.Remove(miss) },
+			}
+			for op, f := range ops {
+				if allocs := testing.AllocsPerRun(100, f); allocs != 0 {
+					t.Errorf("alg %v, %v key, %v allocates %v times, want 0", alg, name, op, allocs)
+				}
+			}
+			//Put only allocates the cell its value is published in, see Entry.storeValue
+			if allocs := testing.AllocsPerRun(100, func() { m.Put(hit, value) }); allocs != 1 {
+				t.Errorf("alg %v, %v key, Put allocates %v times, want 1", alg, name, allocs)
+			}
+			if v, _ := m.Get(hit); v != -1 {
+				t.Errorf("alg %v, %v key, Get after Put, return %v, want -1", alg, name, v)
+			}
+		}
+	}
+}
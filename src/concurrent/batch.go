@@ -0,0 +1,206 @@
+package concurrent
+
+import (
+	"errors"
+)
+
+/* ---------------- Batch operations -------------- */
+
+/*
+* GetAll, PutAll and RemoveAll hash all keys of a batch before touching the
+* map, so a nil or unsupported key fails the whole batch and nothing is
+* written. The writers then group the keys by segment and take the lock of
+* every segment at most once, and PutAll doubles a table in advance when
+* the batch would make it cross its threshold, instead of rehashing while
+* the keys are inserted. A batch is not atomic, readers may see the keys of
+* one segment before those of another.
+ */
+
+type batchItem struct {
+	key   interface{}
+	value interface{}
+	hash  uint32
+}
+
+//hashItem sets the hash code of the key of item
+func (this *ConcurrentMap) hashItem(item *batchItem) (err error) {
+	if isNil(item.key) {
+		return NilKeyError
+	}
+	item.hash, err = hashKey(item.key, this)
+	return
+}
+
+/**
+* Sorts items by segment with a counting sort, and calls f with the
+* items of every segment.
+*/
+func (this *ConcurrentMap) forEachSegmentOf(items []batchItem, f func(s *Segment, items []batchItem)) {
+	dir := this.loadDir()
+	//starts[i] is the start of the items of slot i in sorted
+	starts := make([]int, len(dir.slots)+1)
+	for i := range items {
+		starts[dir.slotIndex(items[i].hash, this.segmentSeed)+1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+	next := make([]int, len(dir.slots))
+	copy(next, starts)
+	sorted := make([]batchItem, len(items))
+	for i := range items {
+		j := dir.slotIndex(items[i].hash, this.segmentSeed)
+		sorted[next[j]] = items[i]
+		next[j]++
+	}
+
+	//the slots of a segment are consecutive
+	for i := 0; i < len(dir.slots); {
+		j := i + 1
+		for j < len(dir.slots) && dir.slots[j] == dir.slots[i] {
+			j++
+		}
+		if starts[i] < starts[j] {
+			f(dir.slots[i], sorted[starts[i]:starts[j]])
+		}
+		i = j
+	}
+}
+
+/**
+* Returns the values to which the specified keys are mapped, values[i] is
+* the value of keys[i], or nil if keys[i] is not in the map. Like Get it
+* does not lock.
+*
+* @return NilKeyError or NonSupportKey if a key is not supported, values
+*         is nil then
+*/
+func (this *ConcurrentMap) GetAll(keys []interface{}) (values []interface{}, err error) {
+	items := make([]batchItem, len(keys))
+	for i, k := range keys {
+		items[i].key = k
+		if err = this.hashItem(&items[i]); err != nil {
+			return nil, err
+		}
+	}
+	values = make([]interface{}, len(keys))
+	for i := range items {
+		values[i] = this.segmentFor(items[i].hash).get(items[i].key, items[i].hash)
+	}
+	return
+}
+
+/**
+* Copies all of the mappings from the specified map to this one.
+* These mappings replace any mappings that this map had for any of the
+* keys currently in the specified map. The lock of every segment is taken
+* at most once, see above.
+*
+* @param m mappings to be stored in this map
+* @return NilKeyError, NilValueError or NonSupportKey if a mapping is not
+*         supported, nothing is stored then
+*/
+func (this *ConcurrentMap) PutAll(m map[interface{}]interface{}) (err error) {
+	if isNil(m) {
+		return errors.New("Cannot copy nil map")
+	}
+	items := make([]batchItem, 0, len(m))
+	for k, v := range m {
+		item := batchItem{key: k, value: v}
+		if err = this.hashItem(&item); err != nil {
+			return
+		}
+		if isNil(v) {
+			return NilValueError
+		}
+		items = append(items, item)
+	}
+
+	this.forEachSegmentOf(items, (*Segment).putBatch)
+	return
+}
+
+/**
+* Removes the specified keys from this map, keys that are not in the map
+* are ignored. The lock of every segment is taken at most once, see above.
+*
+* @return the number of removed mappings, and NilKeyError or NonSupportKey
+*         if a key is not supported, nothing is removed then
+*/
+func (this *ConcurrentMap) RemoveAll(keys []interface{}) (n int, err error) {
+	items := make([]batchItem, len(keys))
+	for i, k := range keys {
+		items[i].key = k
+		if err = this.hashItem(&items[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	this.forEachSegmentOf(items, func(s *Segment, items []batchItem) {
+		n += s.removeBatch(items)
+	})
+	return
+}
+
+/**
+* Puts items under one acquisition of the lock.
+*/
+func (this *Segment) putBatch(items []batchItem) {
+	var evicted []*Entry
+	defer this.m.notifyEvicted(&evicted) //after unlocking
+	if !this.lockLive() {
+		this.m.forEachSegmentOf(items, (*Segment).putBatch)
+		return
+	}
+	defer this.lock.Unlock()
+
+	this.reserve(int64(len(items)))
+	for i := range items {
+		this.putLocked(items[i].key, items[i].hash, items[i].value, this.m.defaultTTL, false, &evicted)
+	}
+}
+
+/**
+* Grows the table at once to the smallest power of two capacity that n
+* more entries fit into without crossing threshold, so a large table is
+* transferred only once. A bounded segment is not grown beyond its share
+* of the bound.
+* Call only while holding lock.
+*/
+func (this *Segment) reserve(n int64) {
+	want := this.count + n
+	if this.maxWeight > 0 && want > this.maxWeight {
+		want = this.maxWeight
+	}
+	if want <= this.threshold {
+		return
+	}
+	capacity := len(this.table())
+	if this.nextTable != nil {
+		capacity = len(this.nextTable)
+	}
+	for int64(float32(capacity)*this.loadFactor) < want && capacity < MAXIMUM_CAPACITY {
+		capacity <<= 1
+	}
+	this.grow(capacity)
+}
+
+/**
+* Removes items under one acquisition of the lock.
+* @return the number of removed mappings
+*/
+func (this *Segment) removeBatch(items []batchItem) (n int) {
+	if !this.lockLive() {
+		this.m.forEachSegmentOf(items, func(s *Segment, items []batchItem) {
+			n += s.removeBatch(items)
+		})
+		return
+	}
+	defer this.lock.Unlock()
+	for i := range items {
+		if this.removeLocked(items[i].key, items[i].hash, nil) != nil {
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package concurrent
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+//lockAcquisitions returns the number of acquisitions of all segment locks
+func lockAcquisitions(m *ConcurrentMap) (n int64) {
+	for _, s := range m.segmentList() {
+		n += s.lock.acquisitions
+	}
+	return
+}
+
+func TestBatch(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 4)
+	n := 10000
+	batch := make(map[interface{}]interface{}, n)
+	for i := 0; i < n; i++ {
+		batch[i] = i * 10
+	}
+	if err := m.PutAll(batch); err != nil {
+		t.Fatalf("PutAll return %v", err)
+	}
+	if s := m.Size(); s != int32(n) {
+		t.Errorf("Size %v, want %v", s, n)
+	}
+
+	//one lock acquisition per segment, the tables are grown to the size that puts one by one reach
+	if locks := lockAcquisitions(m); locks != 4 {
+		t.Errorf("PutAll acquired the segment locks %v times, want 4", locks)
+	}
+	want := NewConcurrentMap(16, float32(0.75), 4)
+	for i := 0; i < n; i++ {
+		want.Put(i, i*10)
+	}
+	if c, wc := m.Stats().Capacity, want.Stats().Capacity; c != wc {
+		t.Errorf("capacity %v after PutAll, want %v", c, wc)
+	}
+
+	values, err := m.GetAll([]interface{}{1, -1, 2, 1})
+	if err != nil || !reflect.DeepEqual(values, []interface{}{10, nil, 20, 10}) {
+		t.Errorf("GetAll return %v, %v", values, err)
+	}
+
+	keys := make([]interface{}, 0, n/2+1)
+	for i := 0; i < n; i += 2 {
+		keys = append(keys, i)
+	}
+	keys = append(keys, -1)
+	locks := lockAcquisitions(m)
+	if removed, err := m.RemoveAll(keys); err != nil || removed != n/2 {
+		t.Errorf("RemoveAll return %v, %v, want %v", removed, err, n/2)
+	}
+	if locks = lockAcquisitions(m) - locks; locks != 4 {
+		t.Errorf("RemoveAll acquired the segment locks %v times, want 4", locks)
+	}
+	if s := m.Size(); s != int32(n/2) {
+		t.Errorf("Size after RemoveAll %v, want %v", s, n/2)
+	}
+	if v, ok := m.Get(3); !ok || v != 30 {
+		t.Errorf("Get(3) return %v, %v", v, ok)
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	m := NewConcurrentMap()
+	if err := m.PutAll(map[interface{}]interface{}{1: 1, 2: nil}); err != NilValueError {
+		t.Errorf("PutAll with nil value, return %v", err)
+	}
+	if err := m.PutAll(map[interface{}]interface{}{1: 1, &struct{}{}: 2}); err != NonSupportKey {
+		t.Errorf("PutAll with pointer key, return %v", err)
+	}
+	if err := m.PutAll(nil); err == nil {
+		t.Errorf("PutAll(nil) return nil")
+	}
+	if s := m.Size(); s != 0 {
+		t.Errorf("Size after failed PutAll %v, want 0", s)
+	}
+
+	m.Put(1, 1)
+	if n, err := m.RemoveAll([]interface{}{1, nil}); n != 0 || err != NilKeyError {
+		t.Errorf("RemoveAll with nil key, return %v, %v", n, err)
+	}
+	if values, err := m.GetAll([]interface{}{1, []int{}}); values != nil || !errors.Is(err, NonSupportKey) {
+		t.Errorf("GetAll with slice key, return %v, %v", values, err)
+	}
+	if v, ok := m.Get(1); !ok || v != 1 {
+		t.Errorf("failed RemoveAll removed key 1")
+	}
+}
+
+func TestBatchEvents(t *testing.T) {
+	m, _ := New(WithMaxEntries(2), WithConcurrencyLevel(1))
+	var events []string
+	m.Subscribe(func(ev Event) {
+		events = append(events, eventString(ev))
+	})
+	m.PutAll(map[interface{}]interface{}{1: "a"})
+	m.PutAll(map[interface{}]interface{}{2: "b"})
+	m.PutAll(map[interface{}]interface{}{3: "c"})
+	m.RemoveAll([]interface{}{3, 4})
+
+	want := []string{
+		"Insert 1 <nil>->a", "Insert 2 <nil>->b", "Insert 3 <nil>->c", "Evict 1 a-><nil>", "Remove 3 c-><nil>",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events\n%v\nwant\n%v", events, want)
+	}
+}
@@ -0,0 +1,236 @@
+package concurrent
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/* ---------------- Bulk Operations -------------- */
+
+/*
+* ForEach, Reduce, ReduceKeys, ReduceValues and Search traverse the map the
+* same weakly consistent way as MapIterator: every entry that is present for
+* the whole traversal is visited exactly once, concurrent updates may or may
+* not be seen.
+*
+* Like the bulk operations of Java 8's ConcurrentHashMap, each takes a
+* parallelismThreshold. If the map holds fewer entries than the threshold,
+* the operation runs sequentially in the calling goroutine. Otherwise the
+* segments are shared out between up to one goroutine per parallelismThreshold
+* entries, bounded by the map's parallelism (see WithParallelism, default
+* GOMAXPROCS) and the number of segments. A threshold of 1 gives maximal
+* parallelism, math.MaxInt64 always runs sequentially.
+*
+* Callbacks may run concurrently with each other and must not rely on any
+* order. If a callback panics, the remaining work is abandoned and the panic
+* is raised again in the calling goroutine.
+ */
+
+/**
+* ForEach calls action for every key-value pair.
+ */
+func (this *ConcurrentMap) ForEach(parallelismThreshold int64, action func(key interface{}, value interface{})) {
+	this.bulk(parallelismThreshold, func(s *Segment, stop *int32) {
+		s.forEach(stop, func(e *Entry, v interface{}) bool {
+			action(e.key, v)
+			return true
+		})
+	})
+}
+
+/**
+* Reduce transforms every key-value pair with transformer and combines the
+* non-nil results with reducer, which must be associative and commutative.
+*
+* @return the combined result, or nil if transformer returned nil for all pairs
+ */
+func (this *ConcurrentMap) Reduce(parallelismThreshold int64,
+	transformer func(key interface{}, value interface{}) interface{},
+	reducer func(r1 interface{}, r2 interface{}) interface{}) interface{} {
+	var lock sync.Mutex
+	var result interface{}
+	this.bulk(parallelismThreshold, func(s *Segment, stop *int32) {
+		var r interface{}
+		s.forEach(stop, func(e *Entry, v interface{}) bool {
+			if u := transformer(e.key, v); u != nil {
+				if r == nil {
+					r = u
+				} else {
+					r = reducer(r, u)
+				}
+			}
+			return true
+		})
+		if r != nil {
+			lock.Lock()
+			if result == nil {
+				result = r
+			} else {
+				result = reducer(result, r)
+			}
+			lock.Unlock()
+		}
+	})
+	return result
+}
+
+/**
+* ReduceKeys combines all keys with reducer.
+*
+* @return the combined result, or nil if the map is empty
+ */
+func (this *ConcurrentMap) ReduceKeys(parallelismThreshold int64,
+	reducer func(k1 interface{}, k2 interface{}) interface{}) interface{} {
+	return this.Reduce(parallelismThreshold, func(key interface{}, value interface{}) interface{} {
+		return key
+	}, reducer)
+}
+
+/**
+* ReduceValues combines all values with reducer.
+*
+* @return the combined result, or nil if the map is empty
+ */
+func (this *ConcurrentMap) ReduceValues(parallelismThreshold int64,
+	reducer func(v1 interface{}, v2 interface{}) interface{}) interface{} {
+	return this.Reduce(parallelismThreshold, func(key interface{}, value interface{}) interface{} {
+		return value
+	}, reducer)
+}
+
+/**
+* Search calls search for key-value pairs until it returns a non-nil result.
+* All goroutines stop as soon as one result is found, so search may still be
+* running for a few other pairs, and which result wins is not defined when
+* several pairs match.
+*
+* @return a non-nil result of search, or nil if there is none
+ */
+func (this *ConcurrentMap) Search(parallelismThreshold int64,
+	search func(key interface{}, value interface{}) interface{}) interface{} {
+	var result atomic.Value
+	this.bulk(parallelismThreshold, func(s *Segment, stop *int32) {
+		s.forEach(stop, func(e *Entry, v interface{}) bool {
+			if r := search(e.key, v); r != nil {
+				if atomic.CompareAndSwapInt32(stop, 0, 1) {
+					result.Store(&r)
+				}
+				return false
+			}
+			return true
+		})
+	})
+	if r := result.Load(); r != nil {
+		return *r.(*interface{})
+	}
+	return nil
+}
+
+/**
+* Returns the number of goroutines a bulk operation with the given
+* threshold uses for the current size of the map.
+ */
+func (this *ConcurrentMap) bulkWorkers(parallelismThreshold int64) int {
+	n := this.LongSize()
+	if parallelismThreshold <= 0 {
+		parallelismThreshold = 1
+	}
+	if n < parallelismThreshold {
+		return 1
+	}
+
+	workers := this.parallelism
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if tasks := n / parallelismThreshold; tasks < int64(workers) {
+		workers = int(tasks)
+	}
+	if n := len(this.segmentList()); workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+/**
+* Calls task for every segment, sharing the segments out between
+* goroutines. Tasks check stop and skip their remaining work once it
+* is set, it is set when a task panics or Search finds a result.
+ */
+func (this *ConcurrentMap) bulk(parallelismThreshold int64, task func(s *Segment, stop *int32)) {
+	segments := this.segmentList()
+	var next int32 = -1
+	var stop int32 = 0
+	var panicVal interface{}
+	var panicOnce sync.Once
+
+	work := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				atomic.StoreInt32(&stop, 1)
+				panicOnce.Do(func() { panicVal = r })
+			}
+		}()
+		for atomic.LoadInt32(&stop) == 0 {
+			i := int(atomic.AddInt32(&next, 1))
+			if i >= len(segments) {
+				return
+			}
+			task(segments[i], &stop)
+		}
+	}
+
+	workers := this.bulkWorkers(parallelismThreshold)
+	if workers == 1 {
+		work()
+	} else {
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				work()
+			}()
+		}
+		wg.Wait()
+	}
+	if panicVal != nil {
+		panic(panicVal)
+	}
+}
+
+/**
+* Calls f for every entry of the segment that has not expired with its value, until f returns
+* false or stop is set. Reads the table without locking like get.
+ */
+func (this *Segment) forEach(stop *int32, f func(e *Entry, value interface{}) bool) {
+	if atomic.LoadInt64(&this.count) == 0 {
+		return
+	}
+	tab := this.loadTable()
+	for i := 0; i < len(tab); i++ {
+		if atomic.LoadInt32(stop) != 0 {
+			return
+		}
+		first := (*Entry)(atomic.LoadPointer(&tab[i]))
+		if first == nil {
+			continue
+		}
+		goOn := true
+		forEachInBin(first, func(e *Entry) {
+			if !goOn {
+				return
+			}
+			if v := this.liveValue(e); v != nil {
+				goOn = f(e, v)
+			}
+		})
+		if !goOn {
+			return
+		}
+	}
+}
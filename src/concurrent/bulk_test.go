@@ -0,0 +1,102 @@
+package concurrent
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+)
+
+func newBulkTestMap(t *testing.T, n int) *ConcurrentMap {
+	m, err := New(WithParallelism(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	return m
+}
+
+func TestForEach(t *testing.T) {
+	n := 10000
+	m := newBulkTestMap(t, n)
+	for _, threshold := range []int64{1, 1000, math.MaxInt64} {
+		var count, sum int64
+		m.ForEach(threshold, func(k, v interface{}) {
+			atomic.AddInt64(&count, 1)
+			atomic.AddInt64(&sum, int64(v.(int)))
+		})
+		if count != int64(n) || sum != int64(n*(n-1)/2) {
+			t.Errorf("threshold %v, ForEach visited %v entries with sum %v", threshold, count, sum)
+		}
+	}
+}
+
+func TestReduce(t *testing.T) {
+	n := 10000
+	m := newBulkTestMap(t, n)
+	add := func(a, b interface{}) interface{} { return a.(int) + b.(int) }
+	for _, threshold := range []int64{1, math.MaxInt64} {
+		if r := m.ReduceValues(threshold, add); r != n*(n-1)/2 {
+			t.Errorf("threshold %v, ReduceValues return %v", threshold, r)
+		}
+		if r := m.ReduceKeys(threshold, add); r != n*(n-1)/2 {
+			t.Errorf("threshold %v, ReduceKeys return %v", threshold, r)
+		}
+		evens := m.Reduce(threshold, func(k, v interface{}) interface{} {
+			if k.(int)%2 == 0 {
+				return 1
+			}
+			return nil
+		}, add)
+		if evens != n/2 {
+			t.Errorf("threshold %v, Reduce counted %v even keys, want %v", threshold, evens, n/2)
+		}
+	}
+	if r := NewConcurrentMap().ReduceValues(1, add); r != nil {
+		t.Errorf("ReduceValues of empty map, return %v, want nil", r)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	n := 10000
+	m := newBulkTestMap(t, n)
+	var calls int64
+	r := m.Search(1, func(k, v interface{}) interface{} {
+		atomic.AddInt64(&calls, 1)
+		if k == 1234 {
+			return v
+		}
+		return nil
+	})
+	if r != 1234 {
+		t.Errorf("Search return %v, want 1234", r)
+	}
+	if r := m.Search(1, func(k, v interface{}) interface{} { return nil }); r != nil {
+		t.Errorf("Search without match, return %v, want nil", r)
+	}
+
+	//stops early, a search that matches everything visits few entries
+	calls = 0
+	m.Search(math.MaxInt64, func(k, v interface{}) interface{} {
+		atomic.AddInt64(&calls, 1)
+		return k
+	})
+	if calls != 1 {
+		t.Errorf("sequential Search called search %v times after first match, want 1", calls)
+	}
+}
+
+func TestBulkPanic(t *testing.T) {
+	m := newBulkTestMap(t, 1000)
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("recover %v, want boom", r)
+		}
+	}()
+	m.ForEach(1, func(k, v interface{}) {
+		if k == 500 {
+			panic("boom")
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package concurrent
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestComputeIfAbsentCallsFactoryOnce(t *testing.T) {
+	m := NewConcurrentMap()
+	var calls int32
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := m.ComputeIfAbsent("memo", func() interface{} {
+				atomic.AddInt32(&calls, 1)
+				return 42
+			})
+			if v != 42 || err != nil {
+				t.Errorf("ComputeIfAbsent return %v, %v, want 42, nil", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("factory called %v times, want 1", calls)
+	}
+
+	v, _ := m.ComputeIfAbsent("nothing", func() interface{} { return nil })
+	if found, _ := m.ContainsKey("nothing"); v != nil || found {
+		t.Errorf("ComputeIfAbsent with nil factory result, return %v and mapping %v", v, found)
+	}
+}
+
+func TestComputeIfPresent(t *testing.T) {
+	m := NewConcurrentMap()
+	called := false
+	v, err := m.ComputeIfPresent(1, func(interface{}) interface{} {
+		called = true
+		return 1
+	})
+	if v != nil || err != nil || called {
+		t.Errorf("ComputeIfPresent on absent key, return %v, %v, called %v", v, err, called)
+	}
+
+	m.Put(1, 10)
+	v, _ = m.ComputeIfPresent(1, func(old interface{}) interface{} { return old.(int) + 1 })
+	if got, _ := m.Get(1); v != 11 || got != 11 {
+		t.Errorf("ComputeIfPresent, return %v and mapping %v, want 11", v, got)
+	}
+	v, _ = m.ComputeIfPresent(1, func(interface{}) interface{} { return nil })
+	if _, ok := m.Get(1); v != nil || ok {
+		t.Errorf("ComputeIfPresent returning nil does not remove the key")
+	}
+}
+
+func TestCompute(t *testing.T) {
+	m := NewConcurrentMap()
+	inc := func(old interface{}) interface{} {
+		if old == nil {
+			return 1
+		}
+		return old.(int) + 1
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m.Compute("counter", inc)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := m.Get("counter"); v != 8000 {
+		t.Errorf("counter is %v after concurrent Compute, want 8000", v)
+	}
+
+	v, _ := m.Compute("counter", func(interface{}) interface{} { return nil })
+	if v != nil || m.Size() != 0 {
+		t.Errorf("Compute returning nil, return %v, size %v", v, m.Size())
+	}
+}
+
+func TestMerge(t *testing.T) {
+	m := NewConcurrentMap()
+	sum := func(old, v interface{}) interface{} { return old.(int) + v.(int) }
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m.Merge(i%10, 1, sum)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		if v, _ := m.Get(i); v != 800 {
+			t.Errorf("Merge counter %v is %v, want 800", i, v)
+		}
+	}
+
+	v, _ := m.Merge(0, 1, func(interface{}, interface{}) interface{} { return nil })
+	if _, ok := m.Get(0); v != nil || ok {
+		t.Errorf("Merge returning nil does not remove the key")
+	}
+	if _, err := m.Merge(0, nil, sum); err != NilValueError {
+		t.Errorf("Merge nil value, return %v, want NilValueError", err)
+	}
+}
+
+func TestComputePanic(t *testing.T) {
+	m := NewConcurrentMap()
+	m.Put(1, 10)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("panic in remapping was not propagated")
+			}
+		}()
+		m.Compute(1, func(interface{}) interface{} { panic("boom") })
+	}()
+
+	//the lock must be released and the mapping unchanged
+	if v, _ := m.Get(1); v != 10 {
+		t.Errorf("Get after panic, return %v, want 10", v)
+	}
+	m.Put(1, 11)
+	if v, _ := m.Get(1); v != 11 {
+		t.Errorf("Put after panic, return %v, want 11", v)
+	}
+}
+
+func TestComputeNilArgs(t *testing.T) {
+	m := NewConcurrentMap()
+	if _, err := m.ComputeIfAbsent(nil, func() interface{} { return 1 }); err != NilKeyError {
+		t.Errorf("ComputeIfAbsent nil key, return %v, want NilKeyError", err)
+	}
+	if _, err := m.Compute(1, nil); err != NilActionError {
+		t.Errorf("Compute nil remapping, return %v, want NilActionError", err)
+	}
+}
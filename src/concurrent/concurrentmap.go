@@ -3,11 +3,12 @@ package concurrent
 import (
 	"errors"
 	//"fmt"
-	"io"
+	"hashkey"
 	"math"
 	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -24,6 +25,14 @@ const (
 	 */
 	DEFAULT_LOAD_FACTOR float32 = 0.75
 
+	/**
+	 * The largest load factor accepted by the constructors. Long bins
+	 * are turned into tree bins, so a load factor above one saves memory
+	 * at some cost in lookups, but far larger values only make every
+	 * table tiny, and capacity*loadFactor must fit a threshold.
+	 */
+	MAX_LOAD_FACTOR float32 = 64
+
 	/**
 	 * The default concurrency level for this table, used when not
 	 * otherwise specified in a constructor.
@@ -45,56 +54,172 @@ const (
 	MAX_SEGMENTS int = 1 << 16 // slightly conservative
 
 	/**
-	 * Number of unsynchronized retries in size and containsValue
-	 * methods before resorting to locking. This is used to avoid
+	 * Number of unsynchronized retries in containsValue and
+	 * keysForValue methods before resorting to locking. This is used to avoid
 	 * unbounded retries if tables undergo continuous modification
 	 * which would make it impossible to obtain an accurate result.
 	 */
 	RETRIES_BEFORE_LOCK int = 2
+
+	/**
+	 * A segment's table is halved when its count drops below
+	 * threshold / SHRINK_DIVISOR. The gap between the grow and
+	 * shrink thresholds keeps a segment that hovers around one size
+	 * from resizing back and forth. A table never shrinks below the
+	 * capacity the segment was created with.
+	 */
+	SHRINK_DIVISOR int64 = 4
+
+	/**
+	 * The bin count threshold for using a tree rather than a chain
+	 * for a bin. A chain is converted to a tree when an entry is
+	 * added to a bin with at least this many entries.
+	 */
+	TREEIFY_THRESHOLD int = 8
+
+	/**
+	 * The bin count threshold for untreeifying a bin during a
+	 * remove. Should be less than TREEIFY_THRESHOLD so a bin that
+	 * hovers around the limit does not convert back and forth.
+	 */
+	UNTREEIFY_THRESHOLD int = 6
 )
 
 var (
-	Debug           = false
-	NilKeyError     = errors.New("Do not support nil as key")
-	NilValueError   = errors.New("Do not support nil as value")
-	NilActionError  = errors.New("Do not support nil as action")
-	NonSupportKey   = errors.New("Non support for pointer, interface, channel, slice, map and function ")
-	IllegalArgError = errors.New("IllegalArgumentException")
+	Debug            = false
+	NilKeyError      = errors.New("Do not support nil as key")
+	NilValueError    = errors.New("Do not support nil as value")
+	NilActionError   = errors.New("Do not support nil as action")
+	NonSupportKey    = errors.New("Non support for pointer, interface, channel, slice, map and function ")
+	IllegalArgError  = errors.New("IllegalArgumentException")
+	CorruptDataError = errors.New("Corrupt or truncated serialized map")
 )
 
-type Hashable interface {
+/**
+* Hashable is implemented by keys that provide their own hash code and
+* equality, such as a key holding a pointer or a slice. It is hashkey.Key,
+* the key contract shared with gotomic.Hash, so the same key types, for
+* example hashkey.Int or hashkey.StructOf(v), work in both maps. The map
+* hashes the result of HashCode again with its seed, see encoding.go, so
+* HashCode need not be a strong hash.
+*/
+type Hashable = hashkey.Key
+
+/**
+* BytesHashable is the former key contract, a key that only implements it
+* is still hashed from the bytes returned by HashBytes.
+*
+* Deprecated: implement Hashable instead, HashBytes allocates a byte slice
+* on every lookup. A key that implements both is hashed from HashCode.
+*/
+type BytesHashable interface {
 	HashBytes() []byte
 	Equals(v2 interface{}) bool
 }
 
 type hashEnginer struct {
-	putFunc func(w io.Writer, v interface{})
+	plan *keyPlan
 }
 
-//segments is read-only, don't need synchronized
+/**
+ * HashAlgorithm selects the function that turns the bytes of a key into
+ * its hash code. Both are keyed with the per-map seed.
+ */
+type HashAlgorithm int
+
+const (
+	/**
+	 * 32-bit FNV-1a over the seed followed by the key bytes. Fast, and
+	 * a random seed keeps hash codes from being known in advance, but
+	 * FNV is not a cryptographic hash.
+	 */
+	FNV1a HashAlgorithm = iota
+
+	/**
+	 * SipHash-2-4 keyed with the seed. Slower than FNV1a, use it when
+	 * keys come from untrusted input and hash flooding is a concern.
+	 */
+	SipHash
+)
+
+//the segment directory is immutable and replaced atomically, see resegment.go
 type ConcurrentMap struct {
-	engChecker *Once
-	eng        unsafe.Pointer
+	/**
+	 * Seed of the hash function, drawn at random for every map
+	 * unless given to NewConcurrentMapWithSeed.
+	 */
+	seed    uint64
+	hashAlg HashAlgorithm
 
 	/**
-	 * Kind of Reflect value for key
+	 * Odd multiplier derived from seed. segmentFor multiplies the hash
+	 * code with it before taking the upper bits, so which keys share a
+	 * segment also depends on the seed.
 	 */
-	kind unsafe.Pointer
+	segmentSeed uint32
+
+	/**
+	 * Maximum number of goroutines of a bulk operation,
+	 * 0 means GOMAXPROCS.
+	 */
+	parallelism int
+
+	/**
+	 * The directory of the segments, each of which is a specialized hash
+	 * table. Points to an immutable segmentDir that is replaced when a
+	 * segment is split, see resegment.go.
+	 */
+	dir unsafe.Pointer
+
+	/**
+	 * Serializes the splits of segments with the operations that lock
+	 * or visit every segment, see lockAllSegments.
+	 */
+	resegmentLock *sync.Mutex
+
+	/**
+	 * Segments whose lock is contended are split until the map has this
+	 * many segments, 0 disables it, see WithMaxConcurrencyLevel.
+	 */
+	maxSegments int32
+	splitting   int32 //1 while a split started by contention is pending
+
 	/**
-	 * Mask value for indexing into segments. The upper bits of a
-	 * key's hash code are used to choose the segment.
+	 * Total number of mappings. Segments add to it when their count
+	 * changes, so Size never needs to lock or rescan the segments.
 	 */
-	segmentMask int
+	counter *longAdder
 
 	/**
-	 * Shift value for indexing within segments.
+	 * Types given by WithKeyType and WithValueType, nil if not given.
+	 * UnmarshalJSON decodes keys and values into them.
 	 */
-	segmentShift uint
+	keyType   reflect.Type
+	valueType reflect.Type
 
 	/**
-	 * The segments, each of which is a specialized hash table
+	 * Time to live of values written without PutWithTTL, 0 if they never
+	 * expire. expiring is set once any value has a deadline, until then
+	 * the methods that look for expired entries return at once.
 	 */
-	segments []*Segment
+	defaultTTL time.Duration
+	expiring   int32
+
+	clock   func() int64 //returns the time in UnixNano, time.Now if nil, replaced by tests
+	janitor *janitor     //nil unless started by WithJanitor
+
+	/**
+	 * Settings of a bounded map, see WithMaxWeight. newPolicy is nil if
+	 * the map is not bounded.
+	 */
+	newPolicy func() EvictionPolicy
+	weigher   func(key, value interface{}) int64
+	onEvict   func(key, value interface{})
+
+	lockStrategy LockStrategy //the lock of the segments, see WithLockStrategy
+	lockStats    bool         //time the segment locks, see WithLockStats
+
+	subscribers unsafe.Pointer //point to []*subscriber, see Subscribe
 }
 
 /**
@@ -103,28 +228,28 @@ type ConcurrentMap struct {
  * @return the segment
  */
 func (this *ConcurrentMap) segmentFor(hash uint32) *Segment {
-	//默认segmentShift是28，segmentMask是（0xFFFFFFF）,hash>>this.segmentShift就是取前面4位
-	//&segmentMask似乎没有必要
+	//默认shift是28，hash>>shift就是取前面4位
 	//get first four bytes
-	return this.segments[(hash>>this.segmentShift)&uint32(this.segmentMask)]
+	dir := this.loadDir()
+	return dir.slots[dir.slotIndex(hash, this.segmentSeed)]
 }
 
 /**
  * Returns true if this map contains no key-value mappings.
  */
 func (this *ConcurrentMap) IsEmpty() bool {
-	segments := this.segments
+	segments := this.segmentList()
 	/*
 	 * if any segment count isn't zero, Map will be no empty.
 	 * 检查是否每个segment的count是否为0，并记录modCount和总和
 	 */
-	mc := make([]int32, len(segments))
-	var mcsum int32 = 0
+	mc := make([]int64, len(segments))
+	var mcsum int64 = 0
 	for i := 0; i < len(segments); i++ {
-		if atomic.LoadInt32(&segments[i].count) != 0 {
+		if atomic.LoadInt64(&segments[i].count) != 0 {
 			return false
 		} else {
-			mc[i] = atomic.LoadInt32(&segments[i].modCount)
+			mc[i] = atomic.LoadInt64(&segments[i].modCount)
 			mcsum += mc[i]
 		}
 	}
@@ -137,7 +262,7 @@ func (this *ConcurrentMap) IsEmpty() bool {
 	 */
 	if mcsum != 0 {
 		for i := 0; i < len(segments); i++ {
-			if atomic.LoadInt32(&segments[i].count) != 0 || mc[i] != atomic.LoadInt32(&segments[i].modCount) {
+			if atomic.LoadInt64(&segments[i].count) != 0 || mc[i] != atomic.LoadInt64(&segments[i].modCount) {
 				return false
 			}
 		}
@@ -146,58 +271,31 @@ func (this *ConcurrentMap) IsEmpty() bool {
 }
 
 /**
- * Returns the number of key-value mappings in this map.
+ * Returns the number of key-value mappings in this map, or math.MaxInt32
+ * if the map holds more mappings, see LongSize.
  */
 func (this *ConcurrentMap) Size() int32 {
-	segments := this.segments
-	var sum int32 = 0
-	var check int32 = 0
-	mc := make([]int32, len(segments))
-
-	// Try a few times to get accurate count. On failure due to
-	// continuous async changes in table, resort to locking.
-	for k := 0; k < RETRIES_BEFORE_LOCK; k++ {
-		check = 0
-		sum = 0
-		var mcsum int32 = 0
-		for i := 0; i < len(segments); i++ {
-			sum += atomic.LoadInt32(&segments[i].count)
-			mc[i] = atomic.LoadInt32(&segments[i].modCount)
-			mcsum += mc[i]
-		}
-		if mcsum != 0 {
-			for i := 0; i < len(segments); i++ {
-				check += atomic.LoadInt32(&segments[i].count)
-				if mc[i] != atomic.LoadInt32(&segments[i].modCount) {
-					//async change happens, force retry
-					check = -1 //
-					break
-				}
-			}
-		}
-
-		//twoice counts ar same, it means no async change,
-		//then will return sum
-		if check == sum {
-			break
-		}
+	n := this.LongSize()
+	if n > math.MaxInt32 {
+		return math.MaxInt32
 	}
+	return int32(n)
+}
 
-	//async change happens in each loop
-	//lock all segments to get accurate count
-	if check != sum {
-		sum = 0
-		for i := 0; i < len(segments); i++ {
-			segments[i].lock.Lock()
-		}
-		for i := 0; i < len(segments); i++ {
-			sum += segments[i].count
-		}
-		for i := 0; i < len(segments); i++ {
-			segments[i].lock.Unlock()
-		}
+/**
+ * Returns the number of key-value mappings in this map.
+ * The count is kept by a striped counter that is read without locking,
+ * while updates are in flight it may miss some of them, like the size
+ * of Java 8's ConcurrentHashMap.
+ * Expired entries are counted until they are removed, see RemoveExpired.
+ */
+func (this *ConcurrentMap) LongSize() int64 {
+	n := this.counter.sum()
+	if n < 0 {
+		//a remove was counted before the put it removes
+		return 0
 	}
-	return sum
+	return n
 }
 
 /**
@@ -211,13 +309,13 @@ func (this *ConcurrentMap) Get(key interface{}) (value interface{}, ok bool) {
 	//if atomic.LoadPointer(&this.kind) == nil {
 	//	return nil, nil
 	//}
-	//if hash, e := hashKey(key, this, false); e != nil {
+	//if hash, e := hashKey(key, this); e != nil {
 	//	ok = false
 	//} else {
 	//	value = this.segmentFor(hash).get(key, hash)
 	//	ok = true
 	//}
-	hash, e := hashKey(key, this, false)
+	hash, e := hashKey(key, this)
 	if e != nil {
 		ok = false
 	} else {
@@ -238,22 +336,121 @@ func (this *ConcurrentMap) ContainsKey(key interface{}) (found bool, err error)
 	if isNil(key) {
 		return false, NilKeyError
 	}
-	if atomic.LoadPointer(&this.kind) == nil {
-		return false, nil
-	}
-
-	if hash, e := hashKey(key, this, false); e != nil {
+	if hash, e := hashKey(key, this); e != nil {
 		err = e
 	} else {
-		Printf("ContainsKey, %v, %v\n", key, hash)
+		if Debug {
+			Printf("ContainsKey, %v, %v\n", key, hash)
+		}
 		found = this.segmentFor(hash).containsKey(key, hash)
 	}
-	//hash := hash2(hashKey(key, this, false))
+	//hash := hash2(hashKey(key, this))
 	//Printf("ContainsKey, %v, %v\n", key, hash)
 	//found = this.segmentFor(hash).containsKey(key, hash)
 	return
 }
 
+/**
+* Returns true if this map maps one or more keys to the specified value.
+* Values are compared with ==, so they must be comparable,
+* use ContainsValueFunc otherwise.
+*/
+func (this *ConcurrentMap) ContainsValue(value interface{}) (found bool, err error) {
+	return this.ContainsValueFunc(value, equalValues)
+}
+
+/**
+* Like ContainsValue, but compares values with equal, which is called
+* with a value of the map and the specified value.
+*/
+func (this *ConcurrentMap) ContainsValueFunc(value interface{}, equal func(v1, v2 interface{}) bool) (found bool, err error) {
+	if isNil(value) {
+		return false, NilValueError
+	}
+	if equal == nil {
+		return false, NilActionError
+	}
+	return len(this.keysForValue(value, equal, true)) != 0, nil
+}
+
+/**
+* Returns the keys that are mapped to the specified value.
+* Values are compared with ==, so they must be comparable,
+* use KeysForValueFunc otherwise.
+*/
+func (this *ConcurrentMap) KeysForValue(value interface{}) (keys []interface{}, err error) {
+	return this.KeysForValueFunc(value, equalValues)
+}
+
+/**
+* Like KeysForValue, but compares values with equal, which is called
+* with a value of the map and the specified value.
+*/
+func (this *ConcurrentMap) KeysForValueFunc(value interface{}, equal func(v1, v2 interface{}) bool) (keys []interface{}, err error) {
+	if isNil(value) {
+		return nil, NilValueError
+	}
+	if equal == nil {
+		return nil, NilActionError
+	}
+	return this.keysForValue(value, equal, false), nil
+}
+
+func equalValues(v1, v2 interface{}) bool {
+	return v1 == v2
+}
+
+/**
+* Scans all segments for keys mapped to value, stopping at the first one if
+* firstOnly. Like IsEmpty, the segments are scanned without locking and the
+* scan is retried if the modCounts show a concurrent change in size,
+* after RETRIES_BEFORE_LOCK attempts all segments are locked.
+*/
+func (this *ConcurrentMap) keysForValue(value interface{}, equal func(v1, v2 interface{}) bool, firstOnly bool) (keys []interface{}) {
+	segments := this.segmentList()
+	mc := make([]int64, len(segments))
+
+	for k := 0; k < RETRIES_BEFORE_LOCK; k++ {
+		keys = keys[:0]
+		var mcsum int64 = 0
+		for i := 0; i < len(segments); i++ {
+			mc[i] = atomic.LoadInt64(&segments[i].modCount)
+			mcsum += mc[i]
+			keys = segments[i].keysForValue(keys, value, equal, firstOnly, false)
+			if firstOnly && len(keys) != 0 {
+				//a found value is an answer even if the map changes later
+				return
+			}
+		}
+		cleanSweep := true
+		if mcsum != 0 {
+			for i := 0; i < len(segments); i++ {
+				if mc[i] != atomic.LoadInt64(&segments[i].modCount) {
+					//async change happens, force retry
+					cleanSweep = false
+					break
+				}
+			}
+		}
+		if cleanSweep {
+			return
+		}
+	}
+
+	//async change happens in each loop
+	//lock all segments to get accurate result
+	keys = keys[:0]
+	segments = this.lockAllSegments()
+	defer this.unlockAllSegments(segments)
+	for i := 0; i < len(segments); i++ {
+		keys = segments[i].keysForValue(keys, value, equal, firstOnly, true)
+		if firstOnly && len(keys) != 0 {
+			break
+		}
+	}
+	return
+}
+
 /**
 * Maps the specified key to the specified value in this table.
 * Neither the key nor the value can be nil.
@@ -275,13 +472,15 @@ func (this *ConcurrentMap) Put(key interface{}, value interface{}) (oldVal inter
 		return nil
 	}
 
-	if hash, e := hashKey(key, this, false); e != nil {
+	if hash, e := hashKey(key, this); e != nil {
 		oldVal = nil
 	} else {
-		Printf("Put, %v, %v\n", key, hash)
-		oldVal = this.segmentFor(hash).put(key, hash, value, false, nil)
+		if Debug {
+			Printf("Put, %v, %v\n", key, hash)
+		}
+		oldVal = this.segmentFor(hash).put(key, hash, value, this.defaultTTL, false)
 	}
-	//hash := hash2(hashKey(key, this, true))
+	//hash := hash2(hashKey(key, this))
 	//Printf("Put, %v, %v\n", key, hash)
 	//oldVal = this.segmentFor(hash).put(key, hash, value, false)
 	return
@@ -306,13 +505,15 @@ func (this *ConcurrentMap) PutIfAbsent(key interface{}, value interface{}) (oldV
 		return nil, NilValueError
 	}
 
-	if hash, e := hashKey(key, this, false); e != nil {
+	if hash, e := hashKey(key, this); e != nil {
 		err = e
 	} else {
-		Printf("PutIfAbsent, %v, %v\n", key, hash)
-		oldVal = this.segmentFor(hash).put(key, hash, value, true, nil)
+		if Debug {
+			Printf("PutIfAbsent, %v, %v\n", key, hash)
+		}
+		oldVal = this.segmentFor(hash).put(key, hash, value, this.defaultTTL, true)
 	}
-	//hash := hash2(hashKey(key, this, true))
+	//hash := hash2(hashKey(key, this))
 	//Printf("PutIfAbsent, %v, %v\n", key, hash)
 	//oldVal = this.segmentFor(hash).put(key, hash, value, true)
 	return
@@ -340,31 +541,121 @@ func (this *ConcurrentMap) Update(key interface{}, action func(oldVal interface{
 		return nil, NilActionError
 	}
 
-	if hash, e := hashKey(key, this, false); e != nil {
+	if hash, e := hashKey(key, this); e != nil {
 		err = e
 	} else {
-		Printf("Put, %v, %v\n", key, hash)
-		oldVal = this.segmentFor(hash).put(key, hash, nil, false, action)
+		if Debug {
+			Printf("Put, %v, %v\n", key, hash)
+		}
+		oldVal, _ = this.segmentFor(hash).compute(key, hash, false, false, action)
 	}
-	//hash := hash2(hashKey(key, this, true))
+	//hash := hash2(hashKey(key, this))
 	//Printf("Put, %v, %v\n", key, hash)
 	//oldVal = this.segmentFor(hash).put(key, hash, value, false)
 	return
 }
 
 /**
-* Copies all of the mappings from the specified map to this one.
-* These mappings replace any mappings that this map had for any of the
-* keys currently in the specified map.
+* If the key is absent, maps it to the value returned by factory and
+* returns that value. factory is called under the segment lock, so it is
+* called at most once even if many goroutines ask for the same absent key.
+* If factory returns nil or panics, no mapping is recorded.
 *
-* @param m mappings to be stored in this map
+* @return the current (existing or computed) value associated with key,
+*         or nil if factory returned nil
 */
-func (this *ConcurrentMap) PutAll(m map[interface{}]interface{}) (err error) {
-	if isNil(m) {
-		err = errors.New("Cannot copy nil map")
+func (this *ConcurrentMap) ComputeIfAbsent(key interface{}, factory func() interface{}) (value interface{}, err error) {
+	if isNil(key) {
+		return nil, NilKeyError
+	}
+	if factory == nil {
+		return nil, NilActionError
+	}
+
+	if hash, e := hashKey(key, this); e != nil {
+		err = e
+	} else {
+		_, value = this.segmentFor(hash).compute(key, hash, true, false, func(interface{}) interface{} {
+			return factory()
+		})
+	}
+	return
+}
+
+/**
+* If the key is present, maps it to the value returned by remapping,
+* which gets the current value. If remapping returns nil the mapping is
+* removed. If remapping panics the mapping is left unchanged.
+*
+* @return the new value associated with key, or nil if there is none
+*/
+func (this *ConcurrentMap) ComputeIfPresent(key interface{}, remapping func(oldVal interface{}) (newVal interface{})) (value interface{}, err error) {
+	if isNil(key) {
+		return nil, NilKeyError
+	}
+	if remapping == nil {
+		return nil, NilActionError
+	}
+
+	if hash, e := hashKey(key, this); e != nil {
+		err = e
+	} else {
+		_, value = this.segmentFor(hash).compute(key, hash, false, true, remapping)
+	}
+	return
+}
+
+/**
+* Maps the key to the value returned by remapping, which gets the current
+* value, or nil if the key is absent. If remapping returns nil the mapping
+* is removed (or stays absent). If remapping panics the mapping is left
+* unchanged. Unlike Update, Compute returns the new value.
+*
+* @return the new value associated with key, or nil if there is none
+*/
+func (this *ConcurrentMap) Compute(key interface{}, remapping func(oldVal interface{}) (newVal interface{})) (value interface{}, err error) {
+	if isNil(key) {
+		return nil, NilKeyError
+	}
+	if remapping == nil {
+		return nil, NilActionError
+	}
+
+	if hash, e := hashKey(key, this); e != nil {
+		err = e
+	} else {
+		_, value = this.segmentFor(hash).compute(key, hash, false, false, remapping)
+	}
+	return
+}
+
+/**
+* If the key is absent, maps it to value. Otherwise maps it to the result
+* of remapping the current value and the given value, or removes it if
+* that result is nil. If remapping panics the mapping is left unchanged.
+*
+* @return the new value associated with key, or nil if there is none
+*/
+func (this *ConcurrentMap) Merge(key interface{}, value interface{}, remapping func(oldVal interface{}, value interface{}) (newVal interface{})) (newVal interface{}, err error) {
+	if isNil(key) {
+		return nil, NilKeyError
 	}
-	for k, v := range m {
-		this.Put(k, v)
+	if isNil(value) {
+		return nil, NilValueError
+	}
+	if remapping == nil {
+		return nil, NilActionError
+	}
+
+	if hash, e := hashKey(key, this); e != nil {
+		err = e
+	} else {
+		_, newVal = this.segmentFor(hash).compute(key, hash, false, false, func(oldVal interface{}) interface{} {
+			if oldVal == nil {
+				return value
+			}
+			return remapping(oldVal, value)
+		})
 	}
 	return
 }
@@ -381,14 +672,16 @@ func (this *ConcurrentMap) Remove(key interface{}) (oldVal interface{}, ok bool)
 		return nil, false
 	}
 
-	if hash, e := hashKey(key, this, false); e != nil {
+	if hash, e := hashKey(key, this); e != nil {
 		ok = false
 	} else {
 		ok = true
-		Printf("Remove, %v, %v\n", key, hash)
+		if Debug {
+			Printf("Remove, %v, %v\n", key, hash)
+		}
 		oldVal = this.segmentFor(hash).remove(key, hash, nil)
 	}
-	//hash := hash2(hashKey(key, this, true))
+	//hash := hash2(hashKey(key, this))
 	//Printf("Remove, %v, %v\n", key, hash)
 	//oldVal = this.segmentFor(hash).remove(key, hash, nil)
 	return
@@ -408,13 +701,15 @@ func (this *ConcurrentMap) RemoveEntry(key interface{}, value interface{}) (ok b
 		return false, NilValueError
 	}
 
-	if hash, e := hashKey(key, this, false); e != nil {
+	if hash, e := hashKey(key, this); e != nil {
 		err = e
 	} else {
-		Printf("RemoveEntry, %v, %v\n", key, hash)
+		if Debug {
+			Printf("RemoveEntry, %v, %v\n", key, hash)
+		}
 		ok = this.segmentFor(hash).remove(key, hash, value) != nil
 	}
-	//hash := hash2(hashKey(key, this, true))
+	//hash := hash2(hashKey(key, this))
 	//Printf("RemoveEntry, %v, %v\n", key, hash)
 	//ok = this.segmentFor(hash).remove(key, hash, value) != nil
 	return
@@ -435,13 +730,15 @@ func (this *ConcurrentMap) CompareAndReplace(key interface{}, oldVal interface{}
 		return false, NilValueError
 	}
 
-	if hash, e := hashKey(key, this, false); e != nil {
+	if hash, e := hashKey(key, this); e != nil {
 		err = e
 	} else {
-		Printf("CompareAndReplace, %v, %v\n", key, hash)
+		if Debug {
+			Printf("CompareAndReplace, %v, %v\n", key, hash)
+		}
 		ok = this.segmentFor(hash).compareAndReplace(key, hash, oldVal, newVal)
 	}
-	//hash := hash2(hashKey(key, this, true))
+	//hash := hash2(hashKey(key, this))
 	//Printf("CompareAndReplace, %v, %v\n", key, hash)
 	//ok = this.segmentFor(hash).replaceWithOld(key, hash, oldVal, newVal)
 	return
@@ -462,13 +759,15 @@ func (this *ConcurrentMap) Replace(key interface{}, value interface{}) (oldVal i
 		return nil, NilValueError
 	}
 
-	if hash, e := hashKey(key, this, false); e != nil {
+	if hash, e := hashKey(key, this); e != nil {
 		err = e
 	} else {
-		Printf("Replace, %v, %v\n", key, hash)
+		if Debug {
+			Printf("Replace, %v, %v\n", key, hash)
+		}
 		oldVal = this.segmentFor(hash).replace(key, hash, value)
 	}
-	//hash := hash2(hashKey(key, this, true))
+	//hash := hash2(hashKey(key, this))
 	//Printf("Replace, %v, %v\n", key, hash)
 	//oldVal = this.segmentFor(hash).replace(key, hash, value)
 	return
@@ -478,8 +777,38 @@ func (this *ConcurrentMap) Replace(key interface{}, value interface{}) (oldVal i
 * Removes all of the mappings from this map.
 */
 func (this *ConcurrentMap) Clear() {
-	for i := 0; i < len(this.segments); i++ {
-		this.segments[i].clear()
+	if !this.hasSubscribers() {
+		this.resegmentLock.Lock()
+		defer this.resegmentLock.Unlock()
+		segments := this.segmentList()
+		for i := 0; i < len(segments); i++ {
+			segments[i].clear()
+		}
+		return
+	}
+
+	//clear all segments at once, so that one EventClear orders the clear with all other events
+	segments := this.lockAllSegments()
+	defer this.unlockAllSegments(segments)
+	for i := 0; i < len(segments); i++ {
+		segments[i].clearLocked()
+	}
+	this.emit(EventClear, nil, 0, nil, nil)
+}
+
+/**
+* Compact shrinks the table of every segment to the smallest capacity
+* that holds its current entries without exceeding the load factor,
+* but not below the initial capacity, so the memory held by tables
+* sized for an earlier peak can be reclaimed.
+* Segments are locked one at a time, readers are never blocked.
+*/
+func (this *ConcurrentMap) Compact() {
+	this.resegmentLock.Lock()
+	defer this.resegmentLock.Unlock()
+	segments := this.segmentList()
+	for i := 0; i < len(segments); i++ {
+		segments[i].compact()
 	}
 }
 
@@ -498,93 +827,58 @@ func (this *ConcurrentMap) ToSlice() (kvs []*Entry) {
 	return
 }
 
-func (this *ConcurrentMap) parseKey(key interface{}) (err error) {
-	this.engChecker.Do(func() {
-		var eng *hashEnginer
-
-		val := key
-
-		if _, ok := val.(Hashable); ok {
-			eng = hasherEng
-		} else {
-			switch v := val.(type) {
-			case bool:
-				_ = v
-				eng = boolEng
-			case int:
-				eng = intEng
-			case int8:
-				eng = int8Eng
-			case int16:
-				eng = int16Eng
-			case int32:
-				eng = int32Eng
-			case int64:
-				eng = int64Eng
-			case uint:
-				eng = uintEng
-			case uint8:
-				eng = uint8Eng
-			case uint16:
-				eng = uint16Eng
-			case uint32:
-				eng = uint32Eng
-			case uint64:
-				eng = uint64Eng
-			case uintptr:
-				eng = uintptrEng
-			case float32:
-				eng = float32Eng
-			case float64:
-				eng = float64Eng
-			case complex64:
-				eng = complex64Eng
-			case complex128:
-				eng = complex128Eng
-			case string:
-				eng = stringEng
-			default:
-				Printf("key = %v, other case\n", key)
-				//some types can be used as key, we can use equals to test
-				//_ = val == val
-
-				rv := reflect.ValueOf(val)
-				if ki, e := getKeyInfo(rv.Type()); e != nil {
-					err = e
-					return
-				} else {
-					putF := getPutFunc(ki)
-					eng = &hashEnginer{}
-					eng.putFunc = putF
-				}
-			}
-		}
-
-		this.eng = unsafe.Pointer(eng)
-
-		Printf("key = %v, eng=%v, %v\n", key, this.eng, eng)
-	})
-	return
-}
-
-func (this *ConcurrentMap) newSegment(initialCapacity int, lf float32) (s *Segment) {
+func (this *ConcurrentMap) newSegment(initialCapacity int, lf float32, shrinkDivisor int64) (s *Segment) {
 	s = new(Segment)
 	s.loadFactor = lf
+	s.shrinkDivisor = shrinkDivisor
+	s.minCapacity = initialCapacity
 	table := make([]unsafe.Pointer, initialCapacity)
 	s.setTable(table)
-	s.lock = new(sync.Mutex)
+	s.lock = newSegmentLock(this.lockStrategy, this.lockStats)
 	s.m = this
 	return
 }
 
 func newConcurrentMap3(initialCapacity int,
 loadFactor float32, concurrencyLevel int) (m *ConcurrentMap) {
+	if !validLoadFactor(loadFactor) || initialCapacity < 0 || concurrencyLevel <= 0 {
+		panic(IllegalArgError)
+	}
+
+	o := defaultOptions()
+	o.initialCapacity, o.loadFactor, o.concurrencyLevel = initialCapacity, loadFactor, concurrencyLevel
+	m, err := newConcurrentMapWithOptions(o)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func newConcurrentMapWithOptions(o *mapOptions) (m *ConcurrentMap, err error) {
 	m = &ConcurrentMap{}
+	if err = m.init(o); err != nil {
+		return nil, err
+	}
+	return
+}
 
-	if !(loadFactor > 0) || initialCapacity < 0 || concurrencyLevel <= 0 {
-		panic(IllegalArgError)
+/**
+* Initializes a zero ConcurrentMap in place, the segments and the janitor
+* refer to this map.
+*/
+func (this *ConcurrentMap) init(o *mapOptions) (err error) {
+	this.parallelism = o.parallelism
+	this.keyType, this.valueType = o.keyType, o.valueType
+	this.defaultTTL, this.clock = o.defaultTTL, o.clock
+	this.weigher, this.onEvict = o.weigher, o.onEvict
+	this.lockStrategy, this.lockStats = o.lockStrategy, o.lockStats
+	if o.seeded {
+		this.setSeed(o.seed, o.hashAlg)
+	} else {
+		this.setSeed(randomSeed(), o.hashAlg)
 	}
 
+	initialCapacity, loadFactor, concurrencyLevel := o.initialCapacity, o.loadFactor, o.concurrencyLevel
 	if concurrencyLevel > MAX_SEGMENTS {
 		concurrencyLevel = MAX_SEGMENTS
 	}
@@ -596,11 +890,15 @@ loadFactor float32, concurrencyLevel int) (m *ConcurrentMap) {
 		sshift++
 		ssize = ssize << 1
 	}
+	//every segment of a bounded map must be able to hold an entry
+	for o.maxWeight > 0 && int64(ssize) > o.maxWeight {
+		sshift--
+		ssize = ssize >> 1
+	}
 
-	m.segmentShift = uint(32) - uint(sshift)
-	m.segmentMask = ssize - 1
-
-	m.segments = make([]*Segment, ssize)
+	this.resegmentLock = new(sync.Mutex)
+	this.maxSegments = int32(o.maxSegments)
+	this.counter = newLongAdder()
 
 	if initialCapacity > MAXIMUM_CAPACITY {
 		initialCapacity = MAXIMUM_CAPACITY
@@ -615,10 +913,24 @@ loadFactor float32, concurrencyLevel int) (m *ConcurrentMap) {
 		cap <<= 1
 	}
 
-	for i := 0; i < len(m.segments); i++ {
-		m.segments[i] = m.newSegment(cap, loadFactor)
+	segments := make([]*Segment, ssize)
+	for i := 0; i < len(segments); i++ {
+		segments[i] = this.newSegment(cap, loadFactor, o.shrinkDivisor)
+		segments[i].depth = uint(sshift)
+	}
+	this.storeDir(newSegmentDir(segments, uint(sshift)))
+	if o.maxWeight > 0 {
+		this.newPolicy = o.newPolicy
+		this.setMaxWeight(o.maxWeight)
+	}
+	if o.keyType != nil {
+		if _, err = engineFor(o.keyType); err != nil {
+			return err
+		}
+	}
+	if o.janitorInterval > 0 {
+		this.startJanitor(o.janitorInterval)
 	}
-	m.engChecker = new(Once)
 	return
 }
 
@@ -643,6 +955,9 @@ loadFactor float32, concurrencyLevel int) (m *ConcurrentMap) {
 *
 * Creates a new, empty map with a default initial capacity (16),
 * load factor (0.75) and concurrencyLevel (16).
+*
+* New is the preferred constructor, it takes typed options and
+* returns an error instead of panicking.
 */
 func NewConcurrentMap(paras ...interface{}) (m *ConcurrentMap) {
 	ok := false
@@ -672,6 +987,24 @@ func NewConcurrentMap(paras ...interface{}) (m *ConcurrentMap) {
 	return
 }
 
+/**
+* Creates a new, empty map like NewConcurrentMap, but hashes keys with
+* the given algorithm and seed instead of a random seed. Maps created
+* with the same seed, algorithm and concurrency level place every key
+* in the same segment and bin, which makes tests reproducible.
+*/
+func NewConcurrentMapWithSeed(seed uint64, alg HashAlgorithm, paras ...interface{}) (m *ConcurrentMap) {
+	m = NewConcurrentMap(paras...)
+	m.setSeed(seed, alg)
+	return
+}
+
+func (this *ConcurrentMap) setSeed(seed uint64, alg HashAlgorithm) {
+	this.seed = seed
+	this.hashAlg = alg
+	this.segmentSeed = uint32(mix64(seed)) | 1
+}
+
 /**
 * Creates a new map with the same mappings as the given map.
 * The map is created with a capacity of 1.5 times the number
@@ -698,7 +1031,8 @@ func NewConcurrentMapFromMap(m map[interface{}]interface{}) *ConcurrentMap {
 type Entry struct {
 	key   interface{}
 	hash  uint32
-	value unsafe.Pointer
+	gen   uint32         //Segment.snapGen when the entry was created, see Segment.setValue
+	value unsafe.Pointer //point to valueCell
 	next  *Entry
 }
 
@@ -707,25 +1041,33 @@ func (this *Entry) Key() interface{} {
 }
 
 func (this *Entry) Value() interface{} {
-	return *((*interface{})(atomic.LoadPointer(&this.value)))
+	return this.cell().v
+}
+
+func (this *Entry) cell() *valueCell {
+	return (*valueCell)(atomic.LoadPointer(&this.value))
+}
+
+func (this *Entry) fastCell() *valueCell {
+	return (*valueCell)(this.value)
 }
 
 func (this *Entry) fastValue() interface{} {
-	return *((*interface{})(this.value))
+	return this.fastCell().v
 }
 
-func (this *Entry) storeValue(v *interface{}) {
-	atomic.StorePointer(&this.value, unsafe.Pointer(v))
+func (this *Entry) storeValue(c *valueCell) {
+	atomic.StorePointer(&this.value, unsafe.Pointer(c))
 }
 
 type Segment struct {
-	m *ConcurrentMap //point to concurrentMap.eng, so it is **hashEnginer
 	/**
 	* The number of elements in this segment's region.
-	* Must use atomic package's LoadInt32 and StoreInt32 functions to read/write this field
-	* otherwise read operation may cannot read latest value
+	* Must use atomic package's LoadInt64 and StoreInt64 functions to read/write this field
+	* otherwise read operation may cannot read latest value.
+	* The 64-bit fields come first to keep them 8-byte aligned on 32-bit platforms.
 	*/
-	count int32
+	count int64
 
 	/**
 	* Number of updates that alter the size of the table. This is
@@ -733,16 +1075,44 @@ type Segment struct {
 	* consistent snapshot: If modCounts change during a traversal
 	* of segments computing size or checking containsValue, then
 	* we might have an inconsistent view of state so (usually)
-	* must retry.
+	* must retry. Written with atomic.AddInt64 under lock, as the
+	* bulk-read methods load it without locking.
 	*/
-	modCount int32
+	modCount int64
 
 	/**
 	* The table is rehashed when its size exceeds this threshold.
 	* (The value of this field is always (int)(capacity *
 	* loadFactor).)
 	*/
-	threshold int32
+	threshold int64
+
+	/**
+	* The table is halved when count drops below this threshold.
+	* It is -1 while the table is at minCapacity or shrinking is disabled.
+	*/
+	shrinkThreshold int64
+
+	/**
+	* See SHRINK_DIVISOR, 0 disables shrinking on remove.
+	*/
+	shrinkDivisor int64
+
+	/**
+	* Total weight of the entries and the share of the bound of a bounded
+	* map, see evictIfNeeded. policy is nil if the map is not bounded.
+	*/
+	weight    int64
+	maxWeight int64
+	policy    EvictionPolicy
+
+	m *ConcurrentMap //the map that owns this segment
+
+	/**
+	* The capacity the segment was created with, the table never
+	* shrinks below it.
+	*/
+	minCapacity int
 
 	/**
 	* The per-segment table.
@@ -757,20 +1127,101 @@ type Segment struct {
 	*/
 	loadFactor float32
 
-	lock *sync.Mutex
-}
+	/**
+	* Generation of the last Snapshot of this segment. Entries created in an
+	* earlier generation may be held by a snapshot and are never modified.
+	*/
+	snapGen uint32
+
+	/**
+	* True while the current table is held by a Snapshot, the first write
+	* after the snapshot copies it, see writableTable.
+	*/
+	tableShared bool
+
+	/**
+	* The table being filled while the table is doubled incrementally,
+	* nil otherwise. The bins of the table from transferIndex on have been
+	* moved to it, see transfer.
+	*/
+	nextTable     []unsafe.Pointer
+	transferIndex int
+
+	/**
+	* Number of times the table was grown and shrunk, see Stats.
+	*/
+	rehashes int64
+	shrinks  int64
+
+	/**
+	* Goroutines blocked in WaitFor by hash code of their keys, guarded by lock.
+	*/
+	waiters map[uint32][]*waiter
+
+	/**
+	* Number of upper bits of hash*segmentSeed that the keys of this
+	* segment share, see segmentDir.
+	*/
+	depth uint
 
-func (this *Segment) enginer() *hashEnginer {
-	return (*hashEnginer)(atomic.LoadPointer(&this.m.eng))
+	/**
+	* Set under lock when the segment was split, it is never changed
+	* afterwards. Writers that lock it retry with the segment of the
+	* current directory, see lockLive.
+	*/
+	moved bool
+
+	//contentions of lock when it was last checked by lockLive
+	checkedContentions int64
+
+	lock *segmentLock
 }
 
+/**
+* Doubles the table.
+* Call only while holding lock.
+*/
 func (this *Segment) rehash() {
+	this.finishTransfer()
+	this.grow(len(this.table()) << 1)
+}
+
+/**
+* Grows the table to newCapacity bins, a power of two, at most
+* MAXIMUM_CAPACITY. A large table is only replaced by an empty one of
+* that size, which the following writes fill, see transfer.
+* Call only while holding lock.
+*/
+func (this *Segment) grow(newCapacity int) {
+	this.finishTransfer()
 	oldTable := this.table() //*(*[]*Entry)(this.table)
 	oldCapacity := len(oldTable)
-	if oldCapacity >= MAXIMUM_CAPACITY {
+	if newCapacity > MAXIMUM_CAPACITY {
+		newCapacity = MAXIMUM_CAPACITY
+	}
+	if oldCapacity >= newCapacity {
 		return
 	}
 
+	newTable := make([]unsafe.Pointer, newCapacity)
+	this.setThresholds(len(newTable))
+	if oldCapacity >= INCREMENTAL_REHASH_CAPACITY {
+		this.nextTable = newTable
+		this.transferIndex = oldCapacity
+		return
+	}
+	for i := 0; i < oldCapacity; i++ {
+		transferBin(oldTable, i, newTable)
+	}
+	this.publishTable(newTable)
+	this.rehashes++
+}
+
+/**
+* Moves the entries of bin i of oldTable to newTable, which is a power of
+* two times larger.
+*/
+func transferBin(oldTable []unsafe.Pointer, i int, newTable []unsafe.Pointer) {
 	/*
 	* Reclassify nodes in each list to new Map.  Because we are
 	* using power-of-two expansion, the elements from each bin
@@ -785,56 +1236,159 @@ func (this *Segment) rehash() {
 	* right now.
 	*/
 
-	newTable := make([]unsafe.Pointer, oldCapacity<<1)
-	atomic.StoreInt32(&this.threshold, int32(float32(len(newTable))*this.loadFactor))
 	sizeMask := uint32(len(newTable) - 1)
-	for i := 0; i < oldCapacity; i++ {
-		// We need to guarantee that any existing reads of old Map can
-		//  proceed. So we cannot yet nil out each bin.
-		e := (*Entry)(oldTable[i])
-
-		if e != nil {
-			next := e.next
-			//计算节点扩容后新的数组下标
-			idx := e.hash & sizeMask
-
-			//  Single node on list
-			//如果没有后续的碰撞节点，直接复制到新数组即可
-			if next == nil {
-				newTable[idx] = unsafe.Pointer(e)
-			} else {
-				/* Reuse trailing consecutive sequence at same slot
-				* 数组扩容后原来数组下标相同（碰撞）的节点可能会计算出不同的新下标
-				* 如果把碰撞链表中所有节点的新下标列出，并将相邻的新下标相同的节点视为一段
-				* 那么下面的代码为了提高效率，会循环碰撞链表，找到链表中最后一段首节点（之后所有节点的新下标相同）
-				* 然后将这个首节点复制到新数组，后续节点因为计算出的新下标相同，所以在扩容后的数组中仍然在同一碰撞链表中
-				* 所以新的首节点的碰撞链表是正确的
-				* 新的首节点之外的其他现存碰撞链表上的节点，则重新复制到新节点（这个重要，可以保持旧节点的不变性）后放入新数组
-				* 这个过程的关键在于维持所有旧节点的next属性不会发生变化，这样才能让无锁的读操作保持线程安全
-				*/
-				lastRun := e
-				lastIdx := idx
-				for last := next; last != nil; last = last.next {
-					k := last.hash & uint32(sizeMask)
-					//发现新下标不同的节点就保存到lastIdx和lastRun中
-					//所以lastIdx和lastRun总是对应现有碰撞链表中最后一段新下标相同节点的首节点和其对应的新下标
-					if k != lastIdx {
-						lastIdx = k
-						lastRun = last
-					}
+	// We need to guarantee that any existing reads of old Map can
+	//  proceed. So the nodes of the bin are never changed.
+	e := (*Entry)(oldTable[i])
+
+	if isTreeBin(e) {
+		//a tree bin splits into bins i, i+len(oldTable)...,
+		//each part becomes a chain again if it is small enough
+		parts := make(map[uint32][]*Entry)
+		asTreeBin(e).forEach(func(p *Entry) {
+			parts[p.hash&sizeMask] = append(parts[p.hash&sizeMask], p)
+		})
+		for k, entries := range parts {
+			newTable[k] = buildBin(entries)
+		}
+	} else if e != nil {
+		next := e.next
+		//计算节点扩容后新的数组下标
+		idx := e.hash & sizeMask
+
+		//  Single node on list
+		//如果没有后续的碰撞节点，直接复制到新数组即可
+		if next == nil {
+			newTable[idx] = unsafe.Pointer(e)
+		} else {
+			/* Reuse trailing consecutive sequence at same slot
+			* 数组扩容后原来数组下标相同（碰撞）的节点可能会计算出不同的新下标
+			* 如果把碰撞链表中所有节点的新下标列出，并将相邻的新下标相同的节点视为一段
+			* 那么下面的代码为了提高效率，会循环碰撞链表，找到链表中最后一段首节点（之后所有节点的新下标相同）
+			* 然后将这个首节点复制到新数组，后续节点因为计算出的新下标相同，所以在扩容后的数组中仍然在同一碰撞链表中
+			* 所以新的首节点的碰撞链表是正确的
+			* 新的首节点之外的其他现存碰撞链表上的节点，则重新复制到新节点（这个重要，可以保持旧节点的不变性）后放入新数组
+			* 这个过程的关键在于维持所有旧节点的next属性不会发生变化，这样才能让无锁的读操作保持线程安全
+			*/
+			lastRun := e
+			lastIdx := idx
+			for last := next; last != nil; last = last.next {
+				k := last.hash & uint32(sizeMask)
+				//发现新下标不同的节点就保存到lastIdx和lastRun中
+				//所以lastIdx和lastRun总是对应现有碰撞链表中最后一段新下标相同节点的首节点和其对应的新下标
+				if k != lastIdx {
+					lastIdx = k
+					lastRun = last
 				}
-				newTable[lastIdx] = unsafe.Pointer(lastRun)
+			}
+			newTable[lastIdx] = unsafe.Pointer(lastRun)
+
+			// Clone all remaining nodes
+			for p := e; p != lastRun; p = p.next {
+				k := p.hash & sizeMask
+				n := newTable[k]
+				newTable[k] = unsafe.Pointer(&Entry{p.key, p.hash, p.gen, p.value, (*Entry)(n)})
+			}
+		}
+	}
+}
+
+/**
+* Halves the table until it reaches newCapacity.
+* Because capacities are powers of two, old bins i, i+newCapacity,
+* i+2*newCapacity... all fold into new bin i. The first chain that lands
+* in a new bin is reused as is, the nodes of every further chain are
+* cloned in front of it. Bins that would become too long are rebuilt
+* as tree bins. As in rehash, next fields of old nodes never
+* change, so readers still traversing the old table stay safe.
+* Call only while holding lock.
+*/
+func (this *Segment) shrink(newCapacity int) {
+	this.finishTransfer()
+	oldTable := this.table()
+	if newCapacity < this.minCapacity {
+		newCapacity = this.minCapacity
+	}
+	if newCapacity >= len(oldTable) {
+		return
+	}
 
-				// Clone all remaining nodes
-				for p := e; p != lastRun; p = p.next {
-					k := p.hash & sizeMask
-					n := newTable[k]
-					newTable[k] = unsafe.Pointer(&Entry{p.key, p.hash, p.value, (*Entry)(n)})
+	newTable := make([]unsafe.Pointer, newCapacity)
+	for idx := 0; idx < newCapacity; idx++ {
+		//bins that fold into a tree bin, or into a chain that would
+		//reach TREEIFY_THRESHOLD, are rebuilt from their entries
+		n, hasTree := 0, false
+		for i := idx; i < len(oldTable); i += newCapacity {
+			e := (*Entry)(oldTable[i])
+			hasTree = hasTree || isTreeBin(e)
+			n += binSize(e, TREEIFY_THRESHOLD)
+		}
+		if hasTree || n >= TREEIFY_THRESHOLD {
+			var entries []*Entry
+			for i := idx; i < len(oldTable); i += newCapacity {
+				entries = appendBinEntries(entries, (*Entry)(oldTable[i]))
+			}
+			newTable[idx] = buildBin(entries)
+			continue
+		}
+
+		for i := idx; i < len(oldTable); i += newCapacity {
+			e := (*Entry)(oldTable[i])
+			if e == nil {
+				continue
+			}
+			if newTable[idx] == nil {
+				newTable[idx] = unsafe.Pointer(e)
+			} else {
+				for p := e; p != nil; p = p.next {
+					newTable[idx] = unsafe.Pointer(&Entry{p.key, p.hash, p.gen, p.value, (*Entry)(newTable[idx])})
 				}
 			}
 		}
 	}
-	atomic.StorePointer(&this.pTable, unsafe.Pointer(&newTable))
+	this.setThresholds(newCapacity)
+	this.publishTable(newTable)
+	this.shrinks++
+}
+
+/**
+* Halves the table if count has dropped below shrinkThreshold.
+* Call only while holding lock.
+*/
+func (this *Segment) shrinkIfNeeded() {
+	if this.count < this.shrinkThreshold {
+		this.finishTransfer()
+		this.shrink(len(this.table()) >> 1)
+	}
+}
+
+/**
+* Shrinks the table to the smallest capacity that keeps count within
+* the load factor.
+*/
+func (this *Segment) compact() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.finishTransfer()
+	capacity := len(this.table())
+	for capacity > this.minCapacity && int64(float32(capacity>>1)*this.loadFactor) >= this.count {
+		capacity >>= 1
+	}
+	this.shrink(capacity)
+}
+
+/**
+* Sets grow and shrink thresholds for a table of the given capacity.
+* Call only while holding lock or in constructor.
+*/
+func (this *Segment) setThresholds(capacity int) {
+	atomic.StoreInt64(&this.threshold, int64(float32(capacity)*this.loadFactor))
+	if capacity > this.minCapacity && this.shrinkDivisor > 0 {
+		this.shrinkThreshold = this.threshold / this.shrinkDivisor
+	} else {
+		this.shrinkThreshold = -1
+	}
 }
 
 /**
@@ -842,10 +1396,36 @@ func (this *Segment) rehash() {
 * Call only while holding lock or in constructor.
 */
 func (this *Segment) setTable(newTable []unsafe.Pointer) {
-	this.threshold = (int32)(float32(len(newTable)) * this.loadFactor)
+	this.setThresholds(len(newTable))
 	this.pTable = unsafe.Pointer(&newTable)
 }
 
+/**
+* Stores a new table for lock-free readers. The new table is not held
+* by any Snapshot yet.
+* Call only while holding lock.
+*/
+func (this *Segment) publishTable(newTable []unsafe.Pointer) {
+	atomic.StorePointer(&this.pTable, unsafe.Pointer(&newTable))
+	this.tableShared = false
+}
+
+/**
+* Returns the table for a write. If the table is held by a Snapshot,
+* it is copied first, so the snapshot never sees the write.
+* Call only while holding lock.
+*/
+func (this *Segment) writableTable() []unsafe.Pointer {
+	tab := this.table()
+	if this.tableShared {
+		newTable := make([]unsafe.Pointer, len(tab))
+		copy(newTable, tab)
+		this.publishTable(newTable)
+		tab = newTable
+	}
+	return tab
+}
+
 /**
 * uses atomic to load table and returns.
 * Call while no lock.
@@ -864,6 +1444,7 @@ func (this *Segment) table() []unsafe.Pointer {
 
 /**
 * Returns properly casted first entry of bin for given hash.
+* The entry may be the head of a tree bin, see isTreeBin.
 */
 func (this *Segment) getFirst(hash uint32) *Entry {
 	tab := this.loadTable()
@@ -873,80 +1454,161 @@ func (this *Segment) getFirst(hash uint32) *Entry {
 /**
 * Reads value field of an entry under lock. Called if value
 * field ever appears to be nil. see below code:
-* 		tab[index] = unsafe.Pointer(&Entry{key, hash, unsafe.Pointer(&value), first})
+* 		tab[index] = unsafe.Pointer(&Entry{key, hash, gen, unsafe.Pointer(cell), first})
 * go memory model don't explain Entry initialization must be executed before
 * table assignment. So value is nil is possible only if a
 * compiler happens to reorder a HashEntry initialization with
 * its table assignment, which is legal under memory model
 * but is not known to ever occur.
 */
-func (this *Segment) readValueUnderLock(e *Entry) interface{} {
+func (this *Segment) readCellUnderLock(e *Entry) *valueCell {
 	this.lock.Lock()
 	defer this.lock.Unlock()
-	return e.fastValue()
+	return e.fastCell()
+}
+
+/**
+* Returns the value cell of e, or nil if it has expired. Reads without
+* locking like get.
+*/
+func (this *Segment) liveCell(e *Entry) *valueCell {
+	c := e.cell()
+	if c == nil {
+		c = this.readCellUnderLock(e) // recheck
+	}
+	if this.m.expired(c) {
+		return nil
+	}
+	return c
+}
+
+//liveValue returns the value of e, or nil if it has expired
+func (this *Segment) liveValue(e *Entry) interface{} {
+	if c := this.liveCell(e); c != nil {
+		return c.v
+	}
+	return nil
+}
+
+/**
+* Finds the entry of key in the bin at index like findInBin. An expired
+* entry is unlinked and nil is returned, so writers treat its key as absent.
+* Returns the head of the bin after the call.
+* Call only while holding lock, with a table returned by writableTable.
+*/
+func (this *Segment) findLive(tab []unsafe.Pointer, index uint32, key interface{}, hash uint32) (first *Entry, e *Entry) {
+	first = (*Entry)(tab[index])
+	e = findInBin(first, key, hash)
+	if e != nil && this.m.expired(e.fastCell()) {
+		atomic.AddInt64(&this.modCount, 1)
+		this.unlinkEntry(tab, index, first, e)
+		this.m.counter.add(hash, -1)
+		atomic.StoreInt64(&this.count, this.count-1)
+		this.m.emit(EventExpire, e.key, hash, e.fastValue(), nil)
+		return (*Entry)(tab[index]), nil
+	}
+	return
 }
 
 /* Specialized implementations of map methods */
 
 func (this *Segment) get(key interface{}, hash uint32) interface{} {
-	if atomic.LoadInt32(&this.count) != 0 { // atomic-read
-		e := this.getFirst(hash)
-		for e != nil {
-			if e.hash == hash && equals(e.key, key) {
-				v := e.Value()
-				if v != nil {
-					//return
-					return v
+	if atomic.LoadInt64(&this.count) != 0 { // atomic-read
+		if e := findInBin(this.getFirst(hash), key, hash); e != nil {
+			if c := this.liveCell(e); c != nil {
+				if c.node != nil {
+					this.recordAccess(c)
 				}
-				return this.readValueUnderLock(e) // recheck
+				return c.v
 			}
-			e = e.next
 		}
 	}
 	return nil
 }
 
 func (this *Segment) containsKey(key interface{}, hash uint32) bool {
-	if atomic.LoadInt32(&this.count) != 0 { // read-volatile
-		e := this.getFirst(hash)
-		for e != nil {
-			if e.hash == hash && equals(e.key, key) {
-				return true
+	if atomic.LoadInt64(&this.count) != 0 { // read-volatile
+		e := findInBin(this.getFirst(hash), key, hash)
+		return e != nil && this.liveValue(e) != nil
+	}
+	return false
+}
+
+/**
+* Appends the keys of the entries whose value equals value to keys,
+* stopping after the first one if firstOnly. locked tells whether the
+* caller holds the segment lock, otherwise the table is read without
+* locking like get.
+*/
+func (this *Segment) keysForValue(keys []interface{}, value interface{}, equal func(v1, v2 interface{}) bool, firstOnly bool, locked bool) []interface{} {
+	if atomic.LoadInt64(&this.count) == 0 {
+		return keys
+	}
+	tab := this.loadTable()
+	for i := 0; i < len(tab); i++ {
+		forEachInBin((*Entry)(atomic.LoadPointer(&tab[i])), func(e *Entry) {
+			if firstOnly && len(keys) != 0 {
+				return
 			}
-			e = e.next
+			var v interface{}
+			if locked {
+				if c := e.fastCell(); !this.m.expired(c) {
+					v = c.v
+				}
+			} else {
+				v = this.liveValue(e)
+			}
+			if v != nil && equal(v, value) {
+				keys = append(keys, e.key)
+			}
+		})
+		if firstOnly && len(keys) != 0 {
+			break
 		}
 	}
-	return false
+	return keys
 }
 
 func (this *Segment) compareAndReplace(key interface{}, hash uint32, oldVal interface{}, newVal interface{}) bool {
-	this.lock.Lock()
+	var evicted []*Entry
+	defer this.m.notifyEvicted(&evicted) //after unlocking
+	if !this.lockLive() {
+		return this.m.segmentFor(hash).compareAndReplace(key, hash, oldVal, newVal)
+	}
 	defer this.lock.Unlock()
 
-	e := this.getFirst(hash)
-	for e != nil && (e.hash != hash || !equals(e.key, key)) {
-		e = e.next
-	}
+	this.transfer(TRANSFER_STRIDE)
+	tab, index := this.writableBin(hash)
+	first, e := this.findLive(tab, index, key, hash)
 
 	replaced := false
 	if e != nil && oldVal == e.fastValue() {
 		replaced = true
-		e.storeValue(&newVal)
+		this.setValue(tab, index, first, e, this.m.newCell(newVal, this.m.defaultTTL))
+		this.m.emit(EventUpdate, key, hash, oldVal, newVal)
+		this.wake(key, hash, newVal)
+		this.evictIfNeeded(&evicted)
 	}
 	return replaced
 }
 
 func (this *Segment) replace(key interface{}, hash uint32, newVal interface{}) (oldVal interface{}) {
-	this.lock.Lock()
-	defer this.lock.Unlock()
-	e := this.getFirst(hash)
-	for e != nil && (e.hash != hash || !equals(e.key, key)) {
-		e = e.next
+	var evicted []*Entry
+	defer this.m.notifyEvicted(&evicted) //after unlocking
+	if !this.lockLive() {
+		return this.m.segmentFor(hash).replace(key, hash, newVal)
 	}
+	defer this.lock.Unlock()
+	this.transfer(TRANSFER_STRIDE)
+	tab, index := this.writableBin(hash)
+	first, e := this.findLive(tab, index, key, hash)
 
 	if e != nil {
 		oldVal = e.fastValue()
-		e.storeValue(&newVal)
+		this.setValue(tab, index, first, e, this.m.newCell(newVal, this.m.defaultTTL))
+		this.m.emit(EventUpdate, key, hash, oldVal, newVal)
+		this.wake(key, hash, newVal)
+		this.evictIfNeeded(&evicted)
 	}
 	return
 }
@@ -960,117 +1622,250 @@ func (this *Segment) replace(key interface{}, hash uint32, newVal interface{}) (
 * 由此保证了多线程情况下读和写线程中看到的操作次序不会发送混乱，
 * 在Golang中，StorePointer内部使用了xchgl指令，具有内存屏障，但是Load操作似乎并未具有明确的acquire语义
 */
-func (this *Segment) put(key interface{}, hash uint32, value interface{}, onlyIfAbsent bool, action func(oldValue interface{}) (newVal interface{})) (oldValue interface{}) {
-	this.lock.Lock()
+func (this *Segment) put(key interface{}, hash uint32, value interface{}, ttl time.Duration, onlyIfAbsent bool) (oldValue interface{}) {
+	var evicted []*Entry
+	defer this.m.notifyEvicted(&evicted) //after unlocking
+	if !this.lockLive() {
+		return this.m.segmentFor(hash).put(key, hash, value, ttl, onlyIfAbsent)
+	}
 	defer this.lock.Unlock()
+	return this.putLocked(key, hash, value, ttl, onlyIfAbsent, &evicted)
+}
 
+//putLocked is put while holding lock, evicted entries are appended to evicted
+func (this *Segment) putLocked(key interface{}, hash uint32, value interface{}, ttl time.Duration, onlyIfAbsent bool, evicted *[]*Entry) (oldValue interface{}) {
+	if this.count > this.threshold { // ensure capacity
+		this.rehash()
+	}
+
+	this.transfer(TRANSFER_STRIDE)
+	tab, index := this.writableBin(hash)
+	first, e := this.findLive(tab, index, key, hash)
 	c := this.count
-	if c > this.threshold { // ensure capacity
+
+	//the value cell is only allocated if it is stored, so PutIfAbsent of a present key does not allocate
+	if e != nil {
+		oldValue = e.fastValue()
+		if !onlyIfAbsent {
+			this.setValue(tab, index, first, e, this.m.newCell(value, ttl))
+			this.m.emit(EventUpdate, key, hash, oldValue, value)
+			this.wake(key, hash, value)
+			this.evictIfNeeded(evicted)
+		}
+	} else {
+		c++
+		oldValue = nil
+		atomic.AddInt64(&this.modCount, 1)
+		this.linkEntry(tab, index, first, &Entry{key, hash, this.snapGen, unsafe.Pointer(this.m.newCell(value, ttl)), nil})
+		this.m.counter.add(hash, 1)
+		atomic.StoreInt64(&this.count, c) // atomic write 这里可以保证对modCount和tab的修改不会被reorder到this.count之后
+		this.m.emit(EventInsert, key, hash, nil, value)
+		this.wake(key, hash, value)
+		this.evictIfNeeded(evicted)
+	}
+	return
+}
+
+/**
+* Maps key to the value returned by remapping, under the segment lock.
+* remapping gets the current value, or nil if the key is absent, and a nil
+* result removes the mapping. remapping is not called if the key is present
+* and onlyIfAbsent is set, or if the key is absent and onlyIfPresent is set.
+*
+* remapping runs before anything is modified, so if it panics the segment
+* is left unchanged, and the lock is released as the panic unwinds.
+* remapping must not access the map, the segment lock is not reentrant.
+*
+* @return the previous value and the value mapped after the call,
+*         nil if there is none
+*/
+func (this *Segment) compute(key interface{}, hash uint32, onlyIfAbsent bool, onlyIfPresent bool, remapping func(oldVal interface{}) (newVal interface{})) (oldValue interface{}, newValue interface{}) {
+	var evicted []*Entry
+	defer this.m.notifyEvicted(&evicted) //after unlocking
+	if !this.lockLive() {
+		return this.m.segmentFor(hash).compute(key, hash, onlyIfAbsent, onlyIfPresent, remapping)
+	}
+	defer this.lock.Unlock()
+
+	if this.count > this.threshold { // ensure capacity
 		this.rehash()
 	}
 
-	tab := this.table()
-	index := hash & uint32(len(tab)-1)
-	first := (*Entry)(tab[index])
-	e := first
+	this.transfer(TRANSFER_STRIDE)
+	tab, index := this.writableBin(hash)
+	first, e := this.findLive(tab, index, key, hash)
+	c := this.count
 
-	for e != nil && (e.hash != hash || !equals(e.key, key)) {
-		e = e.next
+	if e != nil {
+		oldValue = e.fastValue()
+		if onlyIfAbsent {
+			return oldValue, oldValue
+		}
+	} else if onlyIfPresent {
+		return nil, nil
 	}
 
-	if action == nil {
-		if e != nil {
-			oldValue = e.fastValue()
-			if !onlyIfAbsent {
-				e.storeValue(&value)
-			}
-		} else {
+	v := remapping(oldValue)
+	if !isNil(v) {
+		newValue = v
+		if e == nil {
 			c++
-			oldValue = nil
-			this.modCount++
-			tab[index] = unsafe.Pointer(&Entry{key, hash, unsafe.Pointer(&value), first})
-			atomic.StoreInt32(&this.count, c) // atomic write 这里可以保证对modCount和tab的修改不会被reorder到this.count之后
-		}
-	} else {
-		if e != nil {
-			oldValue = e.fastValue()
+			atomic.AddInt64(&this.modCount, 1)
+			this.linkEntry(tab, index, first, &Entry{key, hash, this.snapGen, unsafe.Pointer(this.m.newCell(v, this.m.defaultTTL)), nil})
+			this.m.counter.add(hash, 1)
+			atomic.StoreInt64(&this.count, c) // atomic write 这里可以保证对modCount和tab的修改不会被reorder到this.count之后
+			this.m.emit(EventInsert, key, hash, nil, v)
+			this.wake(key, hash, v)
 		} else {
-			c++
-			oldValue = nil
+			this.setValue(tab, index, first, e, this.m.newCell(v, this.m.defaultTTL))
+			this.m.emit(EventUpdate, key, hash, oldValue, v)
+			this.wake(key, hash, v)
 		}
+		this.evictIfNeeded(&evicted)
+	} else if e != nil {
+		//remove key if remapping returns nil
+		c--
+		atomic.AddInt64(&this.modCount, 1)
+		this.unlinkEntry(tab, index, first, e)
+		this.m.counter.add(hash, -1)
+		atomic.StoreInt64(&this.count, c) //this.count = c
+		this.m.emit(EventRemove, key, hash, oldValue, nil)
+		this.shrinkIfNeeded()
+	}
+	return
+}
 
-		newVal := action(oldValue)
-		if newVal != nil {
-			if oldValue == nil {
-				e = &Entry{key, hash, unsafe.Pointer(&value), first}
-				tab[index] = unsafe.Pointer(e)
-				this.modCount++
-				atomic.StoreInt32(&this.count, c) // atomic write 这里可以保证对modCount和tab的修改不会被reorder到this.count之后
-			}
-			e.storeValue(&newVal)
-		} else if e != nil {
-			//remove key if action returns nil
-			c--
-			this.modCount++
-			newFirst := e.next
-			for p := first; p != e; p = p.next {
-				newFirst = &Entry{p.key, p.hash, p.value, newFirst}
-			}
-			tab[index] = unsafe.Pointer(newFirst)
-			atomic.StoreInt32(&this.count, c) //this.count = c
+/**
+* Links the new entry e into the bin at index whose head is first.
+* A chain that reaches TREEIFY_THRESHOLD entries is converted to a tree bin.
+* In a bounded map the entry is added to the eviction policy, see track.
+* Call only while holding lock.
+*/
+func (this *Segment) linkEntry(tab []unsafe.Pointer, index uint32, first *Entry, e *Entry) {
+	this.track(e)
+	if isTreeBin(first) {
+		atomic.StorePointer(&tab[index], asTreeBin(first).put(e).pointer())
+		return
+	}
+	e.next = first
+	if binSize(e, TREEIFY_THRESHOLD) >= TREEIFY_THRESHOLD {
+		atomic.StorePointer(&tab[index], buildBin(appendBinEntries(make([]*Entry, 0, TREEIFY_THRESHOLD), e)))
+	} else {
+		atomic.StorePointer(&tab[index], unsafe.Pointer(e))
+	}
+}
+
+/**
+* Stores cell v as the value of entry e of the bin at index whose head is first.
+* An entry from before the last Snapshot may be held by that snapshot, so it
+* is not modified but replaced by a copy holding v. v takes over the
+* eviction node of the old value, see retrack.
+* Call only while holding lock, with a table returned by writableTable.
+*/
+func (this *Segment) setValue(tab []unsafe.Pointer, index uint32, first *Entry, e *Entry, v *valueCell) {
+	this.retrack(e.fastCell(), v)
+	if e.gen == this.snapGen {
+		e.storeValue(v)
+		return
+	}
+	ne := &Entry{e.key, e.hash, this.snapGen, unsafe.Pointer(v), nil}
+	if isTreeBin(first) {
+		atomic.StorePointer(&tab[index], asTreeBin(first).remove(e).put(ne).pointer())
+		return
+	}
+	ne.next = e.next
+	for p := first; p != e; p = p.next {
+		ne = &Entry{p.key, p.hash, p.gen, p.value, ne}
+	}
+	atomic.StorePointer(&tab[index], unsafe.Pointer(ne))
+}
+
+/**
+* Unlinks entry e from the bin at index whose head is first.
+* A tree bin that drops to UNTREEIFY_THRESHOLD entries is converted back to a chain.
+* The entry is removed from the eviction policy, see untrack.
+* Call only while holding lock.
+*/
+func (this *Segment) unlinkEntry(tab []unsafe.Pointer, index uint32, first *Entry, e *Entry) {
+	this.untrack(e.fastCell())
+	if isTreeBin(first) {
+		tb := asTreeBin(first).remove(e)
+		if int(tb.size) <= UNTREEIFY_THRESHOLD {
+			atomic.StorePointer(&tab[index], buildBin(appendBinEntries(nil, &tb.Entry)))
+		} else {
+			atomic.StorePointer(&tab[index], tb.pointer())
 		}
+		return
 	}
-	return
+	// All entries following removed node can stay
+	// in list, but all preceding ones need to be
+	// cloned.
+	newFirst := e.next
+	for p := first; p != e; p = p.next {
+		newFirst = &Entry{p.key, p.hash, p.gen, p.value, newFirst}
+	}
+	atomic.StorePointer(&tab[index], unsafe.Pointer(newFirst))
 }
 
 /**
 * Remove; match on key only if value nil, else match both.
 */
 func (this *Segment) remove(key interface{}, hash uint32, value interface{}) (oldValue interface{}) {
-	this.lock.Lock()
+	if !this.lockLive() {
+		return this.m.segmentFor(hash).remove(key, hash, value)
+	}
 	defer this.lock.Unlock()
+	return this.removeLocked(key, hash, value)
+}
 
+//removeLocked is remove while holding lock
+func (this *Segment) removeLocked(key interface{}, hash uint32, value interface{}) (oldValue interface{}) {
+	this.transfer(TRANSFER_STRIDE)
+	tab, index := this.writableBin(hash)
+	first, e := this.findLive(tab, index, key, hash)
 	c := this.count - 1
-	tab := this.table()
-	index := hash & uint32(len(tab)-1)
-	first := (*Entry)(tab[index])
-	e := first
-
-	for e != nil && (e.hash != hash || !equals(e.key, key)) {
-		e = e.next
-	}
 
 	if e != nil {
 		v := e.fastValue()
 		if value == nil || value == v {
 			oldValue = v
-			// All entries following removed node can stay
-			// in list, but all preceding ones need to be
-			// cloned.
-			this.modCount++
-			newFirst := e.next
-			for p := first; p != e; p = p.next {
-				newFirst = &Entry{p.key, p.hash, p.value, newFirst}
-			}
-			tab[index] = unsafe.Pointer(newFirst)
-			atomic.StoreInt32(&this.count, c) //this.count = c
+			atomic.AddInt64(&this.modCount, 1)
+			this.unlinkEntry(tab, index, first, e)
+			this.m.counter.add(hash, -1)
+			atomic.StoreInt64(&this.count, c) //this.count = c
+			this.m.emit(EventRemove, key, hash, v, nil)
+			this.shrinkIfNeeded()
 		}
 	}
 	return
 }
 
+/**
+* Replaces the table with an empty one of the initial capacity,
+* so the memory of the old table is released once no reader
+* is traversing it.
+*/
 func (this *Segment) clear() {
-	if atomic.LoadInt32(&this.count) != 0 {
+	if atomic.LoadInt64(&this.count) != 0 {
 		this.lock.Lock()
 		defer this.lock.Unlock()
+		this.clearLocked()
+	}
+}
 
-		tab := this.table()
-		for i := 0; i < len(tab); i++ {
-			tab[i] = nil
-		}
-		this.modCount++
-		atomic.StoreInt32(&this.count, 0) //this.count = 0 // write-volatile
+//clearLocked is clear while holding lock
+func (this *Segment) clearLocked() {
+	if this.count == 0 {
+		return
 	}
+	newTable := make([]unsafe.Pointer, this.minCapacity)
+	this.setThresholds(len(newTable))
+	this.nextTable, this.transferIndex = nil, 0
+	this.publishTable(newTable)
+	this.resetPolicy()
+	atomic.AddInt64(&this.modCount, 1)
+	this.m.counter.add(0, -this.count)
+	atomic.StoreInt64(&this.count, 0) //this.count = 0 // write-volatile
 }
 
 /**
@@ -1104,10 +1899,57 @@ type MapIterator struct {
 	nextE            *Entry
 	lastReturned     *Entry
 	cm               *ConcurrentMap
+	segments         []*Segment //the segments when the iterator was created
+	/**
+	* Entries of the current tree bin that are not returned yet.
+	* Entries of a tree bin are flattened when the bin is reached,
+	* because their next fields only link entries with the same hash.
+	* So are the entries a forwarding bin leads to, see forwardingBin.
+	*/
+	treeEntries []*Entry
+	inTree      bool
+	//the snapshot being iterated, nil if iterating the map itself
+	snap *Snapshot
+}
+
+//setNext makes the head of a bin the next entry
+func (this *MapIterator) setNext(e *Entry) {
+	this.inTree = isTreeBin(e) || isForwarding(e)
+	if this.inTree {
+		this.treeEntries = appendBinEntries(this.treeEntries[:0], e)
+		if len(this.treeEntries) == 0 {
+			//the bins a forwarding bin leads to can be empty
+			this.nextE, this.inTree = nil, false
+			return
+		}
+		e, this.treeEntries = this.treeEntries[0], this.treeEntries[1:]
+	}
+	this.nextE = e
 }
 
+//advance moves to the next entry that has not expired
 func (this *MapIterator) advance() {
-	if this.nextE != nil {
+	this.advanceEntry()
+	for this.nextE != nil && this.expired(this.nextE) {
+		this.advanceEntry()
+	}
+}
+
+func (this *MapIterator) expired(e *Entry) bool {
+	if this.snap != nil {
+		return this.snap.expired(e)
+	}
+	return this.cm.expired(e.cell())
+}
+
+func (this *MapIterator) advanceEntry() {
+	if this.inTree {
+		if len(this.treeEntries) > 0 {
+			this.nextE, this.treeEntries = this.treeEntries[0], this.treeEntries[1:]
+			return
+		}
+		this.nextE, this.inTree = nil, false
+	} else if this.nextE != nil {
 		this.nextE = this.nextE.next
 		if this.nextE != nil {
 			return
@@ -1115,7 +1957,7 @@ func (this *MapIterator) advance() {
 	}
 
 	for this.nextTableIndex >= 0 {
-		this.nextE = (*Entry)(atomic.LoadPointer(&this.currentTable[this.nextTableIndex]))
+		this.setNext((*Entry)(atomic.LoadPointer(&this.currentTable[this.nextTableIndex])))
 		this.nextTableIndex--
 		if this.nextE != nil {
 			return
@@ -1123,21 +1965,30 @@ func (this *MapIterator) advance() {
 	}
 
 	for this.nextSegmentIndex >= 0 {
-		seg := this.cm.segments[this.nextSegmentIndex]
+		this.currentTable = this.segmentTable(this.nextSegmentIndex)
 		this.nextSegmentIndex--
-		if atomic.LoadInt32(&seg.count) != 0 {
-			this.currentTable = seg.loadTable()
-			for j := len(this.currentTable) - 1; j >= 0; j-- {
-				this.nextE = (*Entry)(atomic.LoadPointer(&this.currentTable[j]))
-				if this.nextE != nil {
-					this.nextTableIndex = j - 1
-					return
-				}
+		for j := len(this.currentTable) - 1; j >= 0; j-- {
+			this.setNext((*Entry)(atomic.LoadPointer(&this.currentTable[j])))
+			if this.nextE != nil {
+				this.nextTableIndex = j - 1
+				return
 			}
 		}
 	}
 }
 
+//segmentTable returns the table of segment i, nil if the segment is empty
+func (this *MapIterator) segmentTable(i int) []unsafe.Pointer {
+	if this.snap != nil {
+		return this.snap.tables[i]
+	}
+	seg := this.segments[i]
+	if atomic.LoadInt64(&seg.count) == 0 {
+		return nil
+	}
+	return seg.loadTable()
+}
+
 func (this *MapIterator) HasNext() bool {
 	return this.nextE != nil
 }
@@ -1152,8 +2003,9 @@ func (this *MapIterator) Next() (key interface{}, value interface{}, ok bool) {
 	return
 }
 
+//Remove removes the last returned key from the map, it is not supported by the iterator of a Snapshot
 func (this *MapIterator) Remove() (ok bool) {
-	if this.lastReturned == nil {
+	if this.lastReturned == nil || this.snap != nil {
 		return false
 	}
 	this.cm.Remove(this.lastReturned.key)
@@ -1172,7 +2024,8 @@ func (this *MapIterator) nextEntry() *Entry {
 
 func newMapIterator(cm *ConcurrentMap) *MapIterator {
 	hi := MapIterator{}
-	hi.nextSegmentIndex = len(cm.segments) - 1
+	hi.segments = cm.segmentList()
+	hi.nextSegmentIndex = len(hi.segments) - 1
 	hi.nextTableIndex = -1
 	hi.cm = cm
 	hi.advance()
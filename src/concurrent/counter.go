@@ -0,0 +1,58 @@
+package concurrent
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+/* ---------------- Size counter -------------- */
+
+//cacheLineSize is the distance between counter cells, so that no two cells share a cache line
+const cacheLineSize = 64
+
+/*
+* longAdder is a striped 64-bit counter, modeled on the LongAdder of
+* java.util.concurrent.atomic and the counter cells of Java 8's
+* ConcurrentHashMap. Every add goes to one of several cells chosen by a
+* probe, each cell on its own cache line, so writers that hit different
+* cells do not contend. sum adds up all cells without locking: it is exact
+* while no add is in flight, concurrent adds may or may not be counted.
+ */
+type longAdder struct {
+	cells []counterCell
+	mask  uint32
+}
+
+type counterCell struct {
+	n int64
+	_ [cacheLineSize - 8]byte
+}
+
+/**
+* Creates a counter with one cell per processor, rounded up to a power of two.
+*/
+func newLongAdder() *longAdder {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	return &longAdder{cells: make([]counterCell, n), mask: uint32(n - 1)}
+}
+
+/**
+* Adds delta to the cell chosen by probe, callers pass a hash code
+* so that unrelated writers spread over the cells.
+*/
+func (this *longAdder) add(probe uint32, delta int64) {
+	atomic.AddInt64(&this.cells[(probe^probe>>16)&this.mask].n, delta)
+}
+
+/**
+* Returns the sum of all cells.
+*/
+func (this *longAdder) sum() (s int64) {
+	for i := 0; i < len(this.cells); i++ {
+		s += atomic.LoadInt64(&this.cells[i].n)
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package concurrent
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestLongAdder(t *testing.T) {
+	a := newLongAdder()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				a.add(uint32(g*10000+i), 1)
+			}
+			a.add(uint32(g), -5000)
+		}(g)
+	}
+	wg.Wait()
+	if s := a.sum(); s != 8*5000 {
+		t.Errorf("sum %v, want %v", s, 8*5000)
+	}
+}
+
+func TestLongSize(t *testing.T) {
+	m := NewConcurrentMap()
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	for i := 0; i < 1000; i += 2 {
+		m.Remove(i)
+	}
+	m.Compute(1, func(interface{}) interface{} { return nil })
+	m.Compute(-1, func(interface{}) interface{} { return -1 })
+	if m.LongSize() != 500 || m.Size() != 500 {
+		t.Errorf("LongSize %v, Size %v, want 500", m.LongSize(), m.Size())
+	}
+	m.Clear()
+	if m.LongSize() != 0 {
+		t.Errorf("LongSize after Clear %v, want 0", m.LongSize())
+	}
+
+	//counts beyond 32 bits, without putting 2^31 entries
+	m.counter.add(0, math.MaxInt32+10)
+	if m.LongSize() != math.MaxInt32+10 || m.Size() != math.MaxInt32 {
+		t.Errorf("LongSize %v, Size %v, want %v, %v", m.LongSize(), m.Size(), int64(math.MaxInt32+10), math.MaxInt32)
+	}
+	m.counter.add(0, -(math.MaxInt32 + 11))
+	if m.LongSize() != 0 {
+		t.Errorf("LongSize of negative count %v, want 0", m.LongSize())
+	}
+}
+
+func TestSizeDuringWrites(t *testing.T) {
+	m := NewConcurrentMap()
+	n := 1000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; ; i += 4 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				m.Put(i+n, i)
+				m.Remove(i)
+			}
+		}(g)
+	}
+	//concurrent adds may or may not be counted, only the final count is exact
+	for k := 0; k < 1000; k++ {
+		if s := m.LongSize(); s < 0 {
+			t.Errorf("LongSize during writes %v, want >= 0", s)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+	if s := m.LongSize(); s != int64(n) {
+		t.Errorf("LongSize after writes %v, want %v", s, n)
+	}
+}
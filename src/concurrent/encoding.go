@@ -0,0 +1,118 @@
+package concurrent
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+/* ---------------- Canonical key encoding -------------- */
+
+/*
+* Keys are hashed by writing a canonical encoding of their value to the
+* hash function. The encoding depends only on the value, never on its
+* memory layout, so with the same seed a key has the same hash code in
+* every process and on every architecture:
+*
+*   bool                    1 byte, 0 or 1
+*   int, int8 ... int64     8 bytes little endian, sign extended
+*   uint, uint8 ... uintptr 8 bytes little endian, zero extended
+*   float32, float64        the IEEE 754 bits of the float64 value like uint64,
+*                           -0 is written as +0 and every NaN as one canonical NaN
+*   complex64, complex128   the real part, then the imaginary part like float64
+*   string                  its bytes
+*   array                   its elements in order
+*   struct                  its exported fields in declaration order,
+*                           unexported fields are skipped
+*   Hashable                the result of HashCode like uint64
+*   BytesHashable           the result of HashBytes, if the key is no Hashable
+*
+* Strings and Hashables inside an array or struct are preceded by their
+* length like uint64, so that the encodings of two fields never run into
+* each other.
+*
+* An int and an int64, or a float32 and a float64, holding the same value
+* have the same encoding. They are still different keys, keys are compared
+* with ==, except for NaN: a float or complex key that is NaN equals every
+* NaN key of the same type, so that it can be found again, unlike a NaN key
+* in a built-in map. NaN fields of array and struct keys and named float
+* types still follow ==, such keys are never found.
+ */
+
+//canonicalNaN is the bit pattern written for every NaN, the one returned by math.NaN
+const canonicalNaN uint64 = 0x7FF8000000000001
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(buf, v)
+}
+
+func appendBool(buf []byte, v bool) []byte {
+	if v {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+//canonicalFloat64 returns the bits written for f, +0 for -0 and canonicalNaN for any NaN
+func canonicalFloat64(f float64) uint64 {
+	if f != f {
+		return canonicalNaN
+	}
+	if f == 0 {
+		return 0
+	}
+	return math.Float64bits(f)
+}
+
+func appendComplex128(buf []byte, c complex128) []byte {
+	buf = appendUint64(buf, canonicalFloat64(real(c)))
+	return appendUint64(buf, canonicalFloat64(imag(c)))
+}
+
+//appendHashable appends the bytes of a Hashable or BytesHashable,
+//prefixed with their length if the key is nested in an array or struct.
+//A nil interface field of a key has no bytes
+func appendHashable(buf []byte, key interface{}, nested bool) []byte {
+	if key == nil {
+		if nested {
+			buf = appendUint64(buf, 0)
+		}
+		return buf
+	}
+	if hc, ok := key.(Hashable); ok {
+		if nested {
+			buf = appendUint64(buf, 8)
+		}
+		return appendUint64(buf, hc.HashCode())
+	}
+	bytes := key.(BytesHashable).HashBytes()
+	if nested {
+		buf = appendUint64(buf, uint64(len(bytes)))
+	}
+	return append(buf, bytes...)
+}
+
+//equalNaNs returns true if k1 and k2 are float or complex keys
+//of the same type that are both NaN, or both have NaN parts
+//where they are not equal
+func equalNaNs(k1, k2 interface{}) bool {
+	switch v1 := k1.(type) {
+	case float64:
+		v2, ok := k2.(float64)
+		return ok && v1 != v1 && v2 != v2
+	case float32:
+		v2, ok := k2.(float32)
+		return ok && v1 != v1 && v2 != v2
+	case complex128:
+		v2, ok := k2.(complex128)
+		return ok && equalFloatParts(real(v1), real(v2)) && equalFloatParts(imag(v1), imag(v2))
+	case complex64:
+		v2, ok := k2.(complex64)
+		return ok && equalFloatParts(float64(real(v1)), float64(real(v2))) &&
+			equalFloatParts(float64(imag(v1)), float64(imag(v2)))
+	}
+	return false
+}
+
+func equalFloatParts(f1, f2 float64) bool {
+	return f1 == f2 || f1 != f1 && f2 != f2
+}
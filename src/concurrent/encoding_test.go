@@ -0,0 +1,181 @@
+package concurrent
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type (
+	namedBool    bool
+	namedInt     int
+	namedInt8    int8
+	namedInt16   int16
+	namedInt32   int32
+	namedInt64   int64
+	namedUint    uint
+	namedUint8   uint8
+	namedUint16  uint16
+	namedUint32  uint32
+	namedUint64  uint64
+	namedUintptr uintptr
+	namedFloat32 float32
+	namedFloat64 float64
+	namedCplx64  complex64
+	namedCplx128 complex128
+	namedString  string
+)
+
+type encodingStruct struct {
+	A int8
+	b int64 //unexported, skipped
+	S string
+	F [2]float32
+}
+
+func le(v uint64) []byte {
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = byte(v >> (8 * uint(i)))
+	}
+	return b
+}
+
+func cat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+func encodeKey(t *testing.T, key interface{}) []byte {
+	buf, err := appendKey(nil, key)
+	if err != nil {
+		t.Fatalf("appendKey %#v, return error %v", key, err)
+	}
+	return buf
+}
+
+func TestCanonicalEncodingPerKind(t *testing.T) {
+	minus1 := le(math.MaxUint64)
+	one := le(math.Float64bits(1))
+	cases := []struct {
+		kind  reflect.Kind
+		key   interface{}
+		named interface{}
+		want  []byte
+	}{
+		{reflect.Bool, true, namedBool(true), []byte{1}},
+		{reflect.Int, -1, namedInt(-1), minus1},
+		{reflect.Int8, int8(-1), namedInt8(-1), minus1},
+		{reflect.Int16, int16(-1), namedInt16(-1), minus1},
+		{reflect.Int32, int32(-1), namedInt32(-1), minus1},
+		{reflect.Int64, int64(-1), namedInt64(-1), minus1},
+		{reflect.Uint, uint(7), namedUint(7), le(7)},
+		{reflect.Uint8, uint8(7), namedUint8(7), le(7)},
+		{reflect.Uint16, uint16(7), namedUint16(7), le(7)},
+		{reflect.Uint32, uint32(7), namedUint32(7), le(7)},
+		{reflect.Uint64, uint64(math.MaxUint64), namedUint64(math.MaxUint64), minus1},
+		{reflect.Uintptr, uintptr(7), namedUintptr(7), le(7)},
+		{reflect.Float32, float32(1), namedFloat32(1), one},
+		{reflect.Float64, float64(1), namedFloat64(1), one},
+		{reflect.Complex64, complex64(1 + 1i), namedCplx64(1 + 1i), cat(one, one)},
+		{reflect.Complex128, complex128(1 + 1i), namedCplx128(1 + 1i), cat(one, one)},
+		{reflect.String, "ab", namedString("ab"), []byte("ab")},
+		{reflect.Array, [2]int8{1, -1}, [2]namedInt8{1, -1}, cat(le(1), minus1)},
+		{reflect.Struct, encodingStruct{1, 99, "ab", [2]float32{1, 1}}, nil,
+			cat(le(1), le(2), []byte("ab"), one, one)},
+	}
+	for _, c := range cases {
+		if reflect.TypeOf(c.key).Kind() != c.kind {
+			t.Fatalf("case %v has a key of kind %v", c.kind, reflect.TypeOf(c.key).Kind())
+		}
+		if got := encodeKey(t, c.key); !bytes.Equal(got, c.want) {
+			t.Errorf("%v: encoding of %#v is %v, want %v", c.kind, c.key, got, c.want)
+		}
+		if c.named != nil {
+			if got := encodeKey(t, c.named); !bytes.Equal(got, c.want) {
+				t.Errorf("%v: encoding of %#v is %v, want %v", c.kind, c.named, got, c.want)
+			}
+		}
+
+		for _, key := range []interface{}{c.key, c.named} {
+			if key == nil {
+				continue
+			}
+			m := NewConcurrentMap()
+			m.Put(key, 1)
+			if v, ok := m.Get(key); !ok || v != 1 {
+				t.Errorf("%v: Get %#v, return %v, %v, want 1, true", c.kind, key, v, ok)
+			}
+		}
+	}
+
+	for _, key := range []interface{}{[]int{1}, map[int]int{}, func() {}, make(chan int), new(int)} {
+		if _, err := appendKey(nil, key); err != NonSupportKey {
+			t.Errorf("appendKey %T, return %v, want NonSupportKey", key, err)
+		}
+	}
+}
+
+func TestEncodingNestedStrings(t *testing.T) {
+	type pair struct{ A, B string }
+	e1, e2 := encodeKey(t, pair{"ab", ""}), encodeKey(t, pair{"a", "b"})
+	if bytes.Equal(e1, e2) {
+		t.Errorf("struct fields %v and %v have the same encoding", pair{"ab", ""}, pair{"a", "b"})
+	}
+}
+
+func TestFloatKeySemantics(t *testing.T) {
+	negZero := math.Copysign(0, -1)
+	if !bytes.Equal(encodeKey(t, negZero), encodeKey(t, 0.0)) {
+		t.Errorf("-0 and +0 have different encodings")
+	}
+	nan2 := math.Float64frombits(0x7FF8000000000002)
+	if !bytes.Equal(encodeKey(t, math.NaN()), encodeKey(t, nan2)) {
+		t.Errorf("NaNs with different bits have different encodings")
+	}
+
+	m := NewConcurrentMap()
+	m.Put(negZero, "zero")
+	if v, _ := m.Get(0.0); v != "zero" {
+		t.Errorf("Get +0 after Put -0, return %v, want zero", v)
+	}
+	m.Put(math.NaN(), "nan")
+	m.Put(nan2, "nan2")
+	if v, ok := m.Get(math.NaN()); !ok || v != "nan2" {
+		t.Errorf("Get NaN, return %v, %v, want nan2, true", v, ok)
+	}
+	if m.Size() != 2 {
+		t.Errorf("Size %v after putting two NaNs and a zero, want 2", m.Size())
+	}
+	m.Put(float32(math.NaN()), "nan32")
+	m.Put(complex(math.NaN(), 1), "cnan")
+	if v, _ := m.Get(float32(math.NaN())); v != "nan32" {
+		t.Errorf("Get float32 NaN, return %v, want nan32", v)
+	}
+	if v, _ := m.Get(complex(math.NaN(), 1)); v != "cnan" {
+		t.Errorf("Get complex NaN, return %v, want cnan", v)
+	}
+	if _, ok := m.Get(complex(math.NaN(), 2)); ok {
+		t.Errorf("Get complex NaN with different imaginary part, found a mapping")
+	}
+}
+
+func TestStableHashCode(t *testing.T) {
+	//hash codes are persisted, they must not change between releases or architectures
+	cases := []struct {
+		alg  HashAlgorithm
+		key  interface{}
+		want uint32
+	}{
+		{FNV1a, 1, 0xa30b188e},
+		{FNV1a, "key", 0xe1a2b1d6},
+		{SipHash, 1, 0x0ef5042c},
+		{SipHash, 1.5, 0xa280d1d2},
+	}
+	for _, c := range cases {
+		h, _ := hashKey(c.key, NewConcurrentMapWithSeed(42, c.alg))
+		if h != c.want {
+			t.Errorf("algorithm %v, hash code of %#v is %#x, want %#x", c.alg, c.key, h, c.want)
+		}
+	}
+}
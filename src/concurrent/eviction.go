@@ -0,0 +1,340 @@
+package concurrent
+
+import (
+	"sync/atomic"
+)
+
+/* ---------------- Eviction -------------- */
+
+/*
+* WithMaxEntries and WithMaxWeight bound the map. The bound is split
+* between the segments, each segment enforces its share on its own: a write
+* that takes the weight of the segment above its share evicts entries
+* chosen by the EvictionPolicy of the segment until the weight fits again.
+* So the map holds no more than the bound once a write returns, but a
+* segment can evict while others are below their share, so a full map may
+* hold somewhat fewer entries. New uses fewer segments if the bound is smaller than the number
+* of segments, so that every segment can hold at least one entry.
+*
+* Every entry of a bounded map has an EvictionNode that is kept in its
+* valueCell, so the node survives the copies made by rehash and Snapshot.
+* All methods of a policy are called under the segment lock. Writes record
+* an access of the written entry, Get records one only if the segment lock
+* is free, so under contention some reads are not seen by the policy.
+ */
+
+/**
+* EvictionNode is the per-entry state of a bounded map that an
+* EvictionPolicy orders. A node belongs to its entry from the write that
+* inserts the key until the entry is removed.
+*/
+type EvictionNode struct {
+	key    interface{}
+	hash   uint32
+	weight int64
+
+	//the policy the node has been added to, nil once it is removed
+	policy EvictionPolicy
+
+	//fields used by the policies of this package
+	prev, next *EvictionNode
+	referenced bool
+}
+
+//Key returns the key of the entry.
+func (this *EvictionNode) Key() interface{} {
+	return this.key
+}
+
+//Weight returns the weight of the entry, 1 unless the map has a weigher.
+func (this *EvictionNode) Weight() int64 {
+	return this.weight
+}
+
+/**
+* EvictionPolicy chooses the entries a full segment evicts. Each segment
+* has its own policy, created by the factory given to WithEvictionPolicy.
+* All methods are called while holding the segment lock.
+*/
+type EvictionPolicy interface {
+	//Add is called when a key is inserted
+	Add(node *EvictionNode)
+
+	//Access is called when the entry is read or written
+	Access(node *EvictionNode)
+
+	//Remove is called when the entry is removed, also after it is evicted
+	Remove(node *EvictionNode)
+
+	//Victim returns the entry to evict next without removing it, nil if there is none
+	Victim() *EvictionNode
+}
+
+/**
+* The list of a policy, a circular doubly linked list with a sentinel.
+*/
+type nodeList struct {
+	head EvictionNode
+}
+
+func (this *nodeList) init() {
+	this.head.prev, this.head.next = &this.head, &this.head
+}
+
+//insertBefore links n before at
+func (this *nodeList) insertBefore(n, at *EvictionNode) {
+	n.prev, n.next = at.prev, at
+	at.prev.next = n
+	at.prev = n
+}
+
+func (this *nodeList) unlink(n *EvictionNode) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	n.prev, n.next = nil, nil
+}
+
+/**
+* The policy returned by NewLRUPolicy, the list is ordered from the most
+* to the least recently used entry.
+*/
+type lruPolicy struct {
+	nodeList
+}
+
+/**
+* NewLRUPolicy returns a policy that evicts the least recently used entry.
+* It is the default policy of a bounded map.
+*/
+func NewLRUPolicy() EvictionPolicy {
+	p := &lruPolicy{}
+	p.init()
+	return p
+}
+
+func (this *lruPolicy) Add(n *EvictionNode) {
+	this.insertBefore(n, this.head.next)
+}
+
+func (this *lruPolicy) Access(n *EvictionNode) {
+	if this.head.next != n {
+		this.unlink(n)
+		this.insertBefore(n, this.head.next)
+	}
+}
+
+func (this *lruPolicy) Remove(n *EvictionNode) {
+	this.unlink(n)
+}
+
+func (this *lruPolicy) Victim() *EvictionNode {
+	if n := this.head.prev; n != &this.head {
+		return n
+	}
+	return nil
+}
+
+/**
+* The policy returned by NewClockPolicy. The hand moves through the
+* circular list, new entries are inserted behind the hand.
+*/
+type clockPolicy struct {
+	nodeList
+	hand *EvictionNode
+}
+
+/**
+* NewClockPolicy returns a CLOCK (second chance) policy, an approximation
+* of LRU that records an access by setting a flag instead of moving the
+* entry, so reads cost less than with NewLRUPolicy.
+*/
+func NewClockPolicy() EvictionPolicy {
+	p := &clockPolicy{}
+	p.init()
+	p.hand = &p.head
+	return p
+}
+
+func (this *clockPolicy) Add(n *EvictionNode) {
+	n.referenced = false
+	this.insertBefore(n, this.hand)
+}
+
+func (this *clockPolicy) Access(n *EvictionNode) {
+	n.referenced = true
+}
+
+func (this *clockPolicy) Remove(n *EvictionNode) {
+	if this.hand == n {
+		this.hand = n.next
+	}
+	this.unlink(n)
+}
+
+func (this *clockPolicy) Victim() *EvictionNode {
+	if this.head.next == &this.head {
+		return nil
+	}
+	//every node is passed at most once with its flag set, so this ends within two rounds
+	for {
+		n := this.hand
+		this.hand = n.next
+		if n == &this.head {
+			continue
+		}
+		if !n.referenced {
+			this.hand = n
+			return n
+		}
+		n.referenced = false
+	}
+}
+
+/**
+* Gives the new entry e a node if the segment is bounded. e is not
+* published yet, so its cell can still be changed.
+* Call only while holding lock.
+*/
+func (this *Segment) track(e *Entry) {
+	if this.policy == nil {
+		return
+	}
+	c := e.fastCell()
+	c.node = &EvictionNode{key: e.key, hash: e.hash, weight: this.m.weigh(e.key, c.v), policy: this.policy}
+	this.weight += c.node.weight
+	this.policy.Add(c.node)
+}
+
+/**
+* Moves the node of old to the new cell c that replaces it and updates the
+* weight of the entry. c is not published yet.
+* Call only while holding lock.
+*/
+func (this *Segment) retrack(old *valueCell, c *valueCell) {
+	n := old.node
+	if n == nil || n.policy != this.policy {
+		return
+	}
+	c.node = n
+	w := this.m.weigh(n.key, c.v)
+	this.weight += w - n.weight
+	n.weight = w
+	this.policy.Access(n)
+}
+
+/**
+* Removes the node of a removed entry from the policy.
+* Call only while holding lock.
+*/
+func (this *Segment) untrack(c *valueCell) {
+	n := c.node
+	if n == nil || n.policy != this.policy {
+		return
+	}
+	this.policy.Remove(n)
+	n.policy = nil
+	this.weight -= n.weight
+}
+
+/**
+* Records a read of the entry whose cell is c if the segment lock is free.
+* The lock is taken through its locker, so that reads do not count as
+* acquisitions, which lockLive and Stats count for writes.
+*/
+func (this *Segment) recordAccess(c *valueCell) {
+	if c.node != nil && this.lock.locker.TryLock() {
+		//the nodes of a split segment belong to the policies of its halves
+		if c.node.policy == this.policy && !this.moved {
+			this.policy.Access(c.node)
+		}
+		this.lock.locker.Unlock()
+	}
+}
+
+/**
+* Evicts entries until the weight of the segment fits its share, the
+* evicted entries are appended to evicted.
+* Call only while holding lock.
+*/
+func (this *Segment) evictIfNeeded(evicted *[]*Entry) {
+	if this.policy == nil || this.weight <= this.maxWeight {
+		return
+	}
+	n := int64(0)
+	for this.weight > this.maxWeight {
+		victim := this.policy.Victim()
+		if victim == nil {
+			break
+		}
+		tab, index := this.writableBin(victim.hash)
+		first := (*Entry)(tab[index])
+		e := findInBin(first, victim.key, victim.hash)
+		if e == nil {
+			//not in the table, only drop it from the policy
+			this.policy.Remove(victim)
+			victim.policy = nil
+			this.weight -= victim.weight
+			continue
+		}
+		this.unlinkEntry(tab, index, first, e)
+		this.m.counter.add(e.hash, -1)
+		this.m.emit(EventEvict, e.key, e.hash, e.fastValue(), nil)
+		*evicted = append(*evicted, e)
+		n++
+	}
+	if n > 0 {
+		atomic.AddInt64(&this.modCount, 1)
+		atomic.StoreInt64(&this.count, this.count-n)
+	}
+}
+
+/**
+* Calls the eviction listener for the evicted entries. Called by writers
+* after releasing the segment lock, so the listener may use the map.
+*/
+func (this *ConcurrentMap) notifyEvicted(evicted *[]*Entry) {
+	if this.onEvict == nil {
+		return
+	}
+	for _, e := range *evicted {
+		this.onEvict(e.key, e.fastValue())
+	}
+}
+
+//weigh returns the weight of an entry, 1 if the map has no weigher.
+//A negative weight is counted as 0, so it cannot lower the weight of
+//the other entries of the segment below the bound
+func (this *ConcurrentMap) weigh(key, value interface{}) int64 {
+	if this.weigher == nil {
+		return 1
+	}
+	if w := this.weigher(key, value); w > 0 {
+		return w
+	}
+	return 0
+}
+
+/**
+* Replaces the policy of a cleared segment, the nodes of the old table
+* stay with the old policy and are ignored.
+* Call only while holding lock.
+*/
+func (this *Segment) resetPolicy() {
+	if this.policy != nil {
+		this.policy = this.m.newPolicy()
+		this.weight = 0
+	}
+}
+
+//setMaxWeight gives the segments their shares of maxWeight
+func (this *ConcurrentMap) setMaxWeight(maxWeight int64) {
+	segments := this.segmentList()
+	n := int64(len(segments))
+	for i, s := range segments {
+		s.maxWeight = maxWeight / n
+		if int64(i) < maxWeight%n {
+			s.maxWeight++
+		}
+		s.policy = this.newPolicy()
+	}
+}
@@ -0,0 +1,162 @@
+package concurrent
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestEvictLRU(t *testing.T) {
+	var evicted []interface{}
+	var m *ConcurrentMap
+	m, _ = New(WithMaxEntries(4), WithConcurrencyLevel(1), WithEvictionListener(func(key, value interface{}) {
+		//the listener runs without the segment lock
+		if _, ok := m.Get(key); ok {
+			t.Errorf("evicted key %v is still in the map", key)
+		}
+		evicted = append(evicted, key)
+	}))
+	for i := 1; i <= 4; i++ {
+		m.Put(i, i)
+	}
+	m.Get(1)
+	m.Put(3, 30)
+	m.Put(5, 5)
+	m.Put(6, 6)
+	if !reflect.DeepEqual(evicted, []interface{}{2, 4}) {
+		t.Errorf("evicted %v, want [2 4]", evicted)
+	}
+	if s := m.Size(); s != 4 {
+		t.Errorf("Size %v, want 4", s)
+	}
+
+	//removed keys free their place
+	m.Remove(1)
+	m.Put(7, 7)
+	m.Clear()
+	for i := 0; i < 4; i++ {
+		m.Put(i, i)
+	}
+	if len(evicted) != 2 || m.Size() != 4 {
+		t.Errorf("evicted %v after Remove and Clear, Size %v", evicted, m.Size())
+	}
+
+	//recorded reads are no lock acquisitions, only the next Stats call is
+	acquisitions := m.Stats().Total().LockAcquisitions
+	for i := 0; i < 100; i++ {
+		m.Get(i % 4)
+	}
+	if n := m.Stats().Total().LockAcquisitions; n != acquisitions+1 {
+		t.Errorf("%v lock acquisitions after 100 reads, want %v", n, acquisitions+1)
+	}
+}
+
+func TestEvictClock(t *testing.T) {
+	var evicted []interface{}
+	m, _ := New(WithMaxEntries(4), WithConcurrencyLevel(1), WithEvictionPolicy(NewClockPolicy),
+		WithEvictionListener(func(key, value interface{}) { evicted = append(evicted, key) }))
+	for i := 1; i <= 4; i++ {
+		m.Put(i, i)
+	}
+	m.Get(1)
+	m.Get(3)
+	m.Put(5, 5)
+	m.Put(6, 6)
+	if !reflect.DeepEqual(evicted, []interface{}{2, 4}) {
+		t.Errorf("evicted %v, want [2 4]", evicted)
+	}
+}
+
+func TestMaxWeight(t *testing.T) {
+	m, _ := New(WithConcurrencyLevel(1), WithMaxWeight(10, func(key, value interface{}) int64 {
+		return int64(len(value.(string)))
+	}))
+	m.Put(1, "aaaa")
+	m.Put(2, "bbbb")
+	m.Put(3, "cc")
+	if s := m.Size(); s != 3 {
+		t.Errorf("Size %v, want 3", s)
+	}
+	//a heavier value evicts the least recently used entries
+	m.Replace(3, "cccccc")
+	if _, ok := m.Get(1); ok || m.Size() != 2 {
+		t.Errorf("Get evicted key return true, Size %v", m.Size())
+	}
+	m.Put(4, "dddddddddddd")
+	if s := m.Size(); s != 0 {
+		t.Errorf("Size after putting a value heavier than the bound %v, want 0", s)
+	}
+
+	//a negative weight counts as 0 and does not make room for heavier entries
+	m, _ = New(WithConcurrencyLevel(1), WithMaxWeight(10, func(key, value interface{}) int64 {
+		return int64(value.(int))
+	}))
+	m.Put("neg", -100)
+	m.Put(1, 6)
+	m.Get("neg")
+	m.Put(2, 6)
+	if _, ok := m.Get(1); ok || m.Size() != 2 || m.segmentList()[0].weight != 6 {
+		t.Errorf("negative weight, Size %v, weight %v", m.Size(), m.segmentList()[0].weight)
+	}
+
+	if _, err := New(WithMaxWeight(10, nil)); !errors.Is(err, IllegalArgError) {
+		t.Errorf("WithMaxWeight without weigher, return %v", err)
+	}
+	if _, err := New(WithMaxEntries(0)); !errors.Is(err, IllegalArgError) {
+		t.Errorf("WithMaxEntries(0), return %v", err)
+	}
+}
+
+func TestEvictSegments(t *testing.T) {
+	m, _ := New(WithMaxEntries(3))
+	if len(m.segmentList()) != 2 {
+		t.Errorf("%v segments for 3 entries, want 2", len(m.segmentList()))
+	}
+	total := int64(0)
+	for _, s := range m.segmentList() {
+		total += s.maxWeight
+	}
+	if total != 3 {
+		t.Errorf("segment shares sum to %v, want 3", total)
+	}
+}
+
+func TestConcurrentEviction(t *testing.T) {
+	for _, policy := range []func() EvictionPolicy{NewLRUPolicy, NewClockPolicy} {
+		max := int64(200)
+		m, _ := New(WithMaxEntries(max), WithConcurrencyLevel(4), WithEvictionPolicy(policy))
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < 20000; i++ {
+					k := r.Intn(1000)
+					switch r.Intn(4) {
+					case 0:
+						m.Remove(k)
+					case 1:
+						m.Get(k)
+					case 2:
+						m.Compute(k, func(oldVal interface{}) interface{} { return k })
+					default:
+						m.Put(k, k)
+					}
+				}
+			}(int64(g))
+		}
+		wg.Wait()
+
+		if s := m.LongSize(); s > max {
+			t.Errorf("Size %v, want at most %v", s, max)
+		}
+		for _, s := range m.segmentList() {
+			if s.weight != s.count || s.count > s.maxWeight {
+				t.Errorf("segment weight %v, count %v, share %v", s.weight, s.count, s.maxWeight)
+			}
+		}
+	}
+}
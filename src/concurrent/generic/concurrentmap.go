@@ -0,0 +1,783 @@
+// Package generic is a type-parameterized port of concurrent.ConcurrentMap.
+// It keeps the Segment/rehash design of the interface{} version, but the
+// hash function is bound at compile time and entries hold typed keys and
+// values, so the hot paths need neither type switches nor reflection.
+package generic
+
+import (
+	"concurrent"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+ * Hasher computes the hash code of a key. The upper bits of the result
+ * choose the segment and the lower bits choose the bucket, so a Hasher
+ * should spread its output over all 32 bits.
+ */
+type Hasher[K comparable] func(key K) uint32
+
+//segments is read-only, don't need synchronized
+type ConcurrentMap[K comparable, V any] struct {
+	hasher Hasher[K]
+
+	/**
+	 * Mask value for indexing into segments. The upper bits of a
+	 * key's hash code are used to choose the segment.
+	 */
+	segmentMask int
+
+	/**
+	 * Shift value for indexing within segments.
+	 */
+	segmentShift uint
+
+	/**
+	 * The segments, each of which is a specialized hash table
+	 */
+	segments []*Segment[K, V]
+}
+
+/**
+ * Returns the segment that should be used for key with given hash
+ * @param hash the hash code for the key
+ * @return the segment
+ */
+func (this *ConcurrentMap[K, V]) segmentFor(hash uint32) *Segment[K, V] {
+	return this.segments[(hash>>this.segmentShift)&uint32(this.segmentMask)]
+}
+
+/**
+ * Returns true if this map contains no key-value mappings.
+ */
+func (this *ConcurrentMap[K, V]) IsEmpty() bool {
+	segments := this.segments
+	mc := make([]int32, len(segments))
+	var mcsum int32 = 0
+	for i := 0; i < len(segments); i++ {
+		if atomic.LoadInt32(&segments[i].count) != 0 {
+			return false
+		} else {
+			mc[i] = atomic.LoadInt32(&segments[i].modCount)
+			mcsum += mc[i]
+		}
+	}
+
+	/*
+	 * if mcsum isn't zero, then modification is made,
+	 * we will check per-segments count and if modCount be modified
+	 * to avoid ABA problems in which an element in one segment was added and
+	 * in another removed during traversal
+	 */
+	if mcsum != 0 {
+		for i := 0; i < len(segments); i++ {
+			if atomic.LoadInt32(&segments[i].count) != 0 || mc[i] != atomic.LoadInt32(&segments[i].modCount) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/**
+ * Returns the number of key-value mappings in this map.
+ */
+func (this *ConcurrentMap[K, V]) Size() int32 {
+	segments := this.segments
+	var sum int32 = 0
+	var check int32 = 0
+	mc := make([]int32, len(segments))
+
+	// Try a few times to get accurate count. On failure due to
+	// continuous async changes in table, resort to locking.
+	for k := 0; k < concurrent.RETRIES_BEFORE_LOCK; k++ {
+		check = 0
+		sum = 0
+		var mcsum int32 = 0
+		for i := 0; i < len(segments); i++ {
+			sum += atomic.LoadInt32(&segments[i].count)
+			mc[i] = atomic.LoadInt32(&segments[i].modCount)
+			mcsum += mc[i]
+		}
+		if mcsum != 0 {
+			for i := 0; i < len(segments); i++ {
+				check += atomic.LoadInt32(&segments[i].count)
+				if mc[i] != atomic.LoadInt32(&segments[i].modCount) {
+					//async change happens, force retry
+					check = -1
+					break
+				}
+			}
+		}
+
+		if check == sum {
+			break
+		}
+	}
+
+	//async change happens in each loop
+	//lock all segments to get accurate count
+	if check != sum {
+		sum = 0
+		for i := 0; i < len(segments); i++ {
+			segments[i].lock.Lock()
+		}
+		for i := 0; i < len(segments); i++ {
+			sum += segments[i].count
+		}
+		for i := 0; i < len(segments); i++ {
+			segments[i].lock.Unlock()
+		}
+	}
+	return sum
+}
+
+/**
+ * Returns the value to which the specified key is mapped.
+ * ok is false if this map contains no mapping for the key.
+ */
+func (this *ConcurrentMap[K, V]) Get(key K) (value V, ok bool) {
+	hash := this.hasher(key)
+	return this.segmentFor(hash).get(key, hash)
+}
+
+/**
+* Tests if the specified object is a key in this table.
+ */
+func (this *ConcurrentMap[K, V]) ContainsKey(key K) bool {
+	hash := this.hasher(key)
+	return this.segmentFor(hash).containsKey(key, hash)
+}
+
+/**
+* Maps the specified key to the specified value in this table.
+*
+* @return the previous value associated with key, and true if
+*         there was a mapping for key
+ */
+func (this *ConcurrentMap[K, V]) Put(key K, value V) (oldVal V, ok bool) {
+	hash := this.hasher(key)
+	return this.segmentFor(hash).put(key, hash, value, false)
+}
+
+/**
+* Maps the specified key to the specified value only if there is
+* no mapping for the key yet.
+*
+* @return the current value associated with the specified key,
+*         and true if there was a mapping for the key
+ */
+func (this *ConcurrentMap[K, V]) PutIfAbsent(key K, value V) (oldVal V, ok bool) {
+	hash := this.hasher(key)
+	return this.segmentFor(hash).put(key, hash, value, true)
+}
+
+/**
+* Maps the specified key to the value that be returned by specified function in this table.
+*
+* The current value and whether a mapping exists are passed into action.
+* If action returns keep == false, the specified key will be removed from map.
+*
+* @return the previous value associated with key, and true if
+*         there was a mapping for key
+ */
+func (this *ConcurrentMap[K, V]) Update(key K, action func(oldVal V, ok bool) (newVal V, keep bool)) (oldVal V, ok bool) {
+	hash := this.hasher(key)
+	return this.segmentFor(hash).update(key, hash, action)
+}
+
+/**
+* Copies all of the mappings from the specified map to this one.
+* These mappings replace any mappings that this map had for any of the
+* keys currently in the specified map.
+ */
+func (this *ConcurrentMap[K, V]) PutAll(m map[K]V) {
+	for k, v := range m {
+		this.Put(k, v)
+	}
+}
+
+/**
+* Removes the key (and its corresponding value) from this map.
+* This method does nothing if the key is not in the map.
+*
+* @return the previous value associated with key, and true if
+*         there was a mapping for key
+ */
+func (this *ConcurrentMap[K, V]) Remove(key K) (oldVal V, ok bool) {
+	hash := this.hasher(key)
+	return this.segmentFor(hash).remove(key, hash, nil, nil)
+}
+
+/**
+* Removes the mapping for the key and value from this map.
+* This method does nothing if no mapping for the key and value.
+* eq compares value with the mapped value, see Equal.
+*
+* @return true if mapping be removed, false otherwise
+ */
+func (this *ConcurrentMap[K, V]) RemoveEntry(key K, value V, eq func(v1, v2 V) bool) bool {
+	hash := this.hasher(key)
+	_, ok := this.segmentFor(hash).remove(key, hash, &value, eq)
+	return ok
+}
+
+/**
+* CompareAndReplace executes the compare-and-replace operation.
+* Replaces the value if the mapping exists for the previous and key from this map.
+* This method does nothing if no mapping for the key and value.
+* eq compares oldVal with the mapped value, see Equal.
+*
+* @return true if value be replaced, false otherwise
+ */
+func (this *ConcurrentMap[K, V]) CompareAndReplace(key K, oldVal V, newVal V, eq func(v1, v2 V) bool) bool {
+	hash := this.hasher(key)
+	return this.segmentFor(hash).compareAndReplace(key, hash, oldVal, newVal, eq)
+}
+
+/**
+* Replaces the value if the key is in the map.
+* This method does nothing if no mapping for the key.
+*
+* @return the previous value associated with the specified key,
+*         and true if there was a mapping for the key
+ */
+func (this *ConcurrentMap[K, V]) Replace(key K, value V) (oldVal V, ok bool) {
+	hash := this.hasher(key)
+	return this.segmentFor(hash).replace(key, hash, value)
+}
+
+/**
+* Removes all of the mappings from this map.
+ */
+func (this *ConcurrentMap[K, V]) Clear() {
+	for i := 0; i < len(this.segments); i++ {
+		this.segments[i].clear()
+	}
+}
+
+//Iterator returns a iterator for ConcurrentMap
+func (this *ConcurrentMap[K, V]) Iterator() *MapIterator[K, V] {
+	return newMapIterator(this)
+}
+
+//ToSlice returns a slice that includes all key-value Entry in ConcurrentMap
+func (this *ConcurrentMap[K, V]) ToSlice() (kvs []*Entry[K, V]) {
+	kvs = make([]*Entry[K, V], 0, this.Size())
+	itr := this.Iterator()
+	for itr.HasNext() {
+		kvs = append(kvs, itr.nextEntry())
+	}
+	return
+}
+
+func (this *ConcurrentMap[K, V]) newSegment(initialCapacity int, lf float32) (s *Segment[K, V]) {
+	s = new(Segment[K, V])
+	s.loadFactor = lf
+	s.setTable(make([]atomic.Pointer[Entry[K, V]], initialCapacity))
+	return
+}
+
+/**
+* Creates a new, empty map with the specified hash function, initial
+* capacity, load factor and concurrency level.
+*
+* If hasher is nil, a per-map seeded hash over the comparable key is used,
+* see ComparableHasher.
+*
+* panic error "IllegalArgumentException" if the initial capacity is
+* negative or the load factor or concurrencyLevel are
+* nonpositive.
+ */
+func NewConcurrentMap3[K comparable, V any](hasher Hasher[K], initialCapacity int,
+	loadFactor float32, concurrencyLevel int) (m *ConcurrentMap[K, V]) {
+	m = &ConcurrentMap[K, V]{}
+
+	if !(loadFactor > 0) || initialCapacity < 0 || concurrencyLevel <= 0 {
+		panic(concurrent.IllegalArgError)
+	}
+
+	if hasher == nil {
+		hasher = ComparableHasher[K]()
+	}
+	m.hasher = hasher
+
+	if concurrencyLevel > concurrent.MAX_SEGMENTS {
+		concurrencyLevel = concurrent.MAX_SEGMENTS
+	}
+
+	// Find power-of-two sizes best matching arguments
+	sshift := 0
+	ssize := 1
+	for ssize < concurrencyLevel {
+		sshift++
+		ssize = ssize << 1
+	}
+
+	m.segmentShift = uint(32) - uint(sshift)
+	m.segmentMask = ssize - 1
+
+	m.segments = make([]*Segment[K, V], ssize)
+
+	if initialCapacity > concurrent.MAXIMUM_CAPACITY {
+		initialCapacity = concurrent.MAXIMUM_CAPACITY
+	}
+
+	c := initialCapacity / ssize
+	if c*ssize < initialCapacity {
+		c++
+	}
+	cap := 1
+	for cap < c {
+		cap <<= 1
+	}
+
+	for i := 0; i < len(m.segments); i++ {
+		m.segments[i] = m.newSegment(cap, loadFactor)
+	}
+	return
+}
+
+/**
+* Creates a new, empty map with the specified hash function and a default
+* initial capacity (16), load factor (0.75) and concurrencyLevel (16).
+ */
+func NewConcurrentMap[K comparable, V any](hasher Hasher[K]) *ConcurrentMap[K, V] {
+	return NewConcurrentMap3[K, V](hasher, concurrent.DEFAULT_INITIAL_CAPACITY,
+		concurrent.DEFAULT_LOAD_FACTOR, concurrent.DEFAULT_CONCURRENCY_LEVEL)
+}
+
+/**
+* Creates a new map with the same mappings as the given map.
+* The map is created with a capacity of 1.5 times the number
+* of mappings in the given map or 16 (whichever is greater),
+* and a default load factor (0.75) and concurrencyLevel (16).
+ */
+func NewConcurrentMapFromMap[K comparable, V any](hasher Hasher[K], m map[K]V) *ConcurrentMap[K, V] {
+	c := int(float32(len(m))/concurrent.DEFAULT_LOAD_FACTOR + 1)
+	if c < concurrent.DEFAULT_INITIAL_CAPACITY {
+		c = concurrent.DEFAULT_INITIAL_CAPACITY
+	}
+	cm := NewConcurrentMap3[K, V](hasher, c, concurrent.DEFAULT_LOAD_FACTOR, concurrent.DEFAULT_CONCURRENCY_LEVEL)
+	cm.PutAll(m)
+	return cm
+}
+
+/**
+* ConcurrentHashMap list entry.
+* Note only value field is variable and must use atomic to read/write it,
+* other three fields are read-only after initializing.
+* The value pointer is stored before the entry is published into the table,
+* so an unsynchronized reader never observes a nil value. Readers load a
+* value of any size in one atomic step through the pointer, so every write
+* of a value allocates a new V on the heap.
+ */
+type Entry[K comparable, V any] struct {
+	key   K
+	hash  uint32
+	value atomic.Pointer[V]
+	next  *Entry[K, V]
+}
+
+func newEntry[K comparable, V any](key K, hash uint32, value *V, next *Entry[K, V]) *Entry[K, V] {
+	e := &Entry[K, V]{key: key, hash: hash, next: next}
+	e.value.Store(value)
+	return e
+}
+
+func (this *Entry[K, V]) Key() K {
+	return this.key
+}
+
+func (this *Entry[K, V]) Value() V {
+	return *this.value.Load()
+}
+
+//storeValue publishes a copy of v, which escapes to the heap
+func (this *Entry[K, V]) storeValue(v V) {
+	this.value.Store(&v)
+}
+
+type Segment[K comparable, V any] struct {
+	/**
+	* The number of elements in this segment's region.
+	* Must use atomic package's LoadInt32 and StoreInt32 functions to read/write this field
+	* otherwise read operation may cannot read latest value
+	 */
+	count int32
+
+	/**
+	* Number of updates that alter the size of the table. This is
+	* used during bulk-read methods to make sure they see a
+	* consistent snapshot.
+	 */
+	modCount int32
+
+	/**
+	* The table is rehashed when its size exceeds this threshold.
+	* (The value of this field is always (int)(capacity *
+	* loadFactor).)
+	 */
+	threshold int32
+
+	/**
+	* The per-segment table.
+	 */
+	pTable atomic.Pointer[[]atomic.Pointer[Entry[K, V]]]
+
+	/**
+	* The load factor for the hash table. Even though this value
+	* is same for all segments, it is replicated to avoid needing
+	* links to outer object.
+	 */
+	loadFactor float32
+
+	lock sync.Mutex
+}
+
+func (this *Segment[K, V]) rehash() {
+	oldTable := this.table()
+	oldCapacity := len(oldTable)
+	if oldCapacity >= concurrent.MAXIMUM_CAPACITY {
+		return
+	}
+
+	/*
+	* Reclassify nodes in each list to new Map. See
+	* concurrent.Segment.rehash: the trailing run of nodes that land in
+	* the same new bin is reused, all preceding nodes are cloned, so the
+	* next fields of old nodes never change under lock-free readers.
+	 */
+	newTable := make([]atomic.Pointer[Entry[K, V]], oldCapacity<<1)
+	atomic.StoreInt32(&this.threshold, int32(float32(len(newTable))*this.loadFactor))
+	sizeMask := uint32(len(newTable) - 1)
+	for i := 0; i < oldCapacity; i++ {
+		e := oldTable[i].Load()
+
+		if e != nil {
+			next := e.next
+			idx := e.hash & sizeMask
+
+			//  Single node on list
+			if next == nil {
+				newTable[idx].Store(e)
+			} else {
+				// Reuse trailing consecutive sequence at same slot
+				lastRun := e
+				lastIdx := idx
+				for last := next; last != nil; last = last.next {
+					k := last.hash & sizeMask
+					if k != lastIdx {
+						lastIdx = k
+						lastRun = last
+					}
+				}
+				newTable[lastIdx].Store(lastRun)
+
+				// Clone all remaining nodes
+				for p := e; p != lastRun; p = p.next {
+					k := p.hash & sizeMask
+					newTable[k].Store(newEntry(p.key, p.hash, p.value.Load(), newTable[k].Load()))
+				}
+			}
+		}
+	}
+	this.pTable.Store(&newTable)
+}
+
+/**
+* Sets table to new slice.
+* Call only while holding lock or in constructor.
+ */
+func (this *Segment[K, V]) setTable(newTable []atomic.Pointer[Entry[K, V]]) {
+	this.threshold = (int32)(float32(len(newTable)) * this.loadFactor)
+	this.pTable.Store(&newTable)
+}
+
+/**
+* returns the current table.
+ */
+func (this *Segment[K, V]) table() []atomic.Pointer[Entry[K, V]] {
+	return *this.pTable.Load()
+}
+
+/**
+* Returns first entry of bin for given hash.
+ */
+func (this *Segment[K, V]) getFirst(hash uint32) *Entry[K, V] {
+	tab := this.table()
+	return tab[hash&uint32(len(tab)-1)].Load()
+}
+
+/**
+* Returns the entry for key in the bin for hash, or nil.
+ */
+func (this *Segment[K, V]) findEntry(key K, hash uint32) *Entry[K, V] {
+	e := this.getFirst(hash)
+	for e != nil && (e.hash != hash || e.key != key) {
+		e = e.next
+	}
+	return e
+}
+
+/* Specialized implementations of map methods */
+
+func (this *Segment[K, V]) get(key K, hash uint32) (value V, ok bool) {
+	if atomic.LoadInt32(&this.count) != 0 { // atomic-read
+		if e := this.findEntry(key, hash); e != nil {
+			return e.Value(), true
+		}
+	}
+	return
+}
+
+func (this *Segment[K, V]) containsKey(key K, hash uint32) bool {
+	if atomic.LoadInt32(&this.count) != 0 { // atomic-read
+		return this.findEntry(key, hash) != nil
+	}
+	return false
+}
+
+func (this *Segment[K, V]) compareAndReplace(key K, hash uint32, oldVal V, newVal V, eq func(v1, v2 V) bool) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e := this.findEntry(key, hash)
+	if e != nil && eq(oldVal, e.Value()) {
+		e.storeValue(newVal)
+		return true
+	}
+	return false
+}
+
+func (this *Segment[K, V]) replace(key K, hash uint32, newVal V) (oldVal V, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if e := this.findEntry(key, hash); e != nil {
+		oldVal, ok = e.Value(), true
+		e.storeValue(newVal)
+	}
+	return
+}
+
+/**
+* See concurrent.Segment.put for the ordering argument: count is written
+* last, after the new entry has been published into the table.
+ */
+func (this *Segment[K, V]) put(key K, hash uint32, value V, onlyIfAbsent bool) (oldValue V, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	c := this.count
+	if c > this.threshold { // ensure capacity
+		this.rehash()
+	}
+
+	tab := this.table()
+	index := hash & uint32(len(tab)-1)
+	first := tab[index].Load()
+	e := first
+
+	for e != nil && (e.hash != hash || e.key != key) {
+		e = e.next
+	}
+
+	if e != nil {
+		oldValue, ok = e.Value(), true
+		if !onlyIfAbsent {
+			e.storeValue(value)
+		}
+	} else {
+		c++
+		this.modCount++
+		tab[index].Store(newEntry(key, hash, &value, first))
+		atomic.StoreInt32(&this.count, c)
+	}
+	return
+}
+
+func (this *Segment[K, V]) update(key K, hash uint32, action func(oldVal V, ok bool) (newVal V, keep bool)) (oldValue V, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	c := this.count
+	if c > this.threshold { // ensure capacity
+		this.rehash()
+	}
+
+	tab := this.table()
+	index := hash & uint32(len(tab)-1)
+	first := tab[index].Load()
+	e := first
+
+	for e != nil && (e.hash != hash || e.key != key) {
+		e = e.next
+	}
+	if e != nil {
+		oldValue, ok = e.Value(), true
+	}
+
+	newVal, keep := action(oldValue, ok)
+	if keep {
+		if e != nil {
+			e.storeValue(newVal)
+		} else {
+			this.modCount++
+			tab[index].Store(newEntry(key, hash, &newVal, first))
+			atomic.StoreInt32(&this.count, c+1)
+		}
+	} else if e != nil {
+		//remove key if action does not keep it
+		this.unlink(tab, index, first, e)
+	}
+	return
+}
+
+/**
+* Removes e from the bin at index. All entries following removed node can
+* stay in list, but all preceding ones need to be cloned.
+* Call only while holding lock.
+ */
+func (this *Segment[K, V]) unlink(tab []atomic.Pointer[Entry[K, V]], index uint32, first, e *Entry[K, V]) {
+	this.modCount++
+	newFirst := e.next
+	for p := first; p != e; p = p.next {
+		newFirst = newEntry(p.key, p.hash, p.value.Load(), newFirst)
+	}
+	tab[index].Store(newFirst)
+	atomic.StoreInt32(&this.count, this.count-1)
+}
+
+/**
+* Remove; match on key only if value nil, else match both with eq.
+ */
+func (this *Segment[K, V]) remove(key K, hash uint32, value *V, eq func(v1, v2 V) bool) (oldValue V, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	tab := this.table()
+	index := hash & uint32(len(tab)-1)
+	first := tab[index].Load()
+	e := first
+
+	for e != nil && (e.hash != hash || e.key != key) {
+		e = e.next
+	}
+
+	if e != nil {
+		v := e.Value()
+		if value == nil || eq(*value, v) {
+			oldValue, ok = v, true
+			this.unlink(tab, index, first, e)
+		}
+	}
+	return
+}
+
+func (this *Segment[K, V]) clear() {
+	if atomic.LoadInt32(&this.count) != 0 {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+
+		tab := this.table()
+		for i := 0; i < len(tab); i++ {
+			tab[i].Store(nil)
+		}
+		this.modCount++
+		atomic.StoreInt32(&this.count, 0)
+	}
+}
+
+/**
+* Equal compares two values of a comparable type with ==, for the methods
+* that compare values, e.g. m.RemoveEntry(key, value, Equal).
+* Values of other types, like slices, need their own function.
+ */
+func Equal[V comparable](v1, v2 V) bool {
+	return v1 == v2
+}
+
+/* ---------------- Iterator Support -------------- */
+
+type MapIterator[K comparable, V any] struct {
+	nextSegmentIndex int
+	nextTableIndex   int
+	currentTable     []atomic.Pointer[Entry[K, V]]
+	nextE            *Entry[K, V]
+	lastReturned     *Entry[K, V]
+	cm               *ConcurrentMap[K, V]
+}
+
+func (this *MapIterator[K, V]) advance() {
+	if this.nextE != nil {
+		this.nextE = this.nextE.next
+		if this.nextE != nil {
+			return
+		}
+	}
+
+	for this.nextTableIndex >= 0 {
+		this.nextE = this.currentTable[this.nextTableIndex].Load()
+		this.nextTableIndex--
+		if this.nextE != nil {
+			return
+		}
+	}
+
+	for this.nextSegmentIndex >= 0 {
+		seg := this.cm.segments[this.nextSegmentIndex]
+		this.nextSegmentIndex--
+		if atomic.LoadInt32(&seg.count) != 0 {
+			this.currentTable = seg.table()
+			for j := len(this.currentTable) - 1; j >= 0; j-- {
+				this.nextE = this.currentTable[j].Load()
+				if this.nextE != nil {
+					this.nextTableIndex = j - 1
+					return
+				}
+			}
+		}
+	}
+}
+
+func (this *MapIterator[K, V]) HasNext() bool {
+	return this.nextE != nil
+}
+
+func (this *MapIterator[K, V]) Next() (key K, value V, ok bool) {
+	if this.nextE == nil {
+		return
+	}
+	this.lastReturned = this.nextE
+	this.advance()
+	key, value, ok = this.lastReturned.Key(), this.lastReturned.Value(), true
+	return
+}
+
+func (this *MapIterator[K, V]) Remove() (ok bool) {
+	if this.lastReturned == nil {
+		return false
+	}
+	this.cm.Remove(this.lastReturned.key)
+	this.lastReturned = nil
+	return true
+}
+
+func (this *MapIterator[K, V]) nextEntry() *Entry[K, V] {
+	if this.nextE == nil {
+		panic("IllegalStateException")
+	}
+	this.lastReturned = this.nextE
+	this.advance()
+	return this.lastReturned
+}
+
+func newMapIterator[K comparable, V any](cm *ConcurrentMap[K, V]) *MapIterator[K, V] {
+	hi := MapIterator[K, V]{}
+	hi.nextSegmentIndex = len(cm.segments) - 1
+	hi.nextTableIndex = -1
+	hi.cm = cm
+	hi.advance()
+	return &hi
+}
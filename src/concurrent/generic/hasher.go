@@ -0,0 +1,80 @@
+package generic
+
+import (
+	"hash/maphash"
+)
+
+const (
+	fnvOffset32 uint32 = 2166136261
+	fnvPrime32  uint32 = 16777619
+)
+
+//fnv32a8 hashes the 8 little-endian bytes of v with 32-bit FNV-1a,
+//the same bytes concurrent's hashKey writes for 64-bit integers
+func fnv32a8(v uint64) uint32 {
+	h := fnvOffset32
+	for i := 0; i < 8; i++ {
+		h ^= uint32(byte(v))
+		h *= fnvPrime32
+		v >>= 8
+	}
+	return h
+}
+
+//fnv32a4 hashes the 4 little-endian bytes of v with 32-bit FNV-1a
+func fnv32a4(v uint32) uint32 {
+	h := fnvOffset32
+	for i := 0; i < 4; i++ {
+		h ^= v & 0xff
+		h *= fnvPrime32
+		v >>= 8
+	}
+	return h
+}
+
+//IntHasher hashes int keys with FNV-1a over 8 bytes.
+func IntHasher(key int) uint32 {
+	return fnv32a8(uint64(key))
+}
+
+//Int64Hasher hashes int64 keys with FNV-1a.
+func Int64Hasher(key int64) uint32 {
+	return fnv32a8(uint64(key))
+}
+
+//Uint64Hasher hashes uint64 keys with FNV-1a.
+func Uint64Hasher(key uint64) uint32 {
+	return fnv32a8(key)
+}
+
+//Int32Hasher hashes int32 keys with FNV-1a.
+func Int32Hasher(key int32) uint32 {
+	return fnv32a4(uint32(key))
+}
+
+//Uint32Hasher hashes uint32 keys with FNV-1a.
+func Uint32Hasher(key uint32) uint32 {
+	return fnv32a4(key)
+}
+
+//StringHasher hashes string keys with FNV-1a, without copying the string.
+func StringHasher(key string) uint32 {
+	h := fnvOffset32
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+//ComparableHasher returns a Hasher for any comparable key type, backed by
+//hash/maphash with a freshly drawn seed. It is used when no hasher is
+//given to a constructor. The hash of a key is only stable within the
+//returned Hasher.
+func ComparableHasher[K comparable]() Hasher[K] {
+	seed := maphash.MakeSeed()
+	return func(key K) uint32 {
+		h := maphash.Comparable(seed, key)
+		return uint32(h ^ (h >> 32))
+	}
+}
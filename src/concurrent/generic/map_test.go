@@ -0,0 +1,183 @@
+package generic
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestIntKey(t *testing.T) {
+	m := NewConcurrentMap[int, string](IntHasher)
+
+	if _, ok := m.Put(1, "a"); ok {
+		t.Errorf("Put 1 firstly, return ok, want !ok")
+	}
+	if old, ok := m.Put(1, "b"); !ok || old != "a" {
+		t.Errorf("Put 1 second time, return %v, %v, want a, true", old, ok)
+	}
+	if old, ok := m.PutIfAbsent(1, "c"); !ok || old != "b" {
+		t.Errorf("PutIfAbsent 1, return %v, %v, want b, true", old, ok)
+	}
+	if v, ok := m.Get(1); !ok || v != "b" {
+		t.Errorf("Get 1, return %v, %v, want b, true", v, ok)
+	}
+	if _, ok := m.Get(2); ok {
+		t.Errorf("Get 2, return ok, want !ok")
+	}
+
+	m.PutAll(map[int]string{2: "x", 3: "y", 4: "z"})
+	if s := m.Size(); s != 4 {
+		t.Errorf("Size return %v, want 4", s)
+	}
+
+	if m.RemoveEntry(2, "wrong", Equal) {
+		t.Errorf("RemoveEntry with wrong value, return true, want false")
+	}
+	if old, ok := m.Replace(2, "xx"); !ok || old != "x" {
+		t.Errorf("Replace 2, return %v, %v, want x, true", old, ok)
+	}
+	if m.CompareAndReplace(2, "x", "xxx", Equal) {
+		t.Errorf("CompareAndReplace with wrong old value, return true, want false")
+	}
+	if !m.CompareAndReplace(2, "xx", "x", Equal) {
+		t.Errorf("CompareAndReplace with right old value, return false, want true")
+	}
+	if !m.RemoveEntry(2, "x", Equal) {
+		t.Errorf("RemoveEntry with right value, return false, want true")
+	}
+	if old, ok := m.Remove(3); !ok || old != "y" {
+		t.Errorf("Remove 3, return %v, %v, want y, true", old, ok)
+	}
+	if m.ContainsKey(3) {
+		t.Errorf("ContainsKey 3 after removing, return true, want false")
+	}
+
+	m.Clear()
+	if !m.IsEmpty() || m.Size() != 0 {
+		t.Errorf("map isn't empty after Clear")
+	}
+}
+
+//zero values are legal values now, Get reports presence separately
+func TestZeroValue(t *testing.T) {
+	m := NewConcurrentMap[string, int](StringHasher)
+	m.Put("zero", 0)
+	if v, ok := m.Get("zero"); !ok || v != 0 {
+		t.Errorf("Get zero, return %v, %v, want 0, true", v, ok)
+	}
+}
+
+type compositeKey struct {
+	tenant int
+	object string
+}
+
+func TestDefaultHasher(t *testing.T) {
+	m := NewConcurrentMap[compositeKey, int](nil)
+	for i := 0; i < 1000; i++ {
+		m.Put(compositeKey{i % 7, strconv.Itoa(i)}, i)
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := m.Get(compositeKey{i % 7, strconv.Itoa(i)}); !ok || v != i {
+			t.Fatalf("Get %v, return %v, %v, want %v, true", i, v, ok, i)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	m := NewConcurrentMap[string, []string](StringHasher)
+	appendAction := func(s string) func([]string, bool) ([]string, bool) {
+		return func(old []string, ok bool) ([]string, bool) {
+			return append(old, s), true
+		}
+	}
+	m.Update("j", appendAction("jack"))
+	m.Update("j", appendAction("jackson"))
+	if v, _ := m.Get("j"); len(v) != 2 {
+		t.Errorf("Get j after two updates, return %v, want 2 items", v)
+	}
+
+	//slices are not comparable, compare them by their elements
+	eq := func(v1, v2 []string) bool { return strings.Join(v1, ",") == strings.Join(v2, ",") }
+	if m.CompareAndReplace("j", []string{"jack"}, nil, eq) {
+		t.Errorf("CompareAndReplace with wrong old slice, return true, want false")
+	}
+	if !m.CompareAndReplace("j", []string{"jack", "jackson"}, []string{"j"}, eq) || !m.RemoveEntry("j", []string{"j"}, eq) {
+		t.Errorf("CompareAndReplace and RemoveEntry with equal slices, return false, want true")
+	}
+
+	m.Update("j", appendAction("jack"))
+	m.Update("j", func([]string, bool) ([]string, bool) { return nil, false })
+	if m.ContainsKey("j") {
+		t.Errorf("Update that drops the key, key still exists")
+	}
+}
+
+func TestIteratorAndGrowth(t *testing.T) {
+	m := NewConcurrentMap3[int, int](IntHasher, 0, 0.75, 4)
+	n := 10000
+	for i := 0; i < n; i++ {
+		m.Put(i, i*2)
+	}
+	seen := make(map[int]bool, n)
+	for itr := m.Iterator(); itr.HasNext(); {
+		k, v, _ := itr.Next()
+		if v != k*2 {
+			t.Fatalf("iterate %v, value %v, want %v", k, v, k*2)
+		}
+		seen[k] = true
+	}
+	if len(seen) != n || len(m.ToSlice()) != n {
+		t.Errorf("iterate %v keys, want %v", len(seen), n)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	m := NewConcurrentMap[int, int](IntHasher)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := g*2000 + i
+				m.Put(k, k)
+				if v, ok := m.Get(k); !ok || v != k {
+					t.Errorf("Get %v, return %v, %v", k, v, ok)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if s := m.Size(); s != 16000 {
+		t.Errorf("Size return %v, want 16000", s)
+	}
+}
+
+//the inlined FNV must agree with hash/fnv over the same bytes
+func TestHasherMatchesFNV(t *testing.T) {
+	for _, k := range []int{0, 1, -1, 1 << 40} {
+		k64 := uint64(k)
+		h := fnv.New32a()
+		h.Write((*((*[8]byte)(unsafe.Pointer(&k64))))[:])
+		if IntHasher(k) != h.Sum32() {
+			t.Errorf("IntHasher(%v) = %v, want %v", k, IntHasher(k), h.Sum32())
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte("hello"))
+	if StringHasher("hello") != h.Sum32() {
+		t.Errorf("StringHasher mismatch")
+	}
+}
+
+func BenchmarkIntPutGet(b *testing.B) {
+	m := NewConcurrentMap[int, int](IntHasher)
+	for i := 0; i < b.N; i++ {
+		m.Put(i, i)
+		m.Get(i)
+	}
+}
@@ -0,0 +1,201 @@
+package concurrent
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+/* ---------------- Compiled key encoders -------------- */
+
+/*
+* A keyPlan encodes keys of one struct, array or named scalar type without
+* reflection. compileKeyPlan flattens the type once into a list of steps,
+* one for every scalar it contains, each with the offset of the scalar from
+* the start of the key and the way to encode it. appendKey then reads the
+* scalars straight from the memory of the key through unsafe pointers, so a
+* struct key costs about as much as hashing its fields one by one, and
+* neither reading nor encoding the key allocates.
+*
+* Plans are compiled by compileKeyPlan when engineFor creates the engine of
+* a key type, and cached per reflect.Type with that engine. A plan writes exactly the canonical encoding
+* described in encoding.go.
+ */
+
+type keyOp uint8
+
+const (
+	opBool keyOp = iota
+	opInt8
+	opInt16
+	opInt32
+	opInt64
+	opUint8
+	opUint16
+	opUint32
+	opUint64
+	opFloat32
+	opFloat64
+	opComplex64
+	opComplex128
+	opString
+	opHashable
+)
+
+type keyStep struct {
+	op     keyOp
+	nested bool //strings and Hashables inside arrays and structs are prefixed with their length
+	offset uintptr
+	//type word of an interface holding a Hashable or BytesHashable of this
+	//step, and whether it is pointer shaped, see hashableAt
+	hashType uintptr
+	direct   bool
+	//the interface type of a field declared as an interface, like Hashable,
+	//its type word is only known from the interface stored in the key
+	iface reflect.Type
+}
+
+type keyPlan struct {
+	steps []keyStep
+	//the interface holds the key itself instead of a pointer to it,
+	//only true for structs and arrays that wrap a single pointer. Such a
+	//key has at most one step, a Hashable at offset 0, as other pointers
+	//cannot be keys
+	direct bool
+}
+
+func compileKeyPlan(ki *keyInfo) *keyPlan {
+	plan := &keyPlan{direct: isDirectIface(ki.typ)}
+	plan.compile(ki, 0, false)
+	return plan
+}
+
+func (this *keyPlan) compile(ki *keyInfo, offset uintptr, nested bool) {
+	if ki.isHasher {
+		s := keyStep{op: opHashable, nested: nested, offset: offset}
+		if ki.typ.Kind() == reflect.Interface {
+			s.iface = ki.typ
+		} else {
+			var sample interface{} = reflect.Zero(ki.typ).Interface()
+			s.hashType, s.direct = (*emptyInterface)(unsafe.Pointer(&sample)).typ, isDirectIface(ki.typ)
+		}
+		this.steps = append(this.steps, s)
+		return
+	}
+	switch ki.kind {
+	case reflect.Array:
+		size := ki.typ.Elem().Size()
+		for i := 0; i < ki.size; i++ {
+			this.compile(ki.elementInfo, offset+uintptr(i)*size, true)
+		}
+	case reflect.Struct:
+		for _, fi := range ki.fields {
+			this.compile(fi, offset+ki.typ.Field(fi.index).Offset, true)
+		}
+	default:
+		this.steps = append(this.steps, keyStep{op: scalarOp(ki.typ), nested: nested, offset: offset})
+	}
+}
+
+//scalarOp returns the step for a scalar type, int, uint and uintptr by their width on this platform
+func scalarOp(t reflect.Type) keyOp {
+	switch t.Kind() {
+	case reflect.Bool:
+		return opBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return [...]keyOp{1: opInt8, 2: opInt16, 4: opInt32, 8: opInt64}[t.Size()]
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return [...]keyOp{1: opUint8, 2: opUint16, 4: opUint32, 8: opUint64}[t.Size()]
+	case reflect.Float32:
+		return opFloat32
+	case reflect.Float64:
+		return opFloat64
+	case reflect.Complex64:
+		return opComplex64
+	case reflect.Complex128:
+		return opComplex128
+	}
+	return opString
+}
+
+//isDirectIface reports whether an interface stores values of type t in its data word,
+//following the rule of the compiler: pointer shaped types and structs and arrays of one of them
+func isDirectIface(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Chan, reflect.Map, reflect.Func, reflect.UnsafePointer:
+		return true
+	case reflect.Array:
+		return t.Len() == 1 && isDirectIface(t.Elem())
+	case reflect.Struct:
+		return t.NumField() == 1 && isDirectIface(t.Field(0).Type)
+	}
+	return false
+}
+
+//hashableAt returns the Hashable or BytesHashable of step s, which is stored
+//at q or, for a direct plan, is the data word of the key itself. The
+//interface is built from the type word recorded by compile and points into
+//the key, so unlike reflect.NewAt it does not allocate. An interface field
+//is read as it is, which is nil if the field is nil
+func (this *keyPlan) hashableAt(s *keyStep, word, q unsafe.Pointer) interface{} {
+	if s.iface != nil {
+		return reflect.NewAt(s.iface, q).Elem().Interface()
+	}
+	var v interface{}
+	e := (*emptyInterface)(unsafe.Pointer(&v))
+	e.typ = s.hashType
+	switch {
+	case this.direct:
+		e.word = word
+	case s.direct:
+		e.word = *(*unsafe.Pointer)(q)
+	default:
+		e.word = q
+	}
+	return v
+}
+
+//appendKey appends the canonical encoding of a key to buf,
+//word is the data word of the interface holding the key
+func (this *keyPlan) appendKey(buf []byte, word unsafe.Pointer) []byte {
+	for i := range this.steps {
+		s := &this.steps[i]
+		q := unsafe.Add(word, s.offset)
+		switch s.op {
+		case opBool:
+			buf = appendBool(buf, *(*bool)(q))
+		case opInt8:
+			buf = appendUint64(buf, uint64(*(*int8)(q)))
+		case opInt16:
+			buf = appendUint64(buf, uint64(*(*int16)(q)))
+		case opInt32:
+			buf = appendUint64(buf, uint64(*(*int32)(q)))
+		case opInt64:
+			buf = appendUint64(buf, uint64(*(*int64)(q)))
+		case opUint8:
+			buf = appendUint64(buf, uint64(*(*uint8)(q)))
+		case opUint16:
+			buf = appendUint64(buf, uint64(*(*uint16)(q)))
+		case opUint32:
+			buf = appendUint64(buf, uint64(*(*uint32)(q)))
+		case opUint64:
+			buf = appendUint64(buf, *(*uint64)(q))
+		case opFloat32:
+			buf = appendUint64(buf, canonicalFloat64(float64(*(*float32)(q))))
+		case opFloat64:
+			buf = appendUint64(buf, canonicalFloat64(*(*float64)(q)))
+		case opComplex64:
+			buf = appendComplex128(buf, complex128(*(*complex64)(q)))
+		case opComplex128:
+			buf = appendComplex128(buf, *(*complex128)(q))
+		case opString:
+			str := *(*string)(q)
+			if s.nested {
+				buf = appendUint64(buf, uint64(len(str)))
+			}
+			buf = append(buf, str...)
+		case opHashable:
+			buf = appendHashable(buf, this.hashableAt(s, word, q), s.nested)
+		}
+	}
+	return buf
+}
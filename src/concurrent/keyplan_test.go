@@ -0,0 +1,107 @@
+package concurrent
+
+import (
+	"bytes"
+	"hashkey"
+	"reflect"
+	"testing"
+)
+
+type hashableRef struct{ id string }
+
+func (this *hashableRef) HashBytes() []byte {
+	return []byte(this.id)
+}
+
+func (this *hashableRef) Equals(v2 interface{}) bool {
+	r2, ok := v2.(*hashableRef)
+	return ok && this.id == r2.id
+}
+
+type tenantKey struct {
+	Tenant int32
+	Object int64
+}
+
+type nestedKey struct {
+	Name   string
+	hidden int
+	Pairs  [2]tenantKey
+	Flag   bool
+	Ref    *hashableRef
+}
+
+func TestKeyPlanNested(t *testing.T) {
+	ref := &hashableRef{"r"}
+	key := nestedKey{"n", 5, [2]tenantKey{{1, 2}, {3, -1}}, true, ref}
+	want := cat(le(1), []byte("n"),
+		le(1), le(2), le(3), le(0xFFFFFFFFFFFFFFFF),
+		[]byte{1},
+		le(1), []byte("r"))
+	if got := encodeKey(t, key); !bytes.Equal(got, want) {
+		t.Errorf("encoding of %+v is %v, want %v", key, got, want)
+	}
+
+	m := NewConcurrentMap()
+	m.Put(key, 1)
+	key2 := key
+	key2.Pairs[1].Object = 4
+	m.Put(key2, 2)
+	if v, _ := m.Get(nestedKey{"n", 5, [2]tenantKey{{1, 2}, {3, -1}}, true, ref}); v != 1 {
+		t.Errorf("Get %+v, return %v, want 1", key, v)
+	}
+	if v, _ := m.Get(key2); v != 2 {
+		t.Errorf("Get %+v, return %v, want 2", key2, v)
+	}
+}
+
+func TestKeyPlanDirectIface(t *testing.T) {
+	//a struct holding only a pointer is stored in the interface word itself
+	type wrapper struct{ R *hashableRef }
+	type array [1]wrapper
+	if !isDirectIface(reflect.TypeOf(wrapper{})) || !isDirectIface(reflect.TypeOf(array{})) || isDirectIface(reflect.TypeOf(tenantKey{})) {
+		t.Fatalf("isDirectIface does not follow the rule of the compiler")
+	}
+	for _, key := range []interface{}{wrapper{&hashableRef{"abc"}}, array{{&hashableRef{"abc"}}}} {
+		if got, want := encodeKey(t, key), cat(le(3), []byte("abc")); !bytes.Equal(got, want) {
+			t.Errorf("encoding of %T is %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestKeyPlanInterfaceField(t *testing.T) {
+	//the type word of a field declared as an interface comes from the key
+	type ifaceKey struct {
+		A int
+		H hashkey.Key
+		B [2]Hashable
+	}
+	key := ifaceKey{1, hashkey.String("s"), [2]Hashable{codedKey{7}, hashkey.Int(3)}}
+	if got, want := encodeKey(t, key), cat(le(1), le(8), le(hashkey.String("s").HashCode()), le(8), le(7), le(8), le(hashkey.Int(3).HashCode())); !bytes.Equal(got, want) {
+		t.Errorf("encoding of %+v is %v, want %v", key, got, want)
+	}
+
+	m := NewConcurrentMap()
+	m.Put(key, 1)
+	m.Put(ifaceKey{A: 1}, 2)
+	if v, _ := m.Get(ifaceKey{1, hashkey.String("s"), [2]Hashable{codedKey{7}, hashkey.Int(3)}}); v != 1 {
+		t.Errorf("Get %+v, return %v, want 1", key, v)
+	}
+	if v, _ := m.Get(ifaceKey{A: 1}); v != 2 {
+		t.Errorf("Get key with nil fields, return %v, want 2", v)
+	}
+}
+
+func BenchmarkHashIntKey(b *testing.B) {
+	m := NewConcurrentMap()
+	for i := 0; i < b.N; i++ {
+		hashKey(i, m)
+	}
+}
+
+func BenchmarkHashStructKey(b *testing.B) {
+	m := NewConcurrentMap()
+	for i := 0; i < b.N; i++ {
+		hashKey(tenantKey{int32(i), int64(i)}, m)
+	}
+}
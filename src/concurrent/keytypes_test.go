@@ -0,0 +1,117 @@
+package concurrent
+
+import (
+	"fmt"
+	"hashkey"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type pointKey struct{ X, Y int }
+type sizeKey struct{ W, H int }
+
+func TestMixedKeyTypes(t *testing.T) {
+	m := NewConcurrentMap()
+	keys := []interface{}{
+		1, int64(1), uint(1), 1.0, "1", true, 'a', [2]int{1, 1},
+		pointKey{1, 1}, sizeKey{1, 1}, namedInt(1), collidingKey{1, 10},
+	}
+	for i, k := range keys {
+		m.Put(k, i)
+	}
+	if int(m.Size()) != len(keys) {
+		t.Errorf("Size %v, want %v, keys of different types must not be equal", m.Size(), len(keys))
+	}
+	for i, k := range keys {
+		if v, ok := m.Get(k); !ok || v != i {
+			t.Errorf("Get %#v, return %v, %v, want %v, true", k, v, ok, i)
+		}
+		if found, err := m.ContainsKey(k); !found || err != nil {
+			t.Errorf("ContainsKey %#v, return %v, %v, want true, nil", k, found, err)
+		}
+	}
+	if found, _ := m.ContainsKey(pointKey{2, 2}); found {
+		t.Errorf("ContainsKey of absent key, return true")
+	}
+
+	if _, err := m.PutIfAbsent([]int{1}, 1); err != NonSupportKey {
+		t.Errorf("PutIfAbsent slice key, return %v, want NonSupportKey", err)
+	}
+	if _, err := m.PutIfAbsent(struct{ S []int }{}, 1); err != NonSupportKey {
+		t.Errorf("PutIfAbsent struct key with slice field, return %v, want NonSupportKey", err)
+	}
+	if v, ok := m.Get(pointKey{1, 1}); !ok || v != 8 {
+		t.Errorf("Get after unsupported key, return %v, %v, want 8, true", v, ok)
+	}
+}
+
+func TestSharedKeys(t *testing.T) {
+	type tenantName struct {
+		Tenant int
+		Name   hashkey.String
+	}
+	m := NewConcurrentMap()
+	keys := []interface{}{
+		hashkey.Int(1), hashkey.Int64(1), hashkey.String("1"), hashkey.StructOf(pointKey{1, 1}),
+		tenantName{1, "1"}, 1, "1",
+	}
+	for i, k := range keys {
+		m.Put(k, i)
+	}
+	if int(m.Size()) != len(keys) {
+		t.Errorf("Size %v, want %v, keys of different types must not be equal", m.Size(), len(keys))
+	}
+	for i, k := range keys {
+		if v, ok := m.Get(k); !ok || v != i {
+			t.Errorf("Get %#v, return %v, %v, want %v, true", k, v, ok, i)
+		}
+	}
+	if v, ok := m.Get(hashkey.StructOf(pointKey{1, 1})); !ok || v != 3 {
+		t.Errorf("Get of an equal Struct key, return %v, %v, want 3, true", v, ok)
+	}
+
+	//a hashkey.Key is encoded from its HashCode
+	if got, want := encodeKey(t, hashkey.String("1")), le(hashkey.String("1").HashCode()); string(got) != string(want) {
+		t.Errorf("encoding of hashkey.String is %v, want %v", got, want)
+	}
+	if _, err := New(WithKeyType(reflect.TypeOf(tenantName{}))); err != nil {
+		t.Errorf("WithKeyType of a struct with a hashkey.Key field, return %v", err)
+	}
+}
+
+func TestMixedKeyTypesConcurrently(t *testing.T) {
+	m := NewConcurrentMap()
+	type a struct{ N int }
+	type b struct{ N int }
+	type c [1]int
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				var k interface{}
+				switch (g + i) % 4 {
+				case 0:
+					k = a{i}
+				case 1:
+					k = b{i}
+				case 2:
+					k = c{i}
+				case 3:
+					k = fmt.Sprint(i)
+				}
+				m.Put(k, i)
+				if v, ok := m.Get(k); !ok || v != i {
+					t.Errorf("Get %#v, return %v, %v, want %v, true", k, v, ok, i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if m.Size() != 2000 {
+		t.Errorf("Size %v, want 2000", m.Size())
+	}
+}
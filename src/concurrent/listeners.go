@@ -0,0 +1,372 @@
+package concurrent
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+/* ---------------- Change notifications -------------- */
+
+/*
+* Subscribe and SubscribeChan register listeners that receive an Event for
+* every change of the map. Events are delivered by the writing goroutine
+* while it holds the segment lock, right after the change is visible to
+* readers, so the events of a key, and of all keys of a segment, arrive in
+* the order of the changes. Events of different segments are not ordered.
+*
+* A callback therefore must not access the map, the segment lock is not
+* reentrant, and should return quickly, it delays the writers of the
+* segment. Channel subscribers decouple the consumer from the writers,
+* the OverflowPolicy decides what a writer does when the channel is full.
+*
+* Clear locks all segments while listeners are registered, so a single
+* EventClear marks the point in the stream before which every mapping was
+* removed.
+ */
+
+//EventKind tells what kind of change an Event reports.
+type EventKind int
+
+const (
+	EventInsert EventKind = iota //a key was mapped, OldValue is nil
+	EventUpdate                  //the value of a key was replaced
+	EventRemove                  //a key was removed, NewValue is nil
+	EventEvict                   //a key was removed by a bounded map to make room, see WithMaxEntries
+	EventExpire                  //an expired key was removed, see PutWithTTL
+	EventClear                   //all keys were removed by Clear, Key and values are nil
+)
+
+var eventKindNames = [...]string{"Insert", "Update", "Remove", "Evict", "Expire", "Clear"}
+
+func (this EventKind) String() string {
+	if this >= 0 && int(this) < len(eventKindNames) {
+		return eventKindNames[this]
+	}
+	return "EventKind(?)"
+}
+
+//removes returns true if the kind removes the key
+func (this EventKind) removes() bool {
+	return this == EventRemove || this == EventEvict || this == EventExpire
+}
+
+/**
+* Event is a change of the map.
+*/
+type Event struct {
+	Kind     EventKind
+	Key      interface{}
+	OldValue interface{}
+	NewValue interface{}
+
+	hash      uint32 //hash code of Key, used to coalesce events
+	cancelled bool   //a queued insert that was cancelled by a remove
+}
+
+/**
+* OverflowPolicy decides what happens to the events of a channel
+* subscriber whose channel is full.
+*/
+type OverflowPolicy int
+
+const (
+	/**
+	 * OverflowDrop drops events that do not fit the channel.
+	 */
+	OverflowDrop OverflowPolicy = iota
+	/**
+	 * OverflowBlock blocks the writer until the event fits the channel,
+	 * and with it all writers of the segment. The consumer must not
+	 * write to the map while it is behind.
+	 */
+	OverflowBlock
+	/**
+	 * OverflowCoalesce queues the events that do not fit and merges the
+	 * queued events of a key into one, from the first old value to the
+	 * last new value, an insert followed by a remove cancels out. Writers
+	 * never block, the queue holds at most one event per key.
+	 */
+	OverflowCoalesce
+)
+
+type subscriber struct {
+	f func(ev Event) //callback, nil for a channel subscriber
+
+	ch       chan Event
+	overflow OverflowPolicy
+	done     chan struct{} //closed by cancel
+	mu       sync.RWMutex  //senders hold it to keep ch open
+	closed   bool
+
+	//queue of OverflowCoalesce, guarded by mu
+	pending []*Event
+	byHash  map[uint32][]*Event //the events of pending that are not cancelled by hash code
+	sending bool                //the forwarder is sending an event taken from pending
+	signal  chan struct{}
+	exited  chan struct{}
+}
+
+/**
+* Subscribe registers f to be called with every Event, see above. f is
+* called while the segment lock is held and must not access the map.
+*
+* @return cancel, which unregisters f. Events of writes in progress may
+*         still be delivered to f until cancel returns.
+*/
+func (this *ConcurrentMap) Subscribe(f func(ev Event)) (cancel func()) {
+	s := &subscriber{f: f}
+	this.addSubscriber(s)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			this.removeSubscriber(s)
+			//a writer may still hold s, wait for the writers of all segments
+			this.unlockAllSegments(this.lockAllSegments())
+		})
+	}
+}
+
+/**
+* SubscribeChan returns a channel that receives every Event, see above.
+* buffer is the capacity of the channel, overflow decides what happens to
+* events that do not fit.
+*
+* @return the channel and cancel, which unregisters the channel and closes
+*         it, so a consumer ranging over it stops
+*/
+func (this *ConcurrentMap) SubscribeChan(buffer int, overflow OverflowPolicy) (events <-chan Event, cancel func()) {
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &subscriber{ch: make(chan Event, buffer), overflow: overflow, done: make(chan struct{})}
+	if overflow == OverflowCoalesce {
+		s.byHash = make(map[uint32][]*Event)
+		s.signal = make(chan struct{}, 1)
+		s.exited = make(chan struct{})
+		go s.forward()
+	}
+	this.addSubscriber(s)
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			this.removeSubscriber(s)
+			close(s.done)
+			if s.exited != nil {
+				<-s.exited
+			}
+			s.mu.Lock()
+			s.closed = true
+			close(s.ch)
+			s.mu.Unlock()
+		})
+	}
+}
+
+//subscriberList returns the registered subscribers, the slice is never modified
+func (this *ConcurrentMap) subscriberList() []*subscriber {
+	if p := atomic.LoadPointer(&this.subscribers); p != nil {
+		return *(*[]*subscriber)(p)
+	}
+	return nil
+}
+
+func (this *ConcurrentMap) addSubscriber(s *subscriber) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	old := this.subscriberList()
+	subs := make([]*subscriber, len(old), len(old)+1)
+	copy(subs, old)
+	subs = append(subs, s)
+	atomic.StorePointer(&this.subscribers, unsafe.Pointer(&subs))
+}
+
+func (this *ConcurrentMap) removeSubscriber(s *subscriber) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	old := this.subscriberList()
+	subs := make([]*subscriber, 0, len(old))
+	for _, o := range old {
+		if o != s {
+			subs = append(subs, o)
+		}
+	}
+	atomic.StorePointer(&this.subscribers, unsafe.Pointer(&subs))
+}
+
+//subscribersLock serializes the changes of the subscriber lists of all maps, they are rare
+var subscribersLock sync.Mutex
+
+//hasSubscribers returns true if any listener is registered
+func (this *ConcurrentMap) hasSubscribers() bool {
+	return len(this.subscriberList()) > 0
+}
+
+/**
+* Delivers an event to all subscribers.
+* Call only while holding the lock of the segment of the key.
+*/
+func (this *ConcurrentMap) emit(kind EventKind, key interface{}, hash uint32, oldValue, newValue interface{}) {
+	subs := this.subscriberList()
+	if len(subs) == 0 {
+		return
+	}
+	ev := Event{Kind: kind, Key: key, OldValue: oldValue, NewValue: newValue, hash: hash}
+	for _, s := range subs {
+		s.deliver(ev)
+	}
+}
+
+func (this *subscriber) deliver(ev Event) {
+	if this.f != nil {
+		this.f(ev)
+		return
+	}
+	if this.overflow == OverflowCoalesce {
+		this.enqueue(ev)
+		return
+	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if this.closed {
+		return
+	}
+	if this.overflow == OverflowBlock {
+		select {
+		case this.ch <- ev:
+		case <-this.done:
+		}
+		return
+	}
+	select {
+	case this.ch <- ev:
+	default:
+	}
+}
+
+/**
+* Sends ev directly if nothing is queued and the channel has room,
+* otherwise queues it, merged with a queued event of the same key.
+*/
+func (this *subscriber) enqueue(ev Event) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return
+	}
+	if !this.sending && len(this.pending) == 0 {
+		select {
+		case this.ch <- ev:
+			return
+		default:
+		}
+	}
+
+	if ev.Kind == EventClear {
+		//a clear makes all queued events of keys obsolete
+		this.pending = nil
+		for h := range this.byHash {
+			delete(this.byHash, h)
+		}
+		this.push(ev)
+		return
+	}
+	for _, p := range this.byHash[ev.hash] {
+		if equals(p.Key, ev.Key) {
+			if p.OldValue == nil && ev.Kind.removes() {
+				//inserted and removed while queued
+				p.cancelled = true
+				this.unindex(p)
+				return
+			}
+			p.NewValue = ev.NewValue
+			switch {
+			case ev.Kind.removes():
+				p.Kind = ev.Kind
+			case p.OldValue == nil:
+				p.Kind = EventInsert
+			default:
+				p.Kind = EventUpdate
+			}
+			return
+		}
+	}
+	this.push(ev)
+}
+
+func (this *subscriber) push(ev Event) {
+	if ev.Kind != EventClear {
+		this.byHash[ev.hash] = append(this.byHash[ev.hash], &ev)
+	}
+	this.pending = append(this.pending, &ev)
+	select {
+	case this.signal <- struct{}{}:
+	default:
+	}
+}
+
+/**
+* The goroutine of an OverflowCoalesce subscriber that sends the queued
+* events in order.
+*/
+func (this *subscriber) forward() {
+	defer close(this.exited)
+	for {
+		select {
+		case <-this.signal:
+		case <-this.done:
+			return
+		}
+		for {
+			ev := this.pop()
+			if ev == nil {
+				break
+			}
+			select {
+			case this.ch <- *ev:
+			case <-this.done:
+				return
+			}
+			this.mu.Lock()
+			this.sending = false
+			this.mu.Unlock()
+		}
+	}
+}
+
+//pop takes the first queued event and sets sending, nil if the queue is empty
+func (this *subscriber) pop() *Event {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for len(this.pending) > 0 {
+		ev := this.pending[0]
+		this.pending[0] = nil
+		this.pending = this.pending[1:]
+		if ev.cancelled {
+			continue
+		}
+		if ev.Kind != EventClear {
+			this.unindex(ev)
+		}
+		this.sending = true
+		return ev
+	}
+	this.pending = nil
+	return nil
+}
+
+//unindex removes a queued event from byHash
+func (this *subscriber) unindex(ev *Event) {
+	evs := this.byHash[ev.hash]
+	for i, p := range evs {
+		if p == ev {
+			evs = append(evs[:i], evs[i+1:]...)
+			break
+		}
+	}
+	if len(evs) == 0 {
+		delete(this.byHash, ev.hash)
+	} else {
+		this.byHash[ev.hash] = evs
+	}
+}
@@ -0,0 +1,203 @@
+package concurrent
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func eventString(ev Event) string {
+	return fmt.Sprintf("%v %v %v->%v", ev.Kind, ev.Key, ev.OldValue, ev.NewValue)
+}
+
+func TestSubscribe(t *testing.T) {
+	m := NewConcurrentMap()
+	var events []string
+	cancel := m.Subscribe(func(ev Event) {
+		events = append(events, eventString(ev))
+	})
+	m.Put(1, "a")
+	m.Put(1, "b")
+	m.PutIfAbsent(1, "c")
+	m.Replace(1, "d")
+	m.CompareAndReplace(1, "d", "e")
+	m.Compute(2, func(oldVal interface{}) interface{} { return "x" })
+	m.Compute(2, func(oldVal interface{}) interface{} { return nil })
+	m.Remove(1)
+	m.Remove(1)
+	m.Put(3, "y")
+	m.Clear()
+	cancel()
+	m.Put(4, "z")
+	cancel()
+
+	want := []string{
+		"Insert 1 <nil>->a", "Update 1 a->b", "Update 1 b->d", "Update 1 d->e",
+		"Insert 2 <nil>->x", "Remove 2 x-><nil>", "Remove 1 e-><nil>",
+		"Insert 3 <nil>->y", "Clear <nil> <nil>-><nil>",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events\n%v\nwant\n%v", events, want)
+	}
+}
+
+func TestEvictAndExpireEvents(t *testing.T) {
+	clock := &fakeClock{now: 1}
+	m, _ := New(withClock(clock), WithMaxEntries(2), WithConcurrencyLevel(1))
+	var events []string
+	m.Subscribe(func(ev Event) {
+		events = append(events, eventString(ev))
+	})
+	m.PutWithTTL(1, "a", time.Second)
+	m.Put(2, "b")
+	m.Put(3, "c")
+	m.PutWithTTL(4, "d", time.Second)
+	clock.advance(time.Minute)
+	m.RemoveExpired()
+
+	want := []string{
+		"Insert 1 <nil>->a", "Insert 2 <nil>->b", "Insert 3 <nil>->c", "Evict 1 a-><nil>",
+		"Insert 4 <nil>->d", "Evict 2 b-><nil>", "Expire 4 d-><nil>",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events\n%v\nwant\n%v", events, want)
+	}
+}
+
+func TestSubscribeChanDrop(t *testing.T) {
+	m := NewConcurrentMap()
+	events, cancel := m.SubscribeChan(2, OverflowDrop)
+	for i := 0; i < 5; i++ {
+		m.Put(i, i)
+	}
+	cancel()
+	n := 0
+	for range events {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("received %v events, want 2", n)
+	}
+}
+
+func TestSubscribeChanBlock(t *testing.T) {
+	m := NewConcurrentMap()
+	events, cancel := m.SubscribeChan(0, OverflowBlock)
+	n := 1000
+	done := make(chan bool)
+	go func() {
+		i := 0
+		for ev := range events {
+			if ev.NewValue != i {
+				t.Errorf("event %v has value %v", i, ev.NewValue)
+			}
+			i++
+		}
+		done <- i == n
+	}()
+	for i := 0; i < n; i++ {
+		m.Put("k", i)
+	}
+	cancel()
+	if !<-done {
+		t.Errorf("events were lost")
+	}
+}
+
+//applyEvents applies events to model until the event of key until
+func applyEvents(t *testing.T, events <-chan Event, model map[interface{}]interface{}, until interface{}) (n int) {
+	for ev := range events {
+		n++
+		switch ev.Kind {
+		case EventInsert, EventUpdate:
+			if old, ok := model[ev.Key]; ok != (ev.Kind == EventUpdate) || ok && old != ev.OldValue {
+				t.Errorf("event %v does not follow %v", eventString(ev), old)
+			}
+			model[ev.Key] = ev.NewValue
+		case EventRemove:
+			delete(model, ev.Key)
+		case EventClear:
+			for k := range model {
+				delete(model, k)
+			}
+		}
+		if ev.Key == until {
+			return
+		}
+	}
+	t.Errorf("channel closed before the event of %v", until)
+	return
+}
+
+func TestSubscribeChanCoalesce(t *testing.T) {
+	m := NewConcurrentMap()
+	events, cancel := m.SubscribeChan(1, OverflowCoalesce)
+	m.Put(1, "a")
+	m.Put(2, "b")
+	m.Put(2, "c")
+	m.Put(3, "x")
+	m.Remove(3)
+	m.Put(1, "z")
+	m.Remove(2)
+	m.Put("end", 0)
+
+	//how much is merged depends on when the forwarder takes the events
+	model := map[interface{}]interface{}{}
+	if n := applyEvents(t, events, model, "end"); n > 6 {
+		t.Errorf("received %v events, want at most 6", n)
+	}
+	if want := map[interface{}]interface{}{1: "z", "end": 0}; !reflect.DeepEqual(model, want) {
+		t.Errorf("events give %v, want %v", model, want)
+	}
+
+	m.Put(4, "d")
+	m.Put(5, "e")
+	m.Clear()
+	m.Put("end2", 0)
+	applyEvents(t, events, model, "end2")
+	if want := map[interface{}]interface{}{"end2": 0}; !reflect.DeepEqual(model, want) {
+		t.Errorf("events give %v after Clear, want %v", model, want)
+	}
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("channel is open after cancel")
+	}
+}
+
+func TestCoalescedIndex(t *testing.T) {
+	m := NewConcurrentMap()
+	events, cancel := m.SubscribeChan(4, OverflowCoalesce)
+	defer cancel()
+
+	index := make(map[interface{}]interface{})
+	synced := make(chan bool)
+	go func() {
+		applyEvents(t, events, index, "done")
+		synced <- true
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				k := (i * 7) % 300
+				if i%3 == 0 {
+					m.Remove(k)
+				} else {
+					m.Put(k, g*10000+i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	m.Put("done", true)
+	<-synced
+
+	if !reflect.DeepEqual(index, m.Snapshot().ToMap()) {
+		t.Errorf("index with %v keys differs from the map with %v keys", len(index), m.Size())
+	}
+}
@@ -0,0 +1,139 @@
+package concurrent
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/* ---------------- Segment locks -------------- */
+
+/**
+* SegmentLocker is the lock of a segment. Readers never take it, so it is
+* only contended by writers of the same segment.
+*/
+type SegmentLocker interface {
+	sync.Locker
+	TryLock() bool
+}
+
+/**
+* LockStrategy selects the SegmentLocker of the segments, see
+* WithLockStrategy. With WithLockStats, Stats reports the time spent
+* waiting for and holding the locks, to compare the strategies under a
+* workload.
+*/
+type LockStrategy int
+
+const (
+	/**
+	 * sync.Mutex, which spins shortly before it parks and hands the lock
+	 * to a waiter that waited more than 1ms.
+	 */
+	LockMutex LockStrategy = iota
+
+	/**
+	 * Tries to take a sync.Mutex SPIN_TRIES times, yielding the processor
+	 * between tries, before it parks. Suits short critical sections.
+	 */
+	LockSpin
+
+	/**
+	 * A ticket lock that grants the lock in the order of the Lock calls,
+	 * waiters spin and yield the processor instead of parking.
+	 */
+	LockTicket
+
+	/**
+	 * Like LockSpin, but the number of tries grows by one whenever
+	 * spinning got the lock and is halved whenever the lock had to park,
+	 * so a segment whose lock is held long almost stops spinning.
+	 */
+	LockAdaptive
+)
+
+var lockStrategyNames = [...]string{"Mutex", "Spin", "Ticket", "Adaptive"}
+
+func (this LockStrategy) String() string {
+	if this >= 0 && int(this) < len(lockStrategyNames) {
+		return lockStrategyNames[this]
+	}
+	return "LockStrategy(?)"
+}
+
+/**
+* The maximum number of tries of LockSpin and LockAdaptive before parking.
+*/
+const SPIN_TRIES = 64
+
+func (this LockStrategy) newLocker() SegmentLocker {
+	switch this {
+	case LockSpin:
+		return new(spinLock)
+	case LockTicket:
+		return new(ticketLock)
+	case LockAdaptive:
+		return &adaptiveLock{spins: SPIN_TRIES / 2}
+	}
+	return new(sync.Mutex)
+}
+
+type spinLock struct {
+	sync.Mutex
+}
+
+func (this *spinLock) Lock() {
+	for i := 0; i < SPIN_TRIES; i++ {
+		if this.Mutex.TryLock() {
+			return
+		}
+		runtime.Gosched()
+	}
+	this.Mutex.Lock()
+}
+
+type ticketLock struct {
+	next    uint32 //the ticket of the next Lock call
+	serving uint32 //the ticket that holds the lock
+}
+
+func (this *ticketLock) Lock() {
+	ticket := atomic.AddUint32(&this.next, 1) - 1
+	for atomic.LoadUint32(&this.serving) != ticket {
+		runtime.Gosched()
+	}
+}
+
+func (this *ticketLock) TryLock() bool {
+	serving := atomic.LoadUint32(&this.serving)
+	return atomic.CompareAndSwapUint32(&this.next, serving, serving+1)
+}
+
+func (this *ticketLock) Unlock() {
+	atomic.AddUint32(&this.serving, 1)
+}
+
+type adaptiveLock struct {
+	sync.Mutex
+	spins int32 //the current number of tries, read and written without the lock
+}
+
+func (this *adaptiveLock) Lock() {
+	if this.Mutex.TryLock() {
+		return
+	}
+	spins := atomic.LoadInt32(&this.spins)
+	for i := int32(0); i < spins; i++ {
+		runtime.Gosched()
+		if this.Mutex.TryLock() {
+			//spinning paid, allow one more try
+			if spins < SPIN_TRIES {
+				atomic.StoreInt32(&this.spins, spins+1)
+			}
+			return
+		}
+	}
+	this.Mutex.Lock()
+	//spinning did not pay, halve the tries
+	atomic.StoreInt32(&this.spins, spins/2+1)
+}
@@ -0,0 +1,98 @@
+package concurrent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+var lockStrategies = []LockStrategy{LockMutex, LockSpin, LockTicket, LockAdaptive}
+
+func TestLockers(t *testing.T) {
+	for _, strategy := range lockStrategies {
+		l := strategy.newLocker()
+		if !l.TryLock() || l.TryLock() {
+			t.Errorf("%v: TryLock of a free lock failed or of a held lock succeeded", strategy)
+		}
+		l.Unlock()
+
+		counter := 0
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					l.Lock()
+					counter++
+					l.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if counter != 8000 {
+			t.Errorf("%v: counter %v, want 8000", strategy, counter)
+		}
+	}
+}
+
+func TestLockStrategy(t *testing.T) {
+	for _, strategy := range lockStrategies {
+		m, _ := New(WithLockStrategy(strategy), WithLockStats(), WithConcurrencyLevel(2))
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					m.Put(g*2000+i, i)
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		stats := m.Stats()
+		total := stats.Total()
+		if stats.LockStrategy != strategy.String() || m.Size() != 8000 {
+			t.Errorf("%v: Stats report %v, Size %v", strategy, stats.LockStrategy, m.Size())
+		}
+		if total.LockHoldTime <= 0 || total.LockContentions > 0 && total.LockWaitTime <= 0 {
+			t.Errorf("%v: hold time %v, wait time %v of %v contentions", strategy, total.LockHoldTime, total.LockWaitTime, total.LockContentions)
+		}
+	}
+
+	m, _ := New(WithConcurrencyLevel(1))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	if total := m.Stats().Total(); total.LockAcquisitions == 0 || total.LockHoldTime != 0 {
+		t.Errorf("untimed locks: %v acquisitions, hold time %v", total.LockAcquisitions, total.LockHoldTime)
+	}
+
+	if _, err := New(WithLockStrategy(LockStrategy(9))); !errors.Is(err, IllegalArgError) {
+		t.Errorf("unknown lock strategy, return %v", err)
+	}
+}
+
+func BenchmarkLockStrategyPut(b *testing.B) {
+	for _, strategy := range lockStrategies {
+		b.Run(fmt.Sprint(strategy), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				cm, _ := New(WithLockStrategy(strategy))
+				wg := new(sync.WaitGroup)
+				wg.Add(listN)
+				for i := 0; i < listN; i++ {
+					k := i
+					go func() {
+						for _, j := range list[k] {
+							cm.Put(j, j)
+						}
+						wg.Done()
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
@@ -201,7 +201,7 @@ func TestEmptyInterface(t *testing.T) {
 	}
 }
 
-//user implements concurrent.Hasher interface
+//user implements the deprecated concurrent.BytesHashable interface
 type user struct {
 	id   string
 	Name string
@@ -0,0 +1,347 @@
+package concurrent
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+/**
+ * Option configures a ConcurrentMap created by New.
+ * An Option returns an error if its argument is invalid.
+ */
+type Option func(o *mapOptions) error
+
+type mapOptions struct {
+	initialCapacity  int
+	loadFactor       float32
+	concurrencyLevel int
+	seed             uint64
+	seeded           bool
+	hashAlg          HashAlgorithm
+	keyType          reflect.Type
+	valueType        reflect.Type
+	shrinkDivisor    int64
+	parallelism      int
+	defaultTTL       time.Duration
+	janitorInterval  time.Duration
+	clock            func() int64
+	maxWeight        int64
+	weigher          func(key, value interface{}) int64
+	newPolicy        func() EvictionPolicy
+	onEvict          func(key, value interface{})
+	lockStrategy     LockStrategy
+	lockStats        bool
+	maxSegments      int
+}
+
+func defaultOptions() *mapOptions {
+	return &mapOptions{
+		initialCapacity:  DEFAULT_INITIAL_CAPACITY,
+		loadFactor:       DEFAULT_LOAD_FACTOR,
+		concurrencyLevel: DEFAULT_CONCURRENCY_LEVEL,
+		hashAlg:          FNV1a,
+		shrinkDivisor:    SHRINK_DIVISOR,
+		newPolicy:        NewLRUPolicy,
+	}
+}
+
+func illegalArg(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", IllegalArgError, fmt.Sprintf(format, a...))
+}
+
+/**
+ * WithInitialCapacity sets the initial capacity. The implementation
+ * performs internal sizing to accommodate this many elements.
+ * Default is DEFAULT_INITIAL_CAPACITY, must not be negative.
+ */
+func WithInitialCapacity(initialCapacity int) Option {
+	return func(o *mapOptions) error {
+		if initialCapacity < 0 {
+			return illegalArg("initial capacity %v is negative", initialCapacity)
+		}
+		o.initialCapacity = initialCapacity
+		return nil
+	}
+}
+
+/**
+ * WithLoadFactor sets the load factor threshold, used to control resizing.
+ * Default is DEFAULT_LOAD_FACTOR, must be positive and at most
+ * MAX_LOAD_FACTOR.
+ */
+func WithLoadFactor(loadFactor float32) Option {
+	return func(o *mapOptions) error {
+		if !validLoadFactor(loadFactor) {
+			return illegalArg("load factor %v is not in (0, %v]", loadFactor, MAX_LOAD_FACTOR)
+		}
+		o.loadFactor = loadFactor
+		return nil
+	}
+}
+
+//validLoadFactor returns false for NaN, infinite and out of range load factors
+func validLoadFactor(loadFactor float32) bool {
+	return loadFactor > 0 && loadFactor <= MAX_LOAD_FACTOR
+}
+
+/**
+ * WithConcurrencyLevel sets the estimated number of concurrently
+ * updating goroutines, the map is split into that many segments
+ * rounded up to a power of two, at most MAX_SEGMENTS.
+ * Default is DEFAULT_CONCURRENCY_LEVEL, must be positive.
+ */
+func WithConcurrencyLevel(concurrencyLevel int) Option {
+	return func(o *mapOptions) error {
+		if concurrencyLevel <= 0 {
+			return illegalArg("concurrency level %v is not positive", concurrencyLevel)
+		}
+		o.concurrencyLevel = concurrencyLevel
+		return nil
+	}
+}
+
+/**
+ * WithHashAlgorithm selects the function that hashes keys.
+ * Default is FNV1a.
+ */
+func WithHashAlgorithm(alg HashAlgorithm) Option {
+	return func(o *mapOptions) error {
+		if alg != FNV1a && alg != SipHash {
+			return illegalArg("unknown hash algorithm %v", alg)
+		}
+		o.hashAlg = alg
+		return nil
+	}
+}
+
+/**
+ * WithSeed sets the seed of the hash function instead of drawing a
+ * random one, see NewConcurrentMapWithSeed.
+ */
+func WithSeed(seed uint64) Option {
+	return func(o *mapOptions) error {
+		o.seed, o.seeded = seed, true
+		return nil
+	}
+}
+
+/**
+ * WithKeyType declares the type of the keys up front. New reports an
+ * error if keys of this type cannot be hashed, instead of Put failing
+ * on the first key. UnmarshalJSON decodes keys into this type.
+ */
+func WithKeyType(t reflect.Type) Option {
+	return func(o *mapOptions) error {
+		if t == nil {
+			return illegalArg("key type is nil")
+		}
+		o.keyType = t
+		return nil
+	}
+}
+
+/**
+ * WithValueType declares the type of the values. It is only used by
+ * UnmarshalJSON, which decodes values into this type instead of the
+ * types encoding/json picks for an interface{}.
+ */
+func WithValueType(t reflect.Type) Option {
+	return func(o *mapOptions) error {
+		if t == nil {
+			return illegalArg("value type is nil")
+		}
+		o.valueType = t
+		return nil
+	}
+}
+
+/**
+ * WithShrinkDivisor sets the divisor of the shrink threshold, see
+ * SHRINK_DIVISOR. 0 disables automatic shrinking, Compact still works.
+ */
+func WithShrinkDivisor(divisor int) Option {
+	return func(o *mapOptions) error {
+		if divisor < 0 {
+			return illegalArg("shrink divisor %v is negative", divisor)
+		}
+		o.shrinkDivisor = int64(divisor)
+		return nil
+	}
+}
+
+/**
+ * WithParallelism bounds the number of goroutines used by the bulk
+ * operations ForEach, Reduce and Search. Default is 0, which means
+ * GOMAXPROCS at the time of the call.
+ */
+func WithParallelism(parallelism int) Option {
+	return func(o *mapOptions) error {
+		if parallelism < 0 {
+			return illegalArg("parallelism %v is negative", parallelism)
+		}
+		o.parallelism = parallelism
+		return nil
+	}
+}
+
+/**
+ * WithDefaultTTL sets the time to live of the values written by every
+ * method except PutWithTTL, see PutWithTTL. Default is 0, which means
+ * values never expire. Must not be negative.
+ */
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(o *mapOptions) error {
+		if ttl < 0 {
+			return illegalArg("default TTL %v is negative", ttl)
+		}
+		o.defaultTTL = ttl
+		return nil
+	}
+}
+
+/**
+ * WithJanitor starts a goroutine that calls RemoveExpired every interval,
+ * until Close is called. Without it expired entries are only removed by
+ * writes to their keys and explicit calls to RemoveExpired.
+ * Must be positive.
+ */
+func WithJanitor(interval time.Duration) Option {
+	return func(o *mapOptions) error {
+		if interval <= 0 {
+			return illegalArg("janitor interval %v is not positive", interval)
+		}
+		o.janitorInterval = interval
+		return nil
+	}
+}
+
+/**
+ * WithMaxEntries bounds the map to maxEntries entries, a write that
+ * exceeds the bound evicts entries chosen by the eviction policy, see
+ * WithEvictionPolicy. Must be positive.
+ */
+func WithMaxEntries(maxEntries int64) Option {
+	return func(o *mapOptions) error {
+		if maxEntries <= 0 {
+			return illegalArg("max entries %v is not positive", maxEntries)
+		}
+		o.maxWeight, o.weigher = maxEntries, nil
+		return nil
+	}
+}
+
+/**
+ * WithMaxWeight bounds the total weight of the entries, where weigher
+ * returns the weight of a mapping, for example the size of the value in
+ * bytes. weigher is called under the segment lock when a value is written
+ * and must not access the map, a negative result is counted as 0.
+ * maxWeight must be positive.
+ */
+func WithMaxWeight(maxWeight int64, weigher func(key, value interface{}) int64) Option {
+	return func(o *mapOptions) error {
+		if maxWeight <= 0 {
+			return illegalArg("max weight %v is not positive", maxWeight)
+		}
+		if weigher == nil {
+			return illegalArg("weigher is nil")
+		}
+		o.maxWeight, o.weigher = maxWeight, weigher
+		return nil
+	}
+}
+
+/**
+ * WithEvictionPolicy sets the factory of the policies that choose the
+ * entries a bounded map evicts, it is called once for every segment.
+ * Default is NewLRUPolicy, NewClockPolicy is the other policy of this
+ * package.
+ */
+func WithEvictionPolicy(newPolicy func() EvictionPolicy) Option {
+	return func(o *mapOptions) error {
+		if newPolicy == nil {
+			return illegalArg("eviction policy is nil")
+		}
+		o.newPolicy = newPolicy
+		return nil
+	}
+}
+
+/**
+ * WithEvictionListener sets a function that is called with every mapping
+ * a bounded map evicts. It is called by the goroutine whose write caused
+ * the eviction, after the segment lock is released, so it may use the map.
+ */
+func WithEvictionListener(onEvict func(key, value interface{})) Option {
+	return func(o *mapOptions) error {
+		o.onEvict = onEvict
+		return nil
+	}
+}
+
+/**
+ * WithLockStrategy selects the lock of the segments, which serializes
+ * the writers of a segment. Default is LockMutex.
+ */
+func WithLockStrategy(strategy LockStrategy) Option {
+	return func(o *mapOptions) error {
+		if strategy < LockMutex || strategy > LockAdaptive {
+			return illegalArg("unknown lock strategy %v", strategy)
+		}
+		o.lockStrategy = strategy
+		return nil
+	}
+}
+
+/**
+ * WithLockStats makes the segment locks measure the time spent waiting
+ * for and holding them, reported by Stats as LockWaitTime and
+ * LockHoldTime. It reads the clock twice per acquisition, so it is off
+ * by default; acquisitions and contentions are always counted.
+ */
+func WithLockStats() Option {
+	return func(o *mapOptions) error {
+		o.lockStats = true
+		return nil
+	}
+}
+
+/**
+ * WithMaxConcurrencyLevel lets the map split segments whose lock is
+ * contended while it is in use, until it has maxConcurrencyLevel
+ * segments, see Resegment. The concurrency level given by
+ * WithConcurrencyLevel is the initial number of segments. Must be positive.
+ */
+func WithMaxConcurrencyLevel(maxConcurrencyLevel int) Option {
+	return func(o *mapOptions) error {
+		if maxConcurrencyLevel <= 0 {
+			return illegalArg("max concurrency level %v is not positive", maxConcurrencyLevel)
+		}
+		if maxConcurrencyLevel > MAX_SEGMENTS {
+			maxConcurrencyLevel = MAX_SEGMENTS
+		}
+		o.maxSegments = maxConcurrencyLevel
+		return nil
+	}
+}
+
+/**
+ * New creates a new, empty map configured by the given options.
+ * Options that are not given keep their defaults: initial capacity (16),
+ * load factor (0.75), concurrencyLevel (16), FNV1a with a random seed.
+ *
+ * Returns an error wrapping IllegalArgError if an option is invalid,
+ * or NonSupportKey if the key type given by WithKeyType cannot be hashed.
+ */
+func New(opts ...Option) (m *ConcurrentMap, err error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err = opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return newConcurrentMapWithOptions(o)
+}
@@ -0,0 +1,75 @@
+package concurrent
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	m, err := New(WithInitialCapacity(64), WithLoadFactor(0.5), WithConcurrencyLevel(4),
+		WithHashAlgorithm(SipHash), WithSeed(9), WithKeyType(reflect.TypeOf(0)))
+	if err != nil {
+		t.Fatalf("New with valid options, return error %v", err)
+	}
+	if len(m.segmentList()) != 4 {
+		t.Errorf("segments %v, want 4", len(m.segmentList()))
+	}
+	if l := len(m.segmentList()[0].loadTable()); l != 16 {
+		t.Errorf("segment capacity %v, want 16", l)
+	}
+	if m.seed != 9 || m.hashAlg != SipHash || m.segmentList()[0].loadFactor != 0.5 {
+		t.Errorf("options not applied, seed %v, algorithm %v, load factor %v",
+			m.seed, m.hashAlg, m.segmentList()[0].loadFactor)
+	}
+	m.Put(1, 1)
+	if v, ok := m.Get(1); !ok || v != 1 {
+		t.Errorf("Get 1, return %v, %v", v, ok)
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	invalid := map[string]Option{
+		"negative capacity":      WithInitialCapacity(-1),
+		"zero load factor":       WithLoadFactor(0),
+		"NaN load factor":        WithLoadFactor(float32(math.NaN())),
+		"infinite load factor":   WithLoadFactor(float32(math.Inf(1))),
+		"huge load factor":       WithLoadFactor(1e30),
+		"zero concurrency level": WithConcurrencyLevel(0),
+		"unknown algorithm":      WithHashAlgorithm(HashAlgorithm(99)),
+		"nil key type":           WithKeyType(nil),
+		"negative divisor":       WithShrinkDivisor(-1),
+	}
+	for name, opt := range invalid {
+		m, err := New(opt)
+		if m != nil || !errors.Is(err, IllegalArgError) {
+			t.Errorf("New with %v, return %v, %v, want nil, IllegalArgError", name, m, err)
+		}
+	}
+
+	if _, err := New(WithKeyType(reflect.TypeOf([]int{}))); err != NonSupportKey {
+		t.Errorf("New with slice key type, return %v, want NonSupportKey", err)
+	}
+	if _, err := New(WithKeyType(reflect.TypeOf(collidingKey{}))); err != nil {
+		t.Errorf("New with Hashable key type, return %v, want nil", err)
+	}
+}
+
+func TestNewWithoutShrinking(t *testing.T) {
+	m, _ := New(WithConcurrencyLevel(1), WithShrinkDivisor(0))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i)
+	}
+	peak := segmentCapacities(m)
+	for i := 0; i < 1000; i++ {
+		m.Remove(i)
+	}
+	if c := segmentCapacities(m); c != peak {
+		t.Errorf("capacity %v after removals with shrinking disabled, want %v", c, peak)
+	}
+	m.Compact()
+	if c := segmentCapacities(m); c >= peak {
+		t.Errorf("capacity %v after Compact, want < %v", c, peak)
+	}
+}
@@ -0,0 +1,315 @@
+package concurrent
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+/* ---------------- Re-segmentation -------------- */
+
+/*
+* The segments are found through a directory of 2^bits slots indexed by the
+* upper bits of hash*segmentSeed, like in extendible hashing. The keys of a
+* segment share its depth upper bits, and the segment fills the
+* 2^(bits-depth) consecutive slots of those bits. So a segment is split
+* into two by the next bit without touching the other segments, the
+* directory is only doubled first if the segment fills a single slot.
+*
+* A split locks the segment, copies its entries into two new segments,
+* publishes a new directory and marks the segment moved before unlocking
+* it. The table of a moved segment never changes again, so a reader that
+* loaded the old directory still sees the mappings as they were before the
+* split, like a reader of a table that is being rehashed. A writer that
+* locks a moved segment unlocks it and retries with the new directory, see
+* lockLive. Splits hold resegmentLock, and so do the operations that lock
+* or visit every segment, so they never see a segment being split.
+ */
+
+const (
+	/**
+	 * A map created WithMaxConcurrencyLevel checks the contention of a
+	 * segment lock every SPLIT_CHECK_INTERVAL acquisitions, and splits the
+	 * segment if more than 1/SPLIT_CONTENTION_DIVISOR of them had to wait.
+	 */
+	SPLIT_CHECK_INTERVAL     int64 = 1024
+	SPLIT_CONTENTION_DIVISOR int64 = 8
+)
+
+type segmentDir struct {
+	slots    []*Segment //indexed by slotIndex
+	segments []*Segment //the distinct segments, in the order of slots
+	bits     uint
+	shift    uint //32 - bits
+}
+
+func newSegmentDir(slots []*Segment, bits uint) *segmentDir {
+	dir := &segmentDir{slots: slots, bits: bits, shift: 32 - bits}
+	for i, s := range slots {
+		if i == 0 || s != slots[i-1] {
+			dir.segments = append(dir.segments, s)
+		}
+	}
+	return dir
+}
+
+//slotIndex returns the slot of the segment of hash
+func (this *segmentDir) slotIndex(hash uint32, seed uint32) uint32 {
+	return (hash * seed) >> this.shift
+}
+
+//double returns a directory with twice the slots and the same segments
+func (this *segmentDir) double() *segmentDir {
+	slots := make([]*Segment, 2*len(this.slots))
+	for i := range slots {
+		slots[i] = this.slots[i>>1]
+	}
+	return newSegmentDir(slots, this.bits+1)
+}
+
+func (this *ConcurrentMap) loadDir() *segmentDir {
+	return (*segmentDir)(atomic.LoadPointer(&this.dir))
+}
+
+func (this *ConcurrentMap) storeDir(dir *segmentDir) {
+	atomic.StorePointer(&this.dir, unsafe.Pointer(dir))
+}
+
+//segmentList returns the current segments, the slice is never modified
+func (this *ConcurrentMap) segmentList() []*Segment {
+	return this.loadDir().segments
+}
+
+/**
+* Returns the number of segments, which bounds the number of writers that
+* can change the map at the same time.
+*/
+func (this *ConcurrentMap) ConcurrencyLevel() int {
+	return len(this.segmentList())
+}
+
+/**
+* Takes resegmentLock and then the locks of all segments.
+* @return the locked segments, to be passed to unlockAllSegments
+*/
+func (this *ConcurrentMap) lockAllSegments() []*Segment {
+	this.resegmentLock.Lock()
+	segments := this.segmentList()
+	for _, s := range segments {
+		s.lock.Lock()
+	}
+	return segments
+}
+
+func (this *ConcurrentMap) unlockAllSegments(segments []*Segment) {
+	for _, s := range segments {
+		s.lock.Unlock()
+	}
+	this.resegmentLock.Unlock()
+}
+
+/**
+* Acquires the lock unless the segment was split.
+* @return false without holding the lock if the segment was split, the
+*         caller must retry with the segment returned by segmentFor
+*/
+func (this *Segment) lockLive() bool {
+	this.lock.Lock()
+	if this.moved {
+		this.lock.Unlock()
+		return false
+	}
+	if this.m.maxSegments > 0 && this.lock.acquisitions%SPLIT_CHECK_INTERVAL == 0 {
+		this.checkContention()
+	}
+	return true
+}
+
+/**
+* Starts a split of the segment if its lock was contended too often since
+* the last check. The split runs on its own goroutine, it has to wait
+* until the lock is released.
+* Call only while holding lock.
+*/
+func (this *Segment) checkContention() {
+	contended := this.lock.contentions - this.checkedContentions
+	this.checkedContentions = this.lock.contentions
+	if contended*SPLIT_CONTENTION_DIVISOR <= SPLIT_CHECK_INTERVAL ||
+		len(this.m.segmentList()) >= int(this.m.maxSegments) ||
+		!atomic.CompareAndSwapInt32(&this.m.splitting, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&this.m.splitting, 0)
+		this.m.resegmentLock.Lock()
+		defer this.m.resegmentLock.Unlock()
+		this.m.split(this)
+	}()
+}
+
+/**
+* Resegment splits segments until the map has at least concurrencyLevel
+* segments, rounded up to a power of two. It can be called while the map
+* is in use, every segment is locked only while it is split and readers
+* are never blocked. The number of segments is never reduced, and the
+* segments of a bounded map are not split below a share of two entries.
+*
+* @return IllegalArgError if concurrencyLevel is not positive
+*/
+func (this *ConcurrentMap) Resegment(concurrencyLevel int) error {
+	if concurrencyLevel <= 0 {
+		return illegalArg("concurrency level %v is not positive", concurrencyLevel)
+	}
+	if concurrencyLevel > MAX_SEGMENTS {
+		concurrencyLevel = MAX_SEGMENTS
+	}
+	bits := uint(0)
+	for 1<<bits < concurrencyLevel {
+		bits++
+	}
+
+	this.resegmentLock.Lock()
+	defer this.resegmentLock.Unlock()
+	for {
+		split := false
+		for _, s := range this.segmentList() {
+			if s.depth < bits && this.split(s) {
+				split = true
+			}
+		}
+		if !split {
+			return nil
+		}
+	}
+}
+
+/**
+* Replaces s by two segments that take the keys whose next bit after the
+* depth upper bits of hash*segmentSeed is 0 and 1.
+* Call only while holding resegmentLock.
+* @return false if s cannot be split
+*/
+func (this *ConcurrentMap) split(s *Segment) bool {
+	//moved is only set under resegmentLock
+	if s.moved || 1<<(s.depth+1) > MAX_SEGMENTS || s.policy != nil && s.maxWeight < 4 {
+		return false
+	}
+	dir := this.loadDir()
+	if s.depth == dir.bits {
+		dir = dir.double()
+	}
+
+	var evicted []*Entry
+	defer this.notifyEvicted(&evicted) //after unlocking
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	halves := s.splitLocked(&evicted)
+	slots := make([]*Segment, len(dir.slots))
+	shift := dir.bits - 1 - s.depth
+	for i, o := range dir.slots {
+		if o == s {
+			o = halves[(i>>shift)&1]
+		}
+		slots[i] = o
+	}
+	this.storeDir(newSegmentDir(slots, dir.bits))
+	s.moved = true
+	return true
+}
+
+/**
+* Copies the entries into two new segments by the bit after the depth upper
+* bits of hash*segmentSeed. The waiters and eviction nodes of the keys
+* move with them.
+* Call only while holding lock.
+*/
+func (this *Segment) splitLocked(evicted *[]*Entry) (halves [2]*Segment) {
+	m := this.m
+	this.finishTransfer()
+	tab := this.table()
+	minCapacity := this.minCapacity >> 1
+	if minCapacity < 1 {
+		minCapacity = 1
+	}
+	capacity := len(tab) >> 1
+	if capacity < minCapacity {
+		capacity = minCapacity
+	}
+	bit := 31 - this.depth
+
+	var bins [2][][]*Entry
+	for h := range halves {
+		s := m.newSegment(capacity, this.loadFactor, this.shrinkDivisor)
+		s.minCapacity = minCapacity
+		s.setThresholds(capacity)
+		s.depth = this.depth + 1
+		//the copies keep the generations of the entries, which are all older than
+		//the one of the new segment, so they are copied again when they are updated
+		s.snapGen = this.snapGen + 1
+		halves[h] = s
+		bins[h] = make([][]*Entry, capacity)
+	}
+	for i := 0; i < len(tab); i++ {
+		forEachInBin((*Entry)(tab[i]), func(e *Entry) {
+			h := ((e.hash * m.segmentSeed) >> bit) & 1
+			index := e.hash & uint32(capacity-1)
+			bins[h][index] = append(bins[h][index], e)
+		})
+	}
+	for h, s := range halves {
+		t := s.table()
+		for index, entries := range bins[h] {
+			if len(entries) > 0 {
+				t[index] = buildBin(entries)
+				s.count += int64(len(entries))
+			}
+		}
+		if s.count > s.threshold {
+			s.rehash()
+		}
+	}
+
+	for hash, ws := range this.waiters {
+		s := halves[((hash*m.segmentSeed)>>bit)&1]
+		if s.waiters == nil {
+			s.waiters = make(map[uint32][]*waiter)
+		}
+		s.waiters[hash] = ws
+	}
+	this.waiters = nil
+
+	if this.policy != nil {
+		this.splitPolicy(halves, bit)
+		for _, s := range halves {
+			s.evictIfNeeded(evicted)
+		}
+	}
+	return
+}
+
+/**
+* Gives each half of a split segment half of its share of the bound, and
+* moves the eviction nodes to the policies of the halves in the order the
+* policy of the segment would evict them, so the halves keep that order.
+* Call only while holding lock.
+*/
+func (this *Segment) splitPolicy(halves [2]*Segment, bit uint) {
+	for h, s := range halves {
+		s.policy = this.m.newPolicy()
+		s.maxWeight = this.maxWeight / 2
+		if h == 0 {
+			s.maxWeight += this.maxWeight % 2
+		}
+	}
+	for n := this.policy.Victim(); n != nil; n = this.policy.Victim() {
+		this.policy.Remove(n)
+		n.policy = nil
+		s := halves[((n.hash*this.m.segmentSeed)>>bit)&1]
+		t := s.table()
+		if e := findInBin((*Entry)(t[n.hash&uint32(len(t)-1)]), n.key, n.hash); e != nil && e.fastCell().node == n {
+			n.policy = s.policy
+			s.policy.Add(n)
+			s.weight += n.weight
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package concurrent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResegment(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 2)
+	n := 10000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	snap := m.Snapshot()
+
+	var stop int32
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				for i := 0; i < n; i += 97 {
+					if v, ok := m.Get(i); !ok || v != i {
+						t.Errorf("Get(%v) return %v, %v during Resegment", i, v, ok)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+				k := n + g*n + i%1000
+				m.Put(k, k)
+				if v, _ := m.Remove(k); v != k {
+					t.Errorf("Remove(%v) return %v during Resegment", k, v)
+					return
+				}
+			}
+		}(g)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := m.Resegment(40); err != nil {
+		t.Errorf("Resegment return %v", err)
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if l := m.ConcurrencyLevel(); l != 64 {
+		t.Errorf("ConcurrencyLevel %v after Resegment(40), want 64", l)
+	}
+	total := int64(0)
+	for _, s := range m.segmentList() {
+		if s.depth != 6 || s.moved {
+			t.Errorf("segment depth %v, moved %v", s.depth, s.moved)
+		}
+		total += s.count
+	}
+	if total != int64(n) || m.Size() != int32(n) {
+		t.Errorf("segments count %v entries, Size %v, want %v", total, m.Size(), n)
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("Get(%v) return %v, %v after Resegment", i, v, ok)
+		}
+	}
+	if snap.Size() != n || !snap.ContainsKey(n-1) {
+		t.Errorf("snapshot taken before Resegment changed")
+	}
+	if snap := m.Snapshot(); snap.Size() != n || !snap.ContainsKey(n-1) {
+		t.Errorf("snapshot after Resegment has %v entries", snap.Size())
+	}
+
+	//the number of segments is never reduced
+	m.Resegment(2)
+	if l := m.ConcurrencyLevel(); l != 64 {
+		t.Errorf("ConcurrencyLevel %v after Resegment(2), want 64", l)
+	}
+	if err := m.Resegment(0); err == nil {
+		t.Errorf("Resegment(0) return nil")
+	}
+}
+
+func TestSplitContended(t *testing.T) {
+	m, _ := New(WithConcurrencyLevel(1), WithMaxConcurrencyLevel(2))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	s := m.segmentList()[0]
+	s.lock.Lock()
+	s.lock.contentions += SPLIT_CHECK_INTERVAL / 2
+	s.checkContention()
+	s.lock.Unlock()
+
+	for i := 0; m.ConcurrencyLevel() != 2; i++ {
+		if i == 100 {
+			t.Fatalf("contended segment was not split")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	//the map has reached its max concurrency level
+	s = m.segmentList()[0]
+	s.lock.Lock()
+	s.lock.contentions += SPLIT_CHECK_INTERVAL / 2
+	s.checkContention()
+	s.lock.Unlock()
+	if atomic.LoadInt32(&m.splitting) != 0 {
+		t.Errorf("split started beyond the max concurrency level")
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Errorf("Get(%v) return %v, %v after split", i, v, ok)
+		}
+	}
+}
+
+func TestResegmentBounded(t *testing.T) {
+	var evicted []interface{}
+	m, _ := New(WithMaxEntries(8), WithConcurrencyLevel(1),
+		WithEvictionListener(func(key, value interface{}) { evicted = append(evicted, key) }))
+	for i := 1; i <= 8; i++ {
+		m.Put(i, i)
+	}
+	m.Get(1)
+	m.Get(2)
+	m.Resegment(2)
+
+	//an uneven split evicts the least recently used keys of the fuller half
+	recency := []interface{}{3, 4, 5, 6, 7, 8, 1, 2}
+	rank := func(k interface{}) int {
+		for i, r := range recency {
+			if r == k {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, k := range evicted {
+		hash, _ := hashKey(k, m)
+		for _, r := range recency {
+			h, _ := hashKey(r, m)
+			if _, ok := m.Get(r); ok && m.segmentFor(h) == m.segmentFor(hash) && rank(r) < rank(k) {
+				t.Errorf("evicted %v but kept the less recently used %v", k, r)
+			}
+		}
+	}
+	if m.ConcurrencyLevel() != 2 || int(m.Size())+len(evicted) != 8 {
+		t.Errorf("%v segments, Size %v, evicted %v", m.ConcurrencyLevel(), m.Size(), evicted)
+	}
+	for _, s := range m.segmentList() {
+		if s.weight != s.count || s.count > s.maxWeight || s.maxWeight != 4 {
+			t.Errorf("segment weight %v, count %v, share %v", s.weight, s.count, s.maxWeight)
+		}
+	}
+	//shares are not split below two entries
+	m.Resegment(8)
+	if l := m.ConcurrencyLevel(); l != 4 {
+		t.Errorf("ConcurrencyLevel %v, want 4", l)
+	}
+}
+
+func TestResegmentWaiters(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 1)
+	result := make(chan interface{})
+	go func() {
+		v, _ := m.WaitFor(context.Background(), "k")
+		result <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.Resegment(8)
+	m.Put("k", 1)
+	if v := <-result; v != 1 {
+		t.Errorf("WaitFor return %v after Resegment", v)
+	}
+}
@@ -0,0 +1,310 @@
+package concurrent
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func segmentCapacities(m *ConcurrentMap) (total int) {
+	for _, s := range m.segmentList() {
+		total += len(s.loadTable())
+	}
+	return
+}
+
+func TestShrinkAfterRemovals(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 4)
+	initial := segmentCapacities(m)
+
+	n := 20000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	peak := segmentCapacities(m)
+	if peak <= initial {
+		t.Fatalf("capacity after %v puts is %v, want > %v", n, peak, initial)
+	}
+
+	for i := 0; i < n-10; i++ {
+		m.Remove(i)
+	}
+	if c := segmentCapacities(m); c >= peak/8 {
+		t.Errorf("capacity after removals is %v, want < %v", c, peak/8)
+	}
+	for i := n - 10; i < n; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Errorf("Get %v after shrink, return %v, %v", i, v, ok)
+		}
+	}
+	if s := m.Size(); s != 10 {
+		t.Errorf("Size after removals is %v, want 10", s)
+	}
+}
+
+func TestClearResetsCapacity(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 4)
+	initial := segmentCapacities(m)
+	for i := 0; i < 10000; i++ {
+		m.Put(i, i)
+	}
+	m.Clear()
+	if c := segmentCapacities(m); c != initial {
+		t.Errorf("capacity after Clear is %v, want %v", c, initial)
+	}
+	m.Put(1, 1)
+	if v, ok := m.Get(1); !ok || v != 1 {
+		t.Errorf("Get 1 after Clear, return %v, %v", v, ok)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 4)
+	n := 20000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	//removing through RemoveEntry of every other key stays above the shrink threshold
+	for i := 0; i < n; i += 2 {
+		m.RemoveEntry(i, i)
+	}
+	before := segmentCapacities(m)
+	m.Compact()
+	after := segmentCapacities(m)
+	if after >= before {
+		t.Errorf("capacity after Compact is %v, want < %v", after, before)
+	}
+	for _, s := range m.segmentList() {
+		if s.count > s.threshold {
+			t.Errorf("segment count %v exceeds threshold %v after Compact", s.count, s.threshold)
+		}
+	}
+	for i := 1; i < n; i += 2 {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("Get %v after Compact, return %v, %v", i, v, ok)
+		}
+	}
+}
+
+//readers must keep finding live keys while writers grow and shrink the tables
+func TestConcurrentReadsDuringShrink(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 2)
+	stable := 100
+	for i := 0; i < stable; i++ {
+		m.Put(-i-1, i)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 5000; i++ {
+				m.Put(i, i)
+			}
+			for i := 0; i < 5000; i++ {
+				m.Remove(i)
+			}
+		}
+		close(stop)
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i := 0; i < stable; i++ {
+					if v, ok := m.Get(-i - 1); !ok || v != i {
+						t.Errorf("Get %v during shrink, return %v, %v", -i-1, v, ok)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+//collidingKey hashes to one of buckets hash codes, so many keys share one bin
+type collidingKey struct {
+	id      int
+	buckets int
+}
+
+func (k collidingKey) HashBytes() []byte {
+	return []byte{byte(k.id % k.buckets)}
+}
+
+func (k collidingKey) Equals(v2 interface{}) bool {
+	k2, ok := v2.(collidingKey)
+	return ok && k.id == k2.id
+}
+
+func treeBinCount(m *ConcurrentMap) (n int) {
+	for _, s := range m.segmentList() {
+		for _, p := range s.loadTable() {
+			if isTreeBin((*Entry)(p)) {
+				n++
+			}
+		}
+	}
+	return
+}
+
+func TestTreeifyCollidingKeys(t *testing.T) {
+	for _, buckets := range []int{1, 3} {
+		m := NewConcurrentMap()
+		n := 200
+		for i := 0; i < n; i++ {
+			m.Put(collidingKey{i, buckets}, i)
+		}
+		if treeBinCount(m) == 0 {
+			t.Fatalf("%v colliding hashes, no tree bin after %v puts", buckets, n)
+		}
+		for i := 0; i < n; i++ {
+			if v, ok := m.Get(collidingKey{i, buckets}); !ok || v != i {
+				t.Fatalf("Get %v from tree bin, return %v, %v", i, v, ok)
+			}
+		}
+		if found, _ := m.ContainsKey(collidingKey{n, buckets}); found {
+			t.Errorf("ContainsKey of absent key in tree bin, return true")
+		}
+		if l := len(m.ToSlice()); l != n {
+			t.Errorf("iterate tree bins, got %v entries, want %v", l, n)
+		}
+
+		m.Replace(collidingKey{5, buckets}, -5)
+		if v, _ := m.Get(collidingKey{5, buckets}); v != -5 {
+			t.Errorf("Get after Replace in tree bin, return %v, want -5", v)
+		}
+
+		for i := 0; i < n-3; i++ {
+			if v, ok := m.Remove(collidingKey{i, buckets}); !ok || v == nil {
+				t.Fatalf("Remove %v from tree bin, return %v, %v", i, v, ok)
+			}
+		}
+		if c := treeBinCount(m); c != 0 {
+			t.Errorf("%v tree bins left after removals, want 0", c)
+		}
+		for i := n - 3; i < n; i++ {
+			if v, ok := m.Get(collidingKey{i, buckets}); !ok || v != i {
+				t.Errorf("Get %v after untreeify, return %v, %v", i, v, ok)
+			}
+		}
+	}
+}
+
+func TestTreeBinBalanced(t *testing.T) {
+	tb := newTreeBin(nil, 0)
+	entries := make([]*Entry, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		var v interface{} = i
+		e := &Entry{i, uint32(i * 2654435761), 0, unsafe.Pointer(&v), nil}
+		entries = append(entries, e)
+		tb = tb.put(e)
+	}
+	var check func(n *treeNode) int32
+	check = func(n *treeNode) int32 {
+		if n == nil {
+			return 0
+		}
+		hl, hr := check(n.left), check(n.right)
+		if hl-hr > 1 || hr-hl > 1 {
+			t.Fatalf("unbalanced node, heights %v and %v", hl, hr)
+		}
+		if n.left != nil && n.left.hash >= n.hash || n.right != nil && n.right.hash <= n.hash {
+			t.Fatalf("tree node out of order")
+		}
+		return n.height
+	}
+	check(tb.root)
+	for i, e := range entries {
+		if i%2 == 0 {
+			tb = tb.remove(e)
+		}
+	}
+	check(tb.root)
+	if tb.size != 500 {
+		t.Errorf("tree bin size %v, want 500", tb.size)
+	}
+	for i, e := range entries {
+		if found := tb.find(e.key, e.hash); (found != nil) != (i%2 == 1) {
+			t.Fatalf("find %v in tree bin, return %v", i, found)
+		}
+	}
+}
+
+//keys whose full hash codes collide are ordered by their values
+func TestTreeBinTieBreak(t *testing.T) {
+	var entries []*Entry
+	for i := 0; i < 500; i++ {
+		var v interface{} = i
+		entries = append(entries, &Entry{i, 7, 0, unsafe.Pointer(&v), nil},
+			&Entry{strconv.Itoa(i), 7, 0, unsafe.Pointer(&v), nil})
+	}
+	built := asTreeBin((*Entry)(buildBin(entries)))
+	tb := newTreeBin(nil, 0)
+	for _, e := range entries {
+		tb = tb.put(e)
+	}
+	var nodes func(n *treeNode) int
+	nodes = func(n *treeNode) int {
+		if n == nil {
+			return 0
+		}
+		return 1 + nodes(n.left) + nodes(n.right)
+	}
+	for _, b := range []*treeBin{built, tb} {
+		if n, h := nodes(b.root), treeHeight(b.root); n != len(entries) || h > 15 {
+			t.Errorf("tree of %v colliding keys has %v nodes and height %v", len(entries), n, h)
+		}
+		if e := b.find("42", 7); e == nil || e.key != "42" {
+			t.Errorf("find 42 in tree bin, return %v", e)
+		}
+	}
+	for i, e := range entries {
+		if i%3 == 0 {
+			tb = tb.remove(e)
+		}
+	}
+	for i, e := range entries {
+		if found := tb.find(e.key, e.hash); (found != nil) != (i%3 != 0) || found != nil && found.key != e.key {
+			t.Fatalf("find %v in tree bin, return %v", e.key, found)
+		}
+	}
+	if tb.find(1.5, 7) != nil || tb.find("x", 7) != nil {
+		t.Errorf("find absent key in tree bin, return an entry")
+	}
+}
+
+//tree bins must survive growing and shrinking the table
+func TestTreeBinResize(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 1)
+	n := 100
+	for i := 0; i < n; i++ {
+		m.Put(collidingKey{i, 1}, i)
+	}
+	for i := 0; i < 5000; i++ {
+		m.Put(i, i)
+	}
+	for i := 0; i < 5000; i++ {
+		m.Remove(i)
+	}
+	m.Compact()
+	for i := 0; i < n; i++ {
+		if v, ok := m.Get(collidingKey{i, 1}); !ok || v != i {
+			t.Fatalf("Get %v after resizing tree bins, return %v, %v", i, v, ok)
+		}
+	}
+	if s := m.Size(); s != int32(n) {
+		t.Errorf("Size %v, want %v", s, n)
+	}
+}
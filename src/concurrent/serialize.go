@@ -0,0 +1,646 @@
+package concurrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"reflect"
+)
+
+/* ---------------- Serialization -------------- */
+
+/*
+* WriteTo writes the map in a compact binary format that ReadFrom reads
+* back. GobEncode and GobDecode use the same format, MarshalJSON and
+* UnmarshalJSON write and read a JSON array of {"key": k, "value": v}
+* objects.
+*
+* Writing the map itself is weakly consistent like MapIterator: entries
+* updated while the map is written may or may not be written. The methods
+* of the same name on a Snapshot write exactly the mappings of the snapshot.
+*
+* Reading adds the mappings to the map, like a Put for each of them. A zero
+* ConcurrentMap, as allocated by encoding/json or encoding/gob, is first
+* initialized like a map created by New without options. The mappings are
+* only put once all of them are read and, in the binary format, the count
+* and checksum of the trailer are verified, with the batch put of PutAll.
+* If reading fails, nothing is put into the map.
+*
+* The binary format is
+*
+*   header    the magic bytes "CMAP" and the format version 1
+*   entries   key and value of every mapping, each as a tag byte
+*             followed by the value, see appendValue
+*   trailer   tagEnd, the number of entries as uvarint, and the CRC-32C
+*             (Castagnoli) of all preceding bytes, 4 bytes little endian
+*
+* bool, the int, uint, float and complex types, string and []byte keep
+* their type and take a few bytes. Other keys and values are written with
+* encoding/gob in one gob stream, so their types must be registered with
+* gob.Register, and a named type like `type id int` comes back as id only
+* if it is registered.
+ */
+
+const (
+	serialMagic   = "CMAP"
+	serialVersion = 1
+
+	//lengths are read before the checksum is verified, so a byte string
+	//is read in chunks of this size instead of allocating its length
+	serialChunk = 64 << 10
+)
+
+const (
+	tagEnd byte = iota
+	tagBool
+	tagInt
+	tagInt8
+	tagInt16
+	tagInt32
+	tagInt64
+	tagUint
+	tagUint8
+	tagUint16
+	tagUint32
+	tagUint64
+	tagUintptr
+	tagFloat32
+	tagFloat64
+	tagComplex64
+	tagComplex128
+	tagString
+	tagBytes
+	tagGob
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func corrupt(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", CorruptDataError, fmt.Sprintf(format, a...))
+}
+
+//gobValue wraps keys and values written with gob, gob sends the concrete type only for interface fields
+type gobValue struct {
+	V interface{}
+}
+
+/**
+* WriteTo writes the mappings of the map to w in the binary format read by
+* ReadFrom, see above. It implements io.WriterTo.
+*
+* @return the number of bytes written and the first error of w or of gob
+*/
+func (this *ConcurrentMap) WriteTo(w io.Writer) (n int64, err error) {
+	return writeMap(w, this.each)
+}
+
+/**
+* WriteTo writes the mappings of the snapshot to w in the binary format
+* read by ConcurrentMap.ReadFrom.
+*/
+func (this *Snapshot) WriteTo(w io.Writer) (n int64, err error) {
+	return writeMap(w, this.each)
+}
+
+/**
+* ReadFrom reads mappings written by WriteTo from r and puts them into the
+* map. It implements io.ReaderFrom. If r is not an io.ByteReader it is
+* buffered, so bytes after the end of the map may be consumed from r.
+* Deadlines are not written, the read mappings get the default TTL of the
+* map like Put.
+*
+* @return the number of bytes read, and an error wrapping CorruptDataError
+*         if the data is not valid or its checksum does not match
+*/
+func (this *ConcurrentMap) ReadFrom(r io.Reader) (n int64, err error) {
+	this.initIfZero()
+	d := newMapDecoder(r)
+	err = d.readMap(this)
+	return d.n, err
+}
+
+func (this *mapDecoder) readMap(m *ConcurrentMap) (err error) {
+	var magic [len(serialMagic) + 1]byte
+	if err = this.readFull(magic[:]); err != nil {
+		return
+	}
+	if string(magic[:len(serialMagic)]) != serialMagic {
+		return corrupt("bad magic %q", magic[:len(serialMagic)])
+	}
+	if magic[len(serialMagic)] != serialVersion {
+		return corrupt("unknown version %v", magic[len(serialMagic)])
+	}
+
+	var items []batchItem
+	for {
+		var item batchItem
+		var end bool
+		if item.key, end, err = this.readValue(); err != nil || end {
+			break
+		}
+		if item.value, end, err = this.readValue(); err != nil {
+			break
+		}
+		if end {
+			return corrupt("key without value")
+		}
+		if err = m.decodedItem(&item); err != nil {
+			break
+		}
+		items = append(items, item)
+	}
+	if err != nil {
+		return
+	}
+	count := uint64(len(items))
+
+	var written uint64
+	if written, err = this.readUvarint(); err != nil {
+		return
+	}
+	sum := this.crc.Sum32()
+	var b [4]byte
+	if err = this.readFull(b[:]); err != nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(b[:]) != sum {
+		return corrupt("checksum mismatch")
+	}
+	if written != count {
+		return corrupt("%v entries, trailer says %v", count, written)
+	}
+	m.forEachSegmentOf(items, (*Segment).putBatch)
+	return
+}
+
+/**
+* GobEncode implements gob.GobEncoder with the format of WriteTo.
+*/
+func (this *ConcurrentMap) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := this.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+/**
+* GobEncode implements gob.GobEncoder, the result decodes into a ConcurrentMap.
+*/
+func (this *Snapshot) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := this.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+/**
+* GobDecode implements gob.GobDecoder, see ReadFrom.
+*/
+func (this *ConcurrentMap) GobDecode(data []byte) error {
+	_, err := this.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+type jsonEntry struct {
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+/**
+* MarshalJSON implements json.Marshaler. The map is written as an array of
+* {"key": k, "value": v} objects, so keys need not be strings.
+*/
+func (this *ConcurrentMap) MarshalJSON() ([]byte, error) {
+	return marshalJSON(this.each)
+}
+
+/**
+* MarshalJSON implements json.Marshaler like ConcurrentMap.MarshalJSON.
+*/
+func (this *Snapshot) MarshalJSON() ([]byte, error) {
+	return marshalJSON(this.each)
+}
+
+/**
+* UnmarshalJSON implements json.Unmarshaler. Keys and values are decoded
+* into the types given by WithKeyType and WithValueType, otherwise into the
+* types encoding/json uses for an interface{}: a number becomes a float64,
+* and keys that decode to arrays or objects are rejected with NonSupportKey.
+*/
+func (this *ConcurrentMap) UnmarshalJSON(data []byte) error {
+	this.initIfZero()
+	var entries []struct {
+		Key   json.RawMessage `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	items := make([]batchItem, len(entries))
+	for i, e := range entries {
+		var err error
+		if items[i].key, err = unmarshalTyped(e.Key, this.keyType); err != nil {
+			return err
+		}
+		if items[i].value, err = unmarshalTyped(e.Value, this.valueType); err != nil {
+			return err
+		}
+		if err = this.decodedItem(&items[i]); err != nil {
+			return err
+		}
+	}
+	this.forEachSegmentOf(items, (*Segment).putBatch)
+	return nil
+}
+
+func unmarshalTyped(data json.RawMessage, t reflect.Type) (interface{}, error) {
+	if t == nil {
+		var v interface{}
+		err := json.Unmarshal(data, &v)
+		return v, err
+	}
+	p := reflect.New(t)
+	if err := json.Unmarshal(data, p.Interface()); err != nil {
+		return nil, err
+	}
+	return p.Elem().Interface(), nil
+}
+
+func marshalJSON(each func(f func(key, value interface{}) bool)) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	buf.WriteByte('[')
+	first := true
+	each(func(key, value interface{}) bool {
+		var b []byte
+		if b, err = json.Marshal(jsonEntry{key, value}); err != nil {
+			return false
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.Write(b)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+/**
+* Calls f for every mapping until f returns false, weakly consistent like
+* MapIterator.
+ */
+func (this *ConcurrentMap) each(f func(key, value interface{}) bool) {
+	var stop int32
+	for _, s := range this.segmentList() {
+		s.forEach(&stop, func(e *Entry, v interface{}) bool {
+			if !f(e.key, v) {
+				stop = 1
+				return false
+			}
+			return true
+		})
+		if stop != 0 {
+			return
+		}
+	}
+}
+
+//each calls f for every mapping of the snapshot until f returns false
+func (this *Snapshot) each(f func(key, value interface{}) bool) {
+	goOn := true
+	for _, tab := range this.tables {
+		for i := 0; i < len(tab) && goOn; i++ {
+			forEachInBin((*Entry)(tab[i]), func(e *Entry) {
+				if goOn && !this.expired(e) {
+					goOn = f(e.key, e.Value())
+				}
+			})
+		}
+	}
+}
+
+//decodedItem hashes the key of a decoded mapping, it reports keys and values that cannot be stored
+func (this *ConcurrentMap) decodedItem(item *batchItem) error {
+	if err := this.hashItem(item); err != nil {
+		return err
+	}
+	if isNil(item.value) {
+		return NilValueError
+	}
+	return nil
+}
+
+//initIfZero initializes a zero ConcurrentMap like New without options
+func (this *ConcurrentMap) initIfZero() {
+	if this.dir != nil {
+		return
+	}
+	this.init(defaultOptions())
+}
+
+/* ---------------- Binary format -------------- */
+
+func writeMap(w io.Writer, each func(f func(key, value interface{}) bool)) (n int64, err error) {
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(castagnoli)
+	e := &mapEncoder{}
+	e.enc = gob.NewEncoder(&e.gobBuf)
+
+	//write sends buf to w and the checksum
+	write := func(buf []byte) bool {
+		crc.Write(buf)
+		var c int
+		c, err = bw.Write(buf)
+		n += int64(c)
+		return err == nil
+	}
+
+	buf := append([]byte(serialMagic), serialVersion)
+	if !write(buf) {
+		return
+	}
+	var count uint64
+	each(func(key, value interface{}) bool {
+		if buf, err = e.appendValue(buf[:0], key); err != nil {
+			return false
+		}
+		if buf, err = e.appendValue(buf, value); err != nil {
+			return false
+		}
+		count++
+		return write(buf)
+	})
+	if err != nil {
+		return
+	}
+
+	buf = binary.AppendUvarint(append(buf[:0], tagEnd), count)
+	if !write(buf) {
+		return
+	}
+	if !write(binary.LittleEndian.AppendUint32(buf[:0], crc.Sum32())) {
+		return
+	}
+	err = bw.Flush()
+	return
+}
+
+//mapEncoder holds the gob stream shared by all keys and values that are written with gob
+type mapEncoder struct {
+	enc    *gob.Encoder
+	gobBuf bytes.Buffer
+}
+
+//appendValue appends the tag and the encoding of v to buf
+func (this *mapEncoder) appendValue(buf []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case bool:
+		buf = appendBool(append(buf, tagBool), x)
+	case int:
+		buf = binary.AppendVarint(append(buf, tagInt), int64(x))
+	case int8:
+		buf = binary.AppendVarint(append(buf, tagInt8), int64(x))
+	case int16:
+		buf = binary.AppendVarint(append(buf, tagInt16), int64(x))
+	case int32:
+		buf = binary.AppendVarint(append(buf, tagInt32), int64(x))
+	case int64:
+		buf = binary.AppendVarint(append(buf, tagInt64), x)
+	case uint:
+		buf = binary.AppendUvarint(append(buf, tagUint), uint64(x))
+	case uint8:
+		buf = binary.AppendUvarint(append(buf, tagUint8), uint64(x))
+	case uint16:
+		buf = binary.AppendUvarint(append(buf, tagUint16), uint64(x))
+	case uint32:
+		buf = binary.AppendUvarint(append(buf, tagUint32), uint64(x))
+	case uint64:
+		buf = binary.AppendUvarint(append(buf, tagUint64), x)
+	case uintptr:
+		buf = binary.AppendUvarint(append(buf, tagUintptr), uint64(x))
+	case float32:
+		buf = binary.LittleEndian.AppendUint32(append(buf, tagFloat32), math.Float32bits(x))
+	case float64:
+		buf = appendUint64(append(buf, tagFloat64), math.Float64bits(x))
+	case complex64:
+		buf = binary.LittleEndian.AppendUint32(append(buf, tagComplex64), math.Float32bits(real(x)))
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(imag(x)))
+	case complex128:
+		buf = appendUint64(append(buf, tagComplex128), math.Float64bits(real(x)))
+		buf = appendUint64(buf, math.Float64bits(imag(x)))
+	case string:
+		buf = binary.AppendUvarint(append(buf, tagString), uint64(len(x)))
+		buf = append(buf, x...)
+	case []byte:
+		buf = binary.AppendUvarint(append(buf, tagBytes), uint64(len(x)))
+		buf = append(buf, x...)
+	default:
+		this.gobBuf.Reset()
+		if err := this.enc.Encode(gobValue{v}); err != nil {
+			return buf, err
+		}
+		buf = binary.AppendUvarint(append(buf, tagGob), uint64(this.gobBuf.Len()))
+		buf = append(buf, this.gobBuf.Bytes()...)
+	}
+	return buf, nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+//mapDecoder reads the binary format, counting the bytes it reads and adding them to the checksum
+type mapDecoder struct {
+	r   byteReader
+	err error //last error of r
+	n   int64
+	crc hash.Hash32
+	buf []byte
+	//the gob stream, fed with the bytes of every value written with gob
+	gobIn bytes.Buffer
+	dec   *gob.Decoder
+}
+
+func newMapDecoder(r io.Reader) *mapDecoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &mapDecoder{r: br, crc: crc32.New(castagnoli)}
+	d.dec = gob.NewDecoder(&d.gobIn)
+	return d
+}
+
+func (this *mapDecoder) ReadByte() (byte, error) {
+	b, err := this.r.ReadByte()
+	if err != nil {
+		this.err = this.wrap(err)
+		return 0, this.err
+	}
+	this.n++
+	this.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (this *mapDecoder) readFull(p []byte) error {
+	c, err := io.ReadFull(this.r, p)
+	this.n += int64(c)
+	this.crc.Write(p[:c])
+	return this.wrap(err)
+}
+
+//wrap reports a map that ends early as CorruptDataError
+func (this *mapDecoder) wrap(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return corrupt("unexpected end of data")
+	}
+	return err
+}
+
+//readUvarint reads a uvarint, reporting one that overflows as CorruptDataError
+func (this *mapDecoder) readUvarint() (uint64, error) {
+	u, err := binary.ReadUvarint(this)
+	if err != nil && err != this.err {
+		err = corrupt("%v", err)
+	}
+	return u, err
+}
+
+func (this *mapDecoder) readVarint() (int64, error) {
+	i, err := binary.ReadVarint(this)
+	if err != nil && err != this.err {
+		err = corrupt("%v", err)
+	}
+	return i, err
+}
+
+//readBytes reads a length prefixed byte string. The buffer only grows
+//with the bytes actually read, so a corrupt length fails at the end of
+//the data instead of allocating that many bytes
+func (this *mapDecoder) readBytes() ([]byte, error) {
+	l, err := this.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if l > math.MaxInt32 {
+		return nil, corrupt("length %v", l)
+	}
+	this.buf = this.buf[:0]
+	for n := int(l); n > 0; {
+		c := n
+		if c > serialChunk {
+			c = serialChunk
+		}
+		start := len(this.buf)
+		this.buf = append(this.buf, make([]byte, c)...)
+		if err = this.readFull(this.buf[start:]); err != nil {
+			return nil, err
+		}
+		n -= c
+	}
+	return this.buf, nil
+}
+
+//readValue reads a value written by appendValue, end is true if it reads tagEnd instead
+func (this *mapDecoder) readValue() (v interface{}, end bool, err error) {
+	tag, err := this.ReadByte()
+	if err != nil {
+		return
+	}
+	var i int64
+	var u uint64
+	switch tag {
+	case tagEnd:
+		return nil, true, nil
+	case tagInt, tagInt8, tagInt16, tagInt32, tagInt64:
+		if i, err = this.readVarint(); err != nil {
+			return
+		}
+	case tagUint, tagUint8, tagUint16, tagUint32, tagUint64, tagUintptr:
+		if u, err = this.readUvarint(); err != nil {
+			return
+		}
+	}
+
+	var b [8]byte
+	switch tag {
+	case tagBool:
+		var c byte
+		c, err = this.ReadByte()
+		v = c != 0
+	case tagInt:
+		v = int(i)
+	case tagInt8:
+		v = int8(i)
+	case tagInt16:
+		v = int16(i)
+	case tagInt32:
+		v = int32(i)
+	case tagInt64:
+		v = i
+	case tagUint:
+		v = uint(u)
+	case tagUint8:
+		v = uint8(u)
+	case tagUint16:
+		v = uint16(u)
+	case tagUint32:
+		v = uint32(u)
+	case tagUint64:
+		v = u
+	case tagUintptr:
+		v = uintptr(u)
+	case tagFloat32:
+		err = this.readFull(b[:4])
+		v = math.Float32frombits(binary.LittleEndian.Uint32(b[:]))
+	case tagFloat64:
+		err = this.readFull(b[:])
+		v = math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+	case tagComplex64:
+		err = this.readFull(b[:])
+		v = complex(math.Float32frombits(binary.LittleEndian.Uint32(b[:4])),
+			math.Float32frombits(binary.LittleEndian.Uint32(b[4:])))
+	case tagComplex128:
+		err = this.readFull(b[:])
+		re := math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+		if err == nil {
+			err = this.readFull(b[:])
+		}
+		v = complex(re, math.Float64frombits(binary.LittleEndian.Uint64(b[:])))
+	case tagString, tagBytes:
+		var p []byte
+		if p, err = this.readBytes(); err != nil {
+			return
+		}
+		if tag == tagString {
+			v = string(p)
+		} else {
+			v = append([]byte(nil), p...)
+		}
+	case tagGob:
+		var p []byte
+		if p, err = this.readBytes(); err != nil {
+			return
+		}
+		this.gobIn.Write(p)
+		var gv gobValue
+		if err = this.dec.Decode(&gv); err != nil {
+			return nil, false, corrupt("%v", err)
+		}
+		v = gv.V
+	default:
+		return nil, false, corrupt("unknown tag %v", tag)
+	}
+	return
+}
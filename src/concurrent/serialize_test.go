@@ -0,0 +1,201 @@
+package concurrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+type serialKey struct {
+	Tenant int
+	Name   string
+}
+
+func init() {
+	gob.Register(serialKey{})
+	gob.Register(namedInt(0))
+}
+
+func serialTestEntries() map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		true: false, -1: int8(-8), int16(-16): int32(-32), int64(-64): uint(1),
+		uint8(8): uint16(16), uint32(32): uint64(1 << 60), uintptr(7): float32(1.5),
+		2.5: complex64(1 + 2i), complex(3, 4): "s", "key": []byte("bytes"),
+		serialKey{1, "a"}: serialKey{2, "b"}, namedInt(3): []int{1, 2},
+	}
+}
+
+func checkEntries(t *testing.T, m *ConcurrentMap, want map[interface{}]interface{}) {
+	if int(m.Size()) != len(want) {
+		t.Errorf("Size %v, want %v", m.Size(), len(want))
+	}
+	for k, v := range want {
+		if got, ok := m.Get(k); !ok || !reflect.DeepEqual(got, v) {
+			t.Errorf("Get %#v, return %#v, %v, want %#v", k, got, ok, v)
+		}
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	want := serialTestEntries()
+	m := NewConcurrentMapFromMap(want)
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo return %v, %v, wrote %v bytes", n, err, buf.Len())
+	}
+
+	m2 := NewConcurrentMap()
+	if n2, err := m2.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil || n2 != n {
+		t.Fatalf("ReadFrom return %v, %v, want %v, nil", n2, err, n)
+	}
+	checkEntries(t, m2, want)
+
+	//a reader that is no io.ByteReader is buffered
+	var m3 ConcurrentMap
+	if _, err := m3.ReadFrom(struct{ *bytes.Buffer }{bytes.NewBuffer(buf.Bytes())}); err != nil {
+		t.Fatalf("ReadFrom into zero map, return %v", err)
+	}
+	checkEntries(t, &m3, want)
+	m3.Put("new", 1)
+	if v, _ := m3.Get("new"); v != 1 {
+		t.Errorf("Get from a zero map after ReadFrom, return %v, want 1", v)
+	}
+}
+
+func TestReadFromCorrupt(t *testing.T) {
+	m := NewConcurrentMap()
+	for i := 0; i < 100; i++ {
+		m.Put(i, "v")
+	}
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	data := buf.Bytes()
+
+	cases := map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("XMAP"), data[4:]...),
+		"version":   append(append([]byte("CMAP"), 9), data[5:]...),
+		"truncated": data[:len(data)/2],
+		"checksum":  append(append([]byte(nil), data[:len(data)-1]...), data[len(data)-1]^1),
+		"flipped":   append(append(append([]byte(nil), data[:20]...), data[20]^0x40), data[21:]...),
+		"length":    binary.AppendUvarint([]byte{'C', 'M', 'A', 'P', serialVersion, tagString}, math.MaxInt32),
+		"gob":       []byte{'C', 'M', 'A', 'P', serialVersion, tagGob, 3, 0xff, 0xff, 0xff},
+	}
+	for name, c := range cases {
+		m2 := NewConcurrentMap()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := m2.ReadFrom(bytes.NewReader(c)); !errors.Is(err, CorruptDataError) {
+			t.Errorf("%v: ReadFrom return %v, want CorruptDataError", name, err)
+		}
+		//a corrupt length must not allocate that many bytes
+		if runtime.ReadMemStats(&after); after.TotalAlloc-before.TotalAlloc > 1<<20 {
+			t.Errorf("%v: ReadFrom allocated %v bytes", name, after.TotalAlloc-before.TotalAlloc)
+		}
+		//nothing is put before the checksum is verified
+		if m2.Size() != 0 {
+			t.Errorf("%v: ReadFrom put %v mappings of corrupt data", name, m2.Size())
+		}
+	}
+}
+
+func TestGob(t *testing.T) {
+	want := serialTestEntries()
+	type cache struct {
+		Name    string
+		Entries *ConcurrentMap
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cache{"c", NewConcurrentMapFromMap(want)}); err != nil {
+		t.Fatalf("gob Encode return %v", err)
+	}
+	var c cache
+	if err := gob.NewDecoder(&buf).Decode(&c); err != nil {
+		t.Fatalf("gob Decode return %v", err)
+	}
+	checkEntries(t, c.Entries, want)
+
+	//types that are not registered cannot be written
+	type unregistered struct{ A int }
+	m := NewConcurrentMap()
+	m.Put(1, unregistered{1})
+	if _, err := m.GobEncode(); err == nil {
+		t.Errorf("GobEncode of unregistered type, return nil error")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	m := NewConcurrentMap()
+	m.Put(serialKey{1, "a"}, 1.5)
+	m.Put(serialKey{2, "b"}, 2.5)
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal return %v", err)
+	}
+
+	m2, _ := New(WithKeyType(reflect.TypeOf(serialKey{})), WithValueType(reflect.TypeOf(float32(0))))
+	if err := json.Unmarshal(data, m2); err != nil {
+		t.Fatalf("Unmarshal return %v", err)
+	}
+	checkEntries(t, m2, map[interface{}]interface{}{serialKey{1, "a"}: float32(1.5), serialKey{2, "b"}: float32(2.5)})
+
+	//without types, keys decode like interface{} values and objects are no keys
+	var untyped struct{ M *ConcurrentMap }
+	if err := json.Unmarshal([]byte(`{"M": [{"key": "a", "value": 1}, {"key": 2, "value": [1]}]}`), &untyped); err != nil {
+		t.Fatalf("Unmarshal return %v", err)
+	}
+	checkEntries(t, untyped.M, map[interface{}]interface{}{"a": 1.0, 2.0: []interface{}{1.0}})
+	m3 := NewConcurrentMap()
+	if err := json.Unmarshal([]byte(`[{"key": "a", "value": 1}, {"key": {"a": 1}, "value": 1}]`), m3); err != NonSupportKey {
+		t.Errorf("Unmarshal object key, return %v, want NonSupportKey", err)
+	}
+	if m3.Size() != 0 {
+		t.Errorf("Unmarshal with an error put %v mappings", m3.Size())
+	}
+}
+
+func TestSnapshotWriteTo(t *testing.T) {
+	m := NewConcurrentMap()
+	n := 1000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	snap := m.Snapshot()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			m.Remove(i)
+			m.Put(n+i, i)
+		}
+	}()
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo return %v", err)
+	}
+	data, _ := snap.MarshalJSON()
+	wg.Wait()
+
+	m2 := NewConcurrentMap()
+	if _, err := m2.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom return %v", err)
+	}
+	want := make(map[interface{}]interface{}, n)
+	for i := 0; i < n; i++ {
+		want[i] = i
+	}
+	checkEntries(t, m2, want)
+	if m3, _ := New(WithKeyType(reflect.TypeOf(0)), WithValueType(reflect.TypeOf(0))); json.Unmarshal(data, m3) != nil || m3.Size() != int32(n) {
+		t.Errorf("snapshot MarshalJSON does not round trip, size %v", m3.Size())
+	}
+}
@@ -0,0 +1,100 @@
+package concurrent
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+/*
+* sipHash is a streaming SipHash-2-4, the keyed hash function by
+* Aumasson and Bernstein. Unlike FNV, finding colliding inputs for
+* SipHash without knowing the 128-bit key is believed to be infeasible,
+* so it protects a map against hash flooding.
+ */
+type sipHash struct {
+	v0, v1, v2, v3 uint64
+	buf            [8]byte
+	nbuf           int
+	length         uint64
+}
+
+func newSipHash(k0, k1 uint64) *sipHash {
+	h := &sipHash{}
+	h.init(k0, k1)
+	return h
+}
+
+//init resets the state and keys it with k0 and k1
+func (this *sipHash) init(k0, k1 uint64) {
+	*this = sipHash{
+		v0: k0 ^ 0x736f6d6570736575,
+		v1: k1 ^ 0x646f72616e646f6d,
+		v2: k0 ^ 0x6c7967656e657261,
+		v3: k1 ^ 0x7465646279746573,
+	}
+}
+
+func (this *sipHash) round() {
+	this.v0 += this.v1
+	this.v1 = bits.RotateLeft64(this.v1, 13)
+	this.v1 ^= this.v0
+	this.v0 = bits.RotateLeft64(this.v0, 32)
+	this.v2 += this.v3
+	this.v3 = bits.RotateLeft64(this.v3, 16)
+	this.v3 ^= this.v2
+	this.v0 += this.v3
+	this.v3 = bits.RotateLeft64(this.v3, 21)
+	this.v3 ^= this.v0
+	this.v2 += this.v1
+	this.v1 = bits.RotateLeft64(this.v1, 17)
+	this.v1 ^= this.v2
+	this.v2 = bits.RotateLeft64(this.v2, 32)
+}
+
+func (this *sipHash) block(m uint64) {
+	this.v3 ^= m
+	this.round()
+	this.round()
+	this.v0 ^= m
+}
+
+func (this *sipHash) Write(p []byte) (n int, err error) {
+	n = len(p)
+	this.length += uint64(n)
+	if this.nbuf > 0 {
+		c := copy(this.buf[this.nbuf:], p)
+		this.nbuf += c
+		p = p[c:]
+		if this.nbuf < 8 {
+			return
+		}
+		this.block(binary.LittleEndian.Uint64(this.buf[:]))
+		this.nbuf = 0
+	}
+	for len(p) >= 8 {
+		this.block(binary.LittleEndian.Uint64(p))
+		p = p[8:]
+	}
+	this.nbuf = copy(this.buf[:], p)
+	return
+}
+
+func (this *sipHash) Sum64() uint64 {
+	m := this.length << 56
+	for i := this.nbuf - 1; i >= 0; i-- {
+		m |= uint64(this.buf[i]) << (8 * uint(i))
+	}
+	this.block(m)
+	this.v2 ^= 0xff
+	this.round()
+	this.round()
+	this.round()
+	this.round()
+	return this.v0 ^ this.v1 ^ this.v2 ^ this.v3
+}
+
+//Sum32 folds the 64-bit SipHash into the 32-bit hash code used by Segment
+func (this *sipHash) Sum32() uint32 {
+	h := this.Sum64()
+	return uint32(h ^ (h >> 32))
+}
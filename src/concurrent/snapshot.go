@@ -0,0 +1,192 @@
+package concurrent
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+/* ---------------- Snapshots -------------- */
+
+/*
+* A Snapshot is an immutable view of the whole map at one instant, unlike
+* MapIterator that may see some concurrent updates and miss others.
+*
+* Taking a snapshot locks all segments only long enough to record their
+* tables, it does not copy any entry. Writers keep the snapshot intact by
+* copy-on-write: the first write to a segment after a snapshot copies the
+* table of the segment, and an entry created before the snapshot is never
+* updated in place but replaced by a copy, see Segment.setValue. Chains and
+* tree bins are already never modified once published, so the recorded
+* tables keep the state of the map at the time of the snapshot for as long
+* as the Snapshot is referenced.
+*
+* Entries that expire are judged at the time of the snapshot: an entry that
+* had expired is not in the snapshot, one that expires later stays in it.
+*
+* A Snapshot is safe for use by multiple goroutines.
+ */
+type Snapshot struct {
+	m           *ConcurrentMap
+	tables      [][]unsafe.Pointer //the table of every segment
+	slots       [][]unsafe.Pointer //the table of every slot of the segment directory
+	size        int
+	dir         *segmentDir
+	segmentSeed uint32
+	at          int64 //time of the snapshot in UnixNano, 0 if no entry of the map had a deadline
+}
+
+/**
+* Snapshot returns a consistent point-in-time view of the map. Updates made
+* to the map after Snapshot returns are not visible in the snapshot.
+*/
+func (this *ConcurrentMap) Snapshot() *Snapshot {
+	segments := this.lockAllSegments()
+	snap := &Snapshot{
+		m:           this,
+		tables:      make([][]unsafe.Pointer, len(segments)),
+		dir:         this.loadDir(),
+		segmentSeed: this.segmentSeed,
+	}
+	for i := 0; i < len(segments); i++ {
+		seg := segments[i]
+		seg.snapGen++
+		//the snapshot holds the whole table, not one with forwarding bins
+		seg.finishTransfer()
+		seg.tableShared = true
+		snap.tables[i] = seg.table()
+		snap.size += int(seg.count)
+	}
+	if atomic.LoadInt32(&this.expiring) != 0 {
+		snap.at = this.nanotime()
+	}
+	this.unlockAllSegments(segments)
+
+	//a segment covers consecutive slots, in the order of segments
+	snap.slots = make([][]unsafe.Pointer, len(snap.dir.slots))
+	for i, j := 0, -1; i < len(snap.slots); i++ {
+		if i == 0 || snap.dir.slots[i] != snap.dir.slots[i-1] {
+			j++
+		}
+		snap.slots[i] = snap.tables[j]
+	}
+	if snap.at != 0 {
+		//the recorded tables never change, so the expired entries are counted after unlocking
+		snap.forEachBin(func(e *Entry) {
+			if snap.expired(e) {
+				snap.size--
+			}
+		})
+	}
+	return snap
+}
+
+//expired returns true if e had expired when the snapshot was taken
+func (this *Snapshot) expired(e *Entry) bool {
+	return this.at != 0 && e.fastCell().expiredAt(this.at)
+}
+
+/**
+* Returns the number of key-value mappings in the snapshot.
+*/
+func (this *Snapshot) Size() int {
+	return this.size
+}
+
+/**
+* Returns true if the snapshot contains no key-value mappings.
+*/
+func (this *Snapshot) IsEmpty() bool {
+	return this.size == 0
+}
+
+/**
+* Returns the value to which the specified key was mapped when the
+* snapshot was taken.
+*
+* @return the value and true, or nil and false if there was no mapping
+*/
+func (this *Snapshot) Get(key interface{}) (value interface{}, ok bool) {
+	if e := this.find(key); e != nil {
+		return e.Value(), true
+	}
+	return nil, false
+}
+
+/**
+* Returns true if the specified key was mapped when the snapshot was taken.
+*/
+func (this *Snapshot) ContainsKey(key interface{}) bool {
+	return this.find(key) != nil
+}
+
+func (this *Snapshot) find(key interface{}) *Entry {
+	if isNil(key) || this.size == 0 {
+		return nil
+	}
+	hash, err := hashKey(key, this.m)
+	if err != nil {
+		return nil
+	}
+	tab := this.slots[this.dir.slotIndex(hash, this.segmentSeed)]
+	if e := findInBin((*Entry)(tab[hash&uint32(len(tab)-1)]), key, hash); e != nil && !this.expired(e) {
+		return e
+	}
+	return nil
+}
+
+/**
+* ForEach calls action for every key-value pair of the snapshot.
+*/
+func (this *Snapshot) ForEach(action func(key interface{}, value interface{})) {
+	this.forEachEntry(func(e *Entry) {
+		action(e.key, e.Value())
+	})
+}
+
+func (this *Snapshot) forEachEntry(f func(e *Entry)) {
+	this.forEachBin(func(e *Entry) {
+		if !this.expired(e) {
+			f(e)
+		}
+	})
+}
+
+//forEachBin calls f for every entry of the recorded tables, including expired ones
+func (this *Snapshot) forEachBin(f func(e *Entry)) {
+	for _, tab := range this.tables {
+		for i := 0; i < len(tab); i++ {
+			forEachInBin((*Entry)(tab[i]), f)
+		}
+	}
+}
+
+//Iterator returns a iterator for the snapshot, its Remove method always returns false
+func (this *Snapshot) Iterator() *MapIterator {
+	hi := MapIterator{}
+	hi.nextSegmentIndex = len(this.tables) - 1
+	hi.nextTableIndex = -1
+	hi.cm = this.m
+	hi.snap = this
+	hi.advance()
+	return &hi
+}
+
+//ToSlice returns a slice that includes all key-value Entry in the snapshot,
+//the entries of a snapshot never change
+func (this *Snapshot) ToSlice() (kvs []*Entry) {
+	kvs = make([]*Entry, 0, this.size)
+	this.forEachEntry(func(e *Entry) {
+		kvs = append(kvs, e)
+	})
+	return
+}
+
+//ToMap returns a native map that includes all key-value pairs in the snapshot,
+//for example to serialize the snapshot with encoding/gob
+func (this *Snapshot) ToMap() map[interface{}]interface{} {
+	m := make(map[interface{}]interface{}, this.size)
+	this.ForEach(func(key interface{}, value interface{}) {
+		m[key] = value
+	})
+	return m
+}
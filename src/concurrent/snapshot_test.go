@@ -0,0 +1,112 @@
+package concurrent
+
+import (
+	"sync"
+	"testing"
+)
+
+//checkSnapshot checks that snap holds exactly the keys 0..n-1 mapped to themselves
+func checkSnapshot(t *testing.T, snap *Snapshot, n int, key func(i int) interface{}) {
+	if snap.Size() != n {
+		t.Errorf("snapshot size %v, want %v", snap.Size(), n)
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := snap.Get(key(i)); !ok || v != i {
+			t.Errorf("snapshot Get %v, return %v, %v, want %v, true", key(i), v, ok, i)
+		}
+	}
+	count := 0
+	for itr := snap.Iterator(); itr.HasNext(); {
+		_, v, _ := itr.Next()
+		if v.(int) < 0 || v.(int) >= n {
+			t.Errorf("snapshot iterator returns value %v", v)
+		}
+		count++
+	}
+	if count != n || len(snap.ToMap()) != n || len(snap.ToSlice()) != n {
+		t.Errorf("snapshot iterates %v, maps %v, slices %v entries, want %v",
+			count, len(snap.ToMap()), len(snap.ToSlice()), n)
+	}
+}
+
+func TestSnapshotIsolatedFromUpdates(t *testing.T) {
+	keys := map[string]func(i int) interface{}{
+		"chain": func(i int) interface{} { return i },
+		"tree":  func(i int) interface{} { return collidingKey{i, 4} },
+	}
+	for name, key := range keys {
+		m := NewConcurrentMap(16, float32(0.75), 4)
+		n := 1000
+		for i := 0; i < n; i++ {
+			m.Put(key(i), i)
+		}
+		snap := m.Snapshot()
+
+		for i := 0; i < n; i++ {
+			switch i % 4 {
+			case 0:
+				m.Put(key(i), -i)
+			case 1:
+				m.Remove(key(i))
+			case 2:
+				m.Replace(key(i), -i)
+			case 3:
+				m.Compute(key(i), func(old interface{}) interface{} { return -i })
+			}
+			m.Put(key(n+i), n+i)
+		}
+		m.Compact()
+		checkSnapshot(t, snap, n, key)
+		if name == "chain" && snap.ContainsKey(n) {
+			t.Errorf("snapshot contains key %v put after the snapshot", n)
+		}
+
+		//the map itself sees all updates
+		if v, _ := m.Get(key(4)); v != -4 {
+			t.Errorf("%v: Get after snapshot, return %v, want -4", name, v)
+		}
+		if m.Snapshot().Size() != int(m.Size()) {
+			t.Errorf("%v: new snapshot size %v, want %v", name, m.Snapshot().Size(), m.Size())
+		}
+	}
+}
+
+func TestSnapshotDuringWrites(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 8)
+	n := 1000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+
+	//every writer keeps the size at n by removing a key before adding the next one
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; ; i += 4 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				m.Remove(i)
+				m.Put(i+n, i)
+			}
+		}(g)
+	}
+
+	for k := 0; k < 50; k++ {
+		snap := m.Snapshot()
+		count := 0
+		snap.ForEach(func(key, value interface{}) {
+			count++
+		})
+		if count != snap.Size() || snap.Size() < n-4 || snap.Size() > n {
+			t.Errorf("snapshot size %v iterates %v entries, want between %v and %v", snap.Size(), count, n-4, n)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
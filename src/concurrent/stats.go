@@ -0,0 +1,234 @@
+package concurrent
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/* ---------------- Statistics -------------- */
+
+/**
+* The lock of a segment, a SegmentLocker of the LockStrategy of the map.
+* It counts how often it is acquired and how often an acquisition had to
+* wait. If timed, see WithLockStats, it also sums the time spent waiting
+* and holding it. The counters are only changed and read while holding
+* the lock.
+*/
+type segmentLock struct {
+	locker       SegmentLocker
+	timed        bool
+	acquisitions int64
+	contentions  int64
+	waitTime     time.Duration
+	holdTime     time.Duration
+	acquiredAt   time.Duration //since lockEpoch
+}
+
+//lockEpoch is the origin of the monotonic times of the segment locks
+var lockEpoch = time.Now()
+
+func newSegmentLock(strategy LockStrategy, timed bool) *segmentLock {
+	return &segmentLock{locker: strategy.newLocker(), timed: timed}
+}
+
+func (this *segmentLock) Lock() {
+	if this.locker.TryLock() {
+		if this.timed {
+			this.acquiredAt = time.Since(lockEpoch)
+		}
+	} else if this.timed {
+		start := time.Since(lockEpoch)
+		this.locker.Lock()
+		this.acquiredAt = time.Since(lockEpoch)
+		this.contentions++
+		this.waitTime += this.acquiredAt - start
+	} else {
+		this.locker.Lock()
+		this.contentions++
+	}
+	this.acquisitions++
+}
+
+func (this *segmentLock) TryLock() bool {
+	if this.locker.TryLock() {
+		if this.timed {
+			this.acquiredAt = time.Since(lockEpoch)
+		}
+		this.acquisitions++
+		return true
+	}
+	return false
+}
+
+func (this *segmentLock) Unlock() {
+	if this.timed {
+		this.holdTime += time.Since(lockEpoch) - this.acquiredAt
+	}
+	this.locker.Unlock()
+}
+
+/**
+* The number of buckets of SegmentStats.Chains, the last bucket counts
+* the bins with CHAIN_HISTOGRAM_SIZE-1 or more entries.
+*/
+const CHAIN_HISTOGRAM_SIZE = 2 * TREEIFY_THRESHOLD
+
+/**
+* SegmentStats describes one segment, see ConcurrentMap.Stats.
+*/
+type SegmentStats struct {
+	Count     int64 //number of entries, including expired ones
+	Capacity  int   //number of bins, len(table)
+	Threshold int64 //the table is doubled when Count exceeds it
+	ModCount  int64 //number of changes of the set of keys
+	Rehashes  int64 //number of times the table was grown
+	Shrinks   int64 //number of times the table was shrunk
+
+	/**
+	* Chains[i] is the number of bins with i entries, the last bucket
+	* counts all longer chains. TreeBins is the number of bins that are
+	* trees, they are counted in Chains by their number of entries.
+	*/
+	Chains   [CHAIN_HISTOGRAM_SIZE]int64
+	TreeBins int
+
+	LockAcquisitions int64         //number of times the segment lock was acquired
+	LockContentions  int64         //acquisitions that had to wait for another goroutine
+	LockWaitTime     time.Duration //total time spent waiting for the lock, 0 unless WithLockStats
+	LockHoldTime     time.Duration //total time the lock was held, without the holding Stats call, 0 unless WithLockStats
+}
+
+/**
+* MapStats describes a ConcurrentMap, see ConcurrentMap.Stats.
+*/
+type MapStats struct {
+	Size         int64 //the result of LongSize
+	Capacity     int   //total number of bins of all segments
+	LoadFactor   float32
+	LockStrategy string //the LockStrategy of the segment locks
+	Segments     []SegmentStats
+}
+
+/**
+* Stats returns statistics of every segment, to tune the concurrency level,
+* the load factor and the initial capacity. Every segment is locked shortly
+* to read its counters, the chains are counted afterwards without locking
+* like ForEach, so they may differ slightly from Count while the map is
+* changed.
+*/
+func (this *ConcurrentMap) Stats() *MapStats {
+	this.resegmentLock.Lock()
+	defer this.resegmentLock.Unlock()
+	segments := this.segmentList()
+	stats := &MapStats{Size: this.LongSize(), LockStrategy: this.lockStrategy.String(), Segments: make([]SegmentStats, len(segments))}
+	for i, s := range segments {
+		s.stats(&stats.Segments[i])
+		stats.Capacity += stats.Segments[i].Capacity
+		stats.LoadFactor = s.loadFactor
+	}
+	return stats
+}
+
+func (this *Segment) stats(st *SegmentStats) {
+	this.lock.Lock()
+	st.Count = this.count
+	st.Capacity = len(this.table())
+	st.Threshold = this.threshold
+	st.ModCount = this.modCount
+	st.Rehashes = this.rehashes
+	st.Shrinks = this.shrinks
+	st.LockAcquisitions = this.lock.acquisitions
+	st.LockContentions = this.lock.contentions
+	st.LockWaitTime = this.lock.waitTime
+	st.LockHoldTime = this.lock.holdTime
+	this.lock.Unlock()
+
+	tab := this.loadTable()
+	for i := 0; i < len(tab); i++ {
+		first := (*Entry)(atomic.LoadPointer(&tab[i]))
+		if isTreeBin(first) {
+			st.TreeBins++
+		}
+		n := binSize(first, CHAIN_HISTOGRAM_SIZE-1)
+		if n > CHAIN_HISTOGRAM_SIZE-1 {
+			n = CHAIN_HISTOGRAM_SIZE - 1
+		}
+		st.Chains[n]++
+	}
+}
+
+/**
+* Returns the totals of all segments in a SegmentStats.
+*/
+func (this *MapStats) Total() (total SegmentStats) {
+	for i := range this.Segments {
+		s := &this.Segments[i]
+		total.Count += s.Count
+		total.Capacity += s.Capacity
+		total.Threshold += s.Threshold
+		total.ModCount += s.ModCount
+		total.Rehashes += s.Rehashes
+		total.Shrinks += s.Shrinks
+		for j, n := range s.Chains {
+			total.Chains[j] += n
+		}
+		total.TreeBins += s.TreeBins
+		total.LockAcquisitions += s.LockAcquisitions
+		total.LockContentions += s.LockContentions
+		total.LockWaitTime += s.LockWaitTime
+		total.LockHoldTime += s.LockHoldTime
+	}
+	return
+}
+
+/**
+* Describe returns a human-readable dump of the statistics, one line per
+* segment followed by the chain length histogram of the whole map.
+*/
+func (this *MapStats) Describe() string {
+	buffer := bytes.NewBufferString(fmt.Sprintf("&ConcurrentMap{size:%v capacity:%v segments:%v loadFactor:%v lock:%v}\n",
+		this.Size, this.Capacity, len(this.Segments), this.LoadFactor, this.LockStrategy))
+	fmt.Fprintf(buffer, "%4v %10v %10v %10v %10v %8v %8v %12v %12v %12v %12v\n",
+		"seg", "count", "capacity", "threshold", "modCount", "rehash", "shrink", "locks", "contended", "wait", "hold")
+	for i, s := range this.Segments {
+		fmt.Fprintf(buffer, "%4v %10v %10v %10v %10v %8v %8v %12v %12v %12v %12v\n",
+			i, s.Count, s.Capacity, s.Threshold, s.ModCount, s.Rehashes, s.Shrinks, s.LockAcquisitions, s.LockContentions,
+			s.LockWaitTime.Round(time.Microsecond), s.LockHoldTime.Round(time.Microsecond))
+	}
+	total := this.Total()
+	fmt.Fprintf(buffer, "chains (tree bins: %v):\n", total.TreeBins)
+	for i, n := range total.Chains {
+		if n == 0 {
+			continue
+		}
+		label := fmt.Sprint(i)
+		if i == CHAIN_HISTOGRAM_SIZE-1 {
+			label += "+"
+		}
+		fmt.Fprintf(buffer, "%4v: %v\n", label, n)
+	}
+	return buffer.String()
+}
+
+/**
+* Describe returns a human-readable dump of Stats, like gotomic's
+* Hash.Describe.
+*/
+func (this *ConcurrentMap) Describe() string {
+	return this.Stats().Describe()
+}
+
+/**
+* Publish exports the statistics of the map as an expvar variable with the
+* given name, so they are served as JSON by the /debug/vars handler. The
+* statistics are collected every time the variable is read. Like
+* expvar.Publish it panics if the name is already in use.
+*/
+func (this *ConcurrentMap) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return this.Stats()
+	}))
+}
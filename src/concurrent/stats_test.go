@@ -0,0 +1,84 @@
+package concurrent
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	m := NewConcurrentMap(16, float32(0.75), 4)
+	n := 1000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	stats := m.Stats()
+	if len(stats.Segments) != 4 || stats.Size != int64(n) || stats.LoadFactor != 0.75 {
+		t.Fatalf("Stats return %v segments, size %v, load factor %v", len(stats.Segments), stats.Size, stats.LoadFactor)
+	}
+	total := stats.Total()
+	if total.Count != int64(n) || total.Capacity != stats.Capacity {
+		t.Errorf("total count %v, capacity %v, want %v, %v", total.Count, total.Capacity, n, stats.Capacity)
+	}
+	if total.Rehashes == 0 || total.LockAcquisitions < int64(n) || total.LockContentions != 0 {
+		t.Errorf("rehashes %v, lock acquisitions %v, contentions %v", total.Rehashes, total.LockAcquisitions, total.LockContentions)
+	}
+	bins, entries := int64(0), int64(0)
+	for i, c := range total.Chains {
+		bins += c
+		entries += int64(i) * c
+	}
+	if bins != int64(stats.Capacity) || entries != int64(n) {
+		t.Errorf("chain histogram counts %v bins and %v entries, want %v and %v", bins, entries, stats.Capacity, n)
+	}
+
+	for i := 0; i < n; i++ {
+		m.Remove(i)
+	}
+	if total := m.Stats().Total(); total.Shrinks == 0 || total.Count != 0 {
+		t.Errorf("after removing all keys shrinks %v, count %v", total.Shrinks, total.Count)
+	}
+
+	d := m.Describe()
+	if !strings.HasPrefix(d, "&ConcurrentMap{size:0 ") || strings.Count(d, "\n") < 6 {
+		t.Errorf("Describe return\n%v", d)
+	}
+}
+
+func TestLockContention(t *testing.T) {
+	m := NewConcurrentMap()
+	hash, _ := hashKey(1, m)
+	s := m.segmentFor(hash)
+	s.lock.Lock()
+	done := make(chan bool)
+	go func() {
+		m.Put(1, 1)
+		done <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.lock.Unlock()
+	<-done
+
+	var st SegmentStats
+	s.stats(&st)
+	if st.LockContentions != 1 || st.LockAcquisitions != 3 {
+		t.Errorf("lock acquisitions %v, contentions %v, want 3, 1", st.LockAcquisitions, st.LockContentions)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	m := NewConcurrentMap()
+	m.Put("a", 1)
+	name := fmt.Sprintf("concurrent.TestPublish.%p", m) //names cannot be published twice, also with -count
+	m.Publish(name)
+	var stats MapStats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &stats); err != nil {
+		t.Fatalf("expvar value is no MapStats: %v", err)
+	}
+	if stats.Size != 1 || len(stats.Segments) != len(m.segmentList()) {
+		t.Errorf("published size %v, %v segments", stats.Size, len(stats.Segments))
+	}
+}
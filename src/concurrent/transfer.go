@@ -0,0 +1,140 @@
+package concurrent
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+/* ---------------- Incremental rehashing -------------- */
+
+/*
+* Doubling a large table at once stalls the writer that crosses the
+* threshold, and every writer queued on the segment lock, for as long as it
+* takes to relink all bins. So a table of at least INCREMENTAL_REHASH_CAPACITY
+* bins is doubled incrementally, like Java 8's ConcurrentHashMap transfers
+* its bins: rehash only allocates nextTable, and every following write
+* moves up to TRANSFER_STRIDE bins into it, from the last bin down, before
+* doing its own work. With a stride of at least two, the transfer is done
+* before the new table reaches its threshold.
+*
+* A moved bin is replaced by a forwardingBin that points to nextTable, bin
+* i of the old table is split into bins i and i+oldCapacity of nextTable
+* exactly as by a full rehash. reserve may start a transfer to a table
+* more than twice as large, then the bin is split into bins i,
+* i+oldCapacity, i+2*oldCapacity and so on. Lock-free readers that reach a forwardingBin
+* continue in nextTable, see findInBin and forEachInBin, and writers write
+* to the bin of nextTable, see writableBin. The nodes of a moved bin are
+* never changed, so a reader already traversing it stays safe. When the
+* last bin is moved nextTable is published as the table of the segment.
+*
+* Operations that need the whole table in one piece finish the transfer
+* first, see finishTransfer: Snapshot, shrinking and splitting a segment.
+ */
+
+const (
+	/**
+	 * Tables with fewer bins are still doubled at once, it is cheaper
+	 * than forwarding their bins.
+	 */
+	INCREMENTAL_REHASH_CAPACITY int = 1 << 10
+
+	/**
+	 * The number of bins that a write moves to the new table while a
+	 * table is doubled incrementally.
+	 */
+	TRANSFER_STRIDE int = 16
+)
+
+//forwardingMark is the next field of the Entry that heads a forwarding bin
+var forwardingMark = &Entry{}
+
+/**
+* Replaces a bin that was moved to the next table.
+*/
+type forwardingBin struct {
+	Entry                        // must be the first field, the table slot points to it
+	table       []unsafe.Pointer //the table the bin was moved to
+	index       uint32           //the index of the bin in the old table
+	oldCapacity uint32           //the size of the old table
+}
+
+//isForwarding returns true if e is the head of a forwarding bin
+func isForwarding(e *Entry) bool {
+	return e != nil && e.next == forwardingMark
+}
+
+func asForwarding(e *Entry) *forwardingBin {
+	return (*forwardingBin)(unsafe.Pointer(e))
+}
+
+func newForwardingBin(table []unsafe.Pointer, index int, oldCapacity int) *forwardingBin {
+	fb := &forwardingBin{table: table, index: uint32(index), oldCapacity: uint32(oldCapacity)}
+	fb.next = forwardingMark
+	return fb
+}
+
+//pointer returns the value stored into the table slot for this bin
+func (this *forwardingBin) pointer() unsafe.Pointer {
+	return unsafe.Pointer(&this.Entry)
+}
+
+//bin returns the first entry of the bin for hash in the next table
+func (this *forwardingBin) bin(hash uint32) *Entry {
+	return (*Entry)(atomic.LoadPointer(&this.table[hash&uint32(len(this.table)-1)]))
+}
+
+//forEachBin calls f with the first entries of the bins the bin was split into
+func (this *forwardingBin) forEachBin(f func(first *Entry)) {
+	for i := this.index; i < uint32(len(this.table)); i += this.oldCapacity {
+		f(this.bin(i))
+	}
+}
+
+/**
+* Moves up to stride bins to nextTable if the table is being doubled, and
+* publishes nextTable once all bins are moved.
+* Call only while holding lock.
+*/
+func (this *Segment) transfer(stride int) {
+	if this.nextTable == nil {
+		return
+	}
+	tab := this.writableTable()
+	for ; stride > 0 && this.transferIndex > 0; stride-- {
+		this.transferIndex--
+		i := this.transferIndex
+		transferBin(tab, i, this.nextTable)
+		atomic.StorePointer(&tab[i], newForwardingBin(this.nextTable, i, len(tab)).pointer())
+	}
+	if this.transferIndex == 0 {
+		this.publishTable(this.nextTable)
+		this.nextTable = nil
+		this.rehashes++
+	}
+}
+
+/**
+* Moves all remaining bins, so the table is no longer being doubled.
+* Call only while holding lock.
+*/
+func (this *Segment) finishTransfer() {
+	if this.nextTable != nil {
+		this.transfer(this.transferIndex)
+	}
+}
+
+/**
+* Returns the table and the index of the bin of hash for a write, in
+* nextTable if the bin was already moved. The table was returned by
+* writableTable.
+* Call only while holding lock.
+*/
+func (this *Segment) writableBin(hash uint32) (tab []unsafe.Pointer, index uint32) {
+	tab = this.writableTable()
+	index = hash & uint32(len(tab)-1)
+	if isForwarding((*Entry)(tab[index])) {
+		tab = this.nextTable
+		index = hash & uint32(len(tab)-1)
+	}
+	return
+}
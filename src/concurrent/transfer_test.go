@@ -0,0 +1,180 @@
+package concurrent
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIncrementalRehash(t *testing.T) {
+	m := NewConcurrentMap(INCREMENTAL_REHASH_CAPACITY, float32(0.75), 1)
+	s := m.segmentList()[0]
+	threshold := int(s.threshold)
+	for i := 0; i <= threshold; i++ {
+		m.Put(i, i)
+	}
+	if s.nextTable != nil {
+		t.Fatalf("table is doubled before crossing threshold")
+	}
+
+	//the put that crosses threshold moves only one stride of bins
+	m.Put(-1, -1)
+	if s.nextTable == nil || s.transferIndex != INCREMENTAL_REHASH_CAPACITY-TRANSFER_STRIDE {
+		t.Fatalf("nextTable %v, transferIndex %v after crossing threshold", len(s.nextTable), s.transferIndex)
+	}
+	if s.rehashes != 0 || len(s.table()) != INCREMENTAL_REHASH_CAPACITY {
+		t.Errorf("table was replaced before all bins were moved")
+	}
+
+	//writes to moved and not yet moved bins, fewer than it takes to move all bins
+	want := map[interface{}]interface{}{-1: -1}
+	for i := 0; i <= threshold; i++ {
+		want[i] = i
+	}
+	for i := 0; i <= threshold; i += 40 {
+		m.Remove(i)
+		delete(want, i)
+	}
+	for i := 1; i <= threshold; i += 40 {
+		m.Put(i, -i)
+		want[i] = -i
+	}
+	if s.nextTable == nil {
+		t.Fatalf("transfer finished too early, transferIndex %v", s.transferIndex)
+	}
+
+	check := func(when string) {
+		if int(m.Size()) != len(want) {
+			t.Errorf("%v: Size %v, want %v", when, m.Size(), len(want))
+		}
+		for k, v := range want {
+			if got, ok := m.Get(k); !ok || got != v {
+				t.Errorf("%v: Get(%v) return %v, %v, want %v", when, k, got, ok, v)
+			}
+		}
+		n := 0
+		for it := m.Iterator(); it.HasNext(); {
+			k, v, _ := it.Next()
+			if want[k] != v {
+				t.Errorf("%v: iterator return %v=%v, want %v", when, k, v, want[k])
+			}
+			n++
+		}
+		if n != len(want) {
+			t.Errorf("%v: iterator return %v entries, want %v", when, n, len(want))
+		}
+		if total := m.Stats().Total(); total.Count != int64(len(want)) {
+			t.Errorf("%v: Stats count %v, want %v", when, total.Count, len(want))
+		}
+	}
+	check("during transfer")
+
+	//a snapshot finishes the transfer
+	snap := m.Snapshot()
+	if s.nextTable != nil || s.rehashes != 1 || len(s.table()) != 2*INCREMENTAL_REHASH_CAPACITY {
+		t.Errorf("Snapshot did not finish the transfer")
+	}
+	check("after transfer")
+	if snap.Size() != len(want) || !snap.ContainsKey(-1) {
+		t.Errorf("snapshot has %v entries, want %v", snap.Size(), len(want))
+	}
+}
+
+func TestReserveTransfersOnce(t *testing.T) {
+	m := NewConcurrentMap(INCREMENTAL_REHASH_CAPACITY, float32(0.75), 1)
+	s := m.segmentList()[0]
+	n := 6 * INCREMENTAL_REHASH_CAPACITY
+	batch := make(map[interface{}]interface{}, n)
+	for i := 0; i < n; i++ {
+		batch[i] = i
+	}
+	m.PutAll(batch)
+
+	//the table grows to 8 times its size in one transfer, not three
+	if s.rehashes != 1 || s.nextTable != nil || len(s.table()) != 8*INCREMENTAL_REHASH_CAPACITY {
+		t.Errorf("%v rehashes to %v bins, want 1 to %v", s.rehashes, len(s.table()), 8*INCREMENTAL_REHASH_CAPACITY)
+	}
+	if int(m.Size()) != n {
+		t.Errorf("Size %v, want %v", m.Size(), n)
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("Get(%v) return %v, %v", i, v, ok)
+		}
+	}
+
+	//bins moved to a table 8 times larger are split into 8 bins
+	m = NewConcurrentMap(INCREMENTAL_REHASH_CAPACITY, float32(0.75), 1)
+	s = m.segmentList()[0]
+	for i := 0; i < 700; i++ {
+		m.Put(i, i)
+	}
+	s.lock.Lock()
+	s.reserve(5000)
+	s.lock.Unlock()
+	m.Put(-1, -1)
+	if len(s.nextTable) != 8*INCREMENTAL_REHASH_CAPACITY || s.transferIndex != INCREMENTAL_REHASH_CAPACITY-TRANSFER_STRIDE {
+		t.Fatalf("nextTable %v, transferIndex %v after reserve", len(s.nextTable), s.transferIndex)
+	}
+	count := 0
+	for it := m.Iterator(); it.HasNext(); {
+		k, v, _ := it.Next()
+		if k != v {
+			t.Errorf("iterator return %v=%v during transfer", k, v)
+		}
+		count++
+	}
+	if count != 701 {
+		t.Errorf("iterator return %v entries during transfer, want 701", count)
+	}
+	for i := -1; i < 700; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("Get(%v) return %v, %v during transfer", i, v, ok)
+		}
+	}
+}
+
+func TestIncrementalRehashConcurrentReads(t *testing.T) {
+	m := NewConcurrentMap(INCREMENTAL_REHASH_CAPACITY, float32(0.75), 1)
+	n := 1000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+
+	var stop int32
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				for i := 0; i < n; i += 7 {
+					if v, ok := m.Get(i); !ok || v != i {
+						t.Errorf("Get(%v) return %v, %v during transfer", i, v, ok)
+						return
+					}
+				}
+			}
+		}()
+	}
+	//grows the table from 1024 to 16384 bins, removing every inserted key
+	//again in every second round so that writes hit moved bins
+	for i := n; i < 12*INCREMENTAL_REHASH_CAPACITY; i++ {
+		m.Put(i, i)
+		if i%2 == 0 {
+			m.Remove(i)
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	s := m.segmentList()[0]
+	if s.rehashes+int64(len(s.nextTable)) == 0 {
+		t.Errorf("table was never doubled")
+	}
+	for i := 0; i < 12*INCREMENTAL_REHASH_CAPACITY; i++ {
+		if v, ok := m.Get(i); ok != (i < n || i%2 != 0) || ok && v != i {
+			t.Fatalf("Get(%v) return %v, %v", i, v, ok)
+		}
+	}
+}
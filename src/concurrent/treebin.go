@@ -0,0 +1,410 @@
+package concurrent
+
+import (
+	"sort"
+	"unsafe"
+)
+
+/* ---------------- Tree bins -------------- */
+
+/*
+* A bin whose chain grows to TREEIFY_THRESHOLD entries is converted to a
+* treeBin, a balanced tree ordered by hash code, like the TreeBin of Java 8's
+* ConcurrentHashMap. Keys with the same hash code are ordered by their value
+* if they are integers, floats or strings, like Java breaks ties with
+* compareComparables, so even keys whose full hash codes collide are found
+* in O(log n). Other keys that share a hash code, Hashable keys among them,
+* hang off one tree node as a plain chain linked through Entry.next, and are
+* still searched linearly.
+*
+* Lock-free readers are kept safe the same way as for chains: a published
+* treeBin and its nodes are never modified. Writers holding the segment lock
+* build a new treeBin that shares all untouched nodes with the old one
+* (path copying), then store it into the table. Entry values are still
+* updated in place with storeValue, so a value change never copies the tree,
+* unless the entry is held by a Snapshot, see Segment.setValue.
+*
+* The table slot of a tree bin points to the Entry embedded at the start of
+* the treeBin. Its next field is treeBinMark, so a reader can tell a tree bin
+* from a chain with one pointer comparison, as Java tests for hash == TREEBIN.
+ */
+
+//treeBinMark is the next field of the Entry that heads a tree bin
+var treeBinMark = &Entry{}
+
+type treeBin struct {
+	Entry // must be the first field, the table slot points to it
+	root  *treeNode
+	size  int32
+}
+
+type treeNode struct {
+	hash        uint32
+	entries     *Entry //entries with this hash, linked through next
+	left, right *treeNode
+	height      int32
+}
+
+//isTreeBin returns true if e is the head of a tree bin
+func isTreeBin(e *Entry) bool {
+	return e != nil && e.next == treeBinMark
+}
+
+func asTreeBin(e *Entry) *treeBin {
+	return (*treeBin)(unsafe.Pointer(e))
+}
+
+func newTreeBin(root *treeNode, size int32) *treeBin {
+	tb := &treeBin{root: root, size: size}
+	tb.next = treeBinMark
+	return tb
+}
+
+//pointer returns the value stored into the table slot for this bin
+func (this *treeBin) pointer() unsafe.Pointer {
+	return unsafe.Pointer(&this.Entry)
+}
+
+//find returns the entry for key, or nil
+func (this *treeBin) find(key interface{}, hash uint32) *Entry {
+	n := this.root
+	for n != nil {
+		if c := n.compare(hash, key); c < 0 {
+			n = n.left
+		} else if c > 0 {
+			n = n.right
+		} else {
+			for e := n.entries; e != nil; e = e.next {
+				if equals(e.key, key) {
+					return e
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+//put returns a new treeBin that also holds e, e must not be in this bin yet
+func (this *treeBin) put(e *Entry) *treeBin {
+	return newTreeBin(insertTreeNode(this.root, e), this.size+1)
+}
+
+//remove returns a new treeBin without e
+func (this *treeBin) remove(e *Entry) *treeBin {
+	return newTreeBin(removeTreeNode(this.root, e), this.size-1)
+}
+
+//forEach calls f for all entries of the bin in hash order
+func (this *treeBin) forEach(f func(e *Entry)) {
+	forEachTreeNode(this.root, f)
+}
+
+func forEachTreeNode(n *treeNode, f func(e *Entry)) {
+	for n != nil {
+		forEachTreeNode(n.left, f)
+		for e := n.entries; e != nil; e = e.next {
+			f(e)
+		}
+		n = n.right
+	}
+}
+
+/*
+* Ties of keys with the same hash code: keys of the same class are ordered
+* by their value, classes are ordered by their number.
+ */
+const (
+	tieNone   = iota //keys that are not ordered, they share one tree node
+	tieInt           //signed integers, stored with the sign bit flipped
+	tieUint          //unsigned integers
+	tieFloat         //floats except NaN, -0 and +0 are the same key
+	tieString        //strings
+)
+
+//tieOf returns the class and the value by which key is ordered among keys with the same hash code
+func tieOf(key interface{}) (class int, n uint64, f float64, s string) {
+	switch k := key.(type) {
+	case int:
+		return tieInt, uint64(k) ^ 1<<63, 0, ""
+	case int8:
+		return tieInt, uint64(k) ^ 1<<63, 0, ""
+	case int16:
+		return tieInt, uint64(k) ^ 1<<63, 0, ""
+	case int32:
+		return tieInt, uint64(k) ^ 1<<63, 0, ""
+	case int64:
+		return tieInt, uint64(k) ^ 1<<63, 0, ""
+	case uint:
+		return tieUint, uint64(k), 0, ""
+	case uint8:
+		return tieUint, uint64(k), 0, ""
+	case uint16:
+		return tieUint, uint64(k), 0, ""
+	case uint32:
+		return tieUint, uint64(k), 0, ""
+	case uint64:
+		return tieUint, k, 0, ""
+	case uintptr:
+		return tieUint, uint64(k), 0, ""
+	case float32:
+		if k == k {
+			return tieFloat, 0, float64(k), ""
+		}
+	case float64:
+		if k == k {
+			return tieFloat, 0, k, ""
+		}
+	case string:
+		return tieString, 0, 0, k
+	}
+	return tieNone, 0, 0, ""
+}
+
+//compareKeys orders two keys with the same hash code, keys that are
+//equal always compare as 0
+func compareKeys(k1, k2 interface{}) int {
+	c1, n1, f1, s1 := tieOf(k1)
+	c2, n2, f2, s2 := tieOf(k2)
+	switch {
+	case c1 != c2:
+		return c1 - c2
+	case n1 != n2:
+		if n1 < n2 {
+			return -1
+		}
+		return 1
+	case f1 != f2:
+		if f1 < f2 {
+			return -1
+		}
+		return 1
+	case s1 != s2:
+		if s1 < s2 {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+//compare orders the key with the given hash code against the keys of n
+func (this *treeNode) compare(hash uint32, key interface{}) int {
+	if hash < this.hash {
+		return -1
+	} else if hash > this.hash {
+		return 1
+	}
+	return compareKeys(key, this.entries.key)
+}
+
+func treeHeight(n *treeNode) int32 {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func newTreeNode(hash uint32, entries *Entry, left, right *treeNode) *treeNode {
+	h := treeHeight(left)
+	if hr := treeHeight(right); hr > h {
+		h = hr
+	}
+	return &treeNode{hash, entries, left, right, h + 1}
+}
+
+//balanceTreeNode creates a node from the given parts, rotating once or
+//twice if the heights of left and right differ by more than one
+func balanceTreeNode(hash uint32, entries *Entry, left, right *treeNode) *treeNode {
+	hl, hr := treeHeight(left), treeHeight(right)
+	if hl > hr+1 {
+		if treeHeight(left.left) >= treeHeight(left.right) {
+			return newTreeNode(left.hash, left.entries, left.left,
+				newTreeNode(hash, entries, left.right, right))
+		}
+		lr := left.right
+		return newTreeNode(lr.hash, lr.entries,
+			newTreeNode(left.hash, left.entries, left.left, lr.left),
+			newTreeNode(hash, entries, lr.right, right))
+	}
+	if hr > hl+1 {
+		if treeHeight(right.right) >= treeHeight(right.left) {
+			return newTreeNode(right.hash, right.entries,
+				newTreeNode(hash, entries, left, right.left), right.right)
+		}
+		rl := right.left
+		return newTreeNode(rl.hash, rl.entries,
+			newTreeNode(hash, entries, left, rl.left),
+			newTreeNode(right.hash, right.entries, rl.right, right.right))
+	}
+	return newTreeNode(hash, entries, left, right)
+}
+
+func insertTreeNode(n *treeNode, e *Entry) *treeNode {
+	if n == nil {
+		e.next = nil
+		return newTreeNode(e.hash, e, nil, nil)
+	}
+	if c := n.compare(e.hash, e.key); c < 0 {
+		return balanceTreeNode(n.hash, n.entries, insertTreeNode(n.left, e), n.right)
+	} else if c > 0 {
+		return balanceTreeNode(n.hash, n.entries, n.left, insertTreeNode(n.right, e))
+	}
+	e.next = n.entries
+	return &treeNode{n.hash, e, n.left, n.right, n.height}
+}
+
+func removeTreeNode(n *treeNode, e *Entry) *treeNode {
+	if n == nil {
+		return nil
+	}
+	if c := n.compare(e.hash, e.key); c < 0 {
+		return balanceTreeNode(n.hash, n.entries, removeTreeNode(n.left, e), n.right)
+	} else if c > 0 {
+		return balanceTreeNode(n.hash, n.entries, n.left, removeTreeNode(n.right, e))
+	}
+
+	// Entries following e can stay in the chain, preceding ones are cloned
+	entries := e.next
+	for p := n.entries; p != e; p = p.next {
+		entries = &Entry{p.key, p.hash, p.gen, p.value, entries}
+	}
+	if entries != nil {
+		return &treeNode{n.hash, entries, n.left, n.right, n.height}
+	}
+
+	if n.left == nil {
+		return n.right
+	} else if n.right == nil {
+		return n.left
+	}
+	min := n.right
+	for min.left != nil {
+		min = min.left
+	}
+	return balanceTreeNode(min.hash, min.entries, n.left, removeMinTreeNode(n.right))
+}
+
+func removeMinTreeNode(n *treeNode) *treeNode {
+	if n.left == nil {
+		return n.right
+	}
+	return balanceTreeNode(n.hash, n.entries, removeMinTreeNode(n.left), n.right)
+}
+
+//compareEntries orders entries like the nodes of a tree bin
+func compareEntries(e1, e2 *Entry) int {
+	if e1.hash != e2.hash {
+		if e1.hash < e2.hash {
+			return -1
+		}
+		return 1
+	}
+	return compareKeys(e1.key, e2.key)
+}
+
+//buildTreeNode builds a balanced tree from entries sorted by compareEntries,
+//entries that compare equal are cloned into one chain
+func buildTreeNode(sorted []*Entry) *treeNode {
+	if len(sorted) == 0 {
+		return nil
+	}
+	mid := len(sorted) / 2
+	hash := sorted[mid].hash
+	lo, hi := mid, mid+1
+	for lo > 0 && compareEntries(sorted[lo-1], sorted[mid]) == 0 {
+		lo--
+	}
+	for hi < len(sorted) && compareEntries(sorted[hi], sorted[mid]) == 0 {
+		hi++
+	}
+	var entries *Entry
+	for i := hi - 1; i >= lo; i-- {
+		p := sorted[i]
+		entries = &Entry{p.key, p.hash, p.gen, p.value, entries}
+	}
+	return newTreeNode(hash, entries, buildTreeNode(sorted[:lo]), buildTreeNode(sorted[hi:]))
+}
+
+/* ---------------- Bin helpers -------------- */
+
+//the helpers follow forwarding bins into the next table, see forwardingBin
+
+//findInBin returns the entry for key in the bin headed by first, or nil
+func findInBin(first *Entry, key interface{}, hash uint32) *Entry {
+	if isForwarding(first) {
+		return findInBin(asForwarding(first).bin(hash), key, hash)
+	}
+	if isTreeBin(first) {
+		return asTreeBin(first).find(key, hash)
+	}
+	e := first
+	for e != nil && (e.hash != hash || !equals(e.key, key)) {
+		e = e.next
+	}
+	return e
+}
+
+//forEachInBin calls f for all entries in the bin headed by first
+func forEachInBin(first *Entry, f func(e *Entry)) {
+	if isForwarding(first) {
+		asForwarding(first).forEachBin(func(first *Entry) {
+			forEachInBin(first, f)
+		})
+		return
+	}
+	if isTreeBin(first) {
+		asTreeBin(first).forEach(f)
+		return
+	}
+	for e := first; e != nil; e = e.next {
+		f(e)
+	}
+}
+
+//appendBinEntries appends all entries in the bin headed by first to entries
+func appendBinEntries(entries []*Entry, first *Entry) []*Entry {
+	forEachInBin(first, func(e *Entry) {
+		entries = append(entries, e)
+	})
+	return entries
+}
+
+//binSize returns the number of entries in the bin headed by first,
+//counting chains only up to limit
+func binSize(first *Entry, limit int) int {
+	if isForwarding(first) {
+		n := 0
+		asForwarding(first).forEachBin(func(first *Entry) {
+			n += binSize(first, limit-n)
+		})
+		return n
+	}
+	if isTreeBin(first) {
+		return int(asTreeBin(first).size)
+	}
+	n := 0
+	for e := first; e != nil && n < limit; e = e.next {
+		n++
+	}
+	return n
+}
+
+//buildBin returns a new bin holding clones of entries, a tree bin
+//if there are at least TREEIFY_THRESHOLD of them, else a chain
+func buildBin(entries []*Entry) unsafe.Pointer {
+	if len(entries) >= TREEIFY_THRESHOLD {
+		sorted := make([]*Entry, len(entries))
+		copy(sorted, entries)
+		sort.Slice(sorted, func(i, j int) bool {
+			return compareEntries(sorted[i], sorted[j]) < 0
+		})
+		return newTreeBin(buildTreeNode(sorted), int32(len(sorted))).pointer()
+	}
+	var first *Entry
+	for i := len(entries) - 1; i >= 0; i-- {
+		p := entries[i]
+		first = &Entry{p.key, p.hash, p.gen, p.value, first}
+	}
+	return unsafe.Pointer(first)
+}
@@ -0,0 +1,195 @@
+package concurrent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ---------------- Expiry -------------- */
+
+/*
+* An entry can be given a time to live with PutWithTTL, and WithDefaultTTL
+* gives one to every value written by the other methods. The deadline is
+* kept with the value in its valueCell, so a write replaces value and
+* deadline with one atomic store and a reader never sees the value of one
+* write with the deadline of another. Every write sets a new deadline, a
+* value written without a TTL and without a default TTL never expires.
+*
+* Once its deadline has passed an entry is invisible: Get, ContainsKey,
+* MapIterator, the bulk operations, ContainsValue, Snapshot and the
+* serialization methods skip it, and the methods that write treat its key as
+* absent. It still holds memory and is still counted by Size until it is
+* removed, by a write to its key, by RemoveExpired, or by the janitor that
+* WithJanitor starts to call RemoveExpired periodically. Close stops the
+* janitor.
+ */
+
+/**
+* The value of an entry with its deadline. A cell is never modified once
+* it is published, writes replace the cell, see Entry.storeValue.
+*/
+type valueCell struct {
+	v       interface{}
+	expires int64         //deadline in UnixNano, 0 if the value never expires
+	node    *EvictionNode //the node of the entry in a bounded map, see track
+}
+
+//expiredAt returns true if the cell has a deadline that is not after now
+func (this *valueCell) expiredAt(now int64) bool {
+	return this.expires != 0 && this.expires <= now
+}
+
+//expired returns true if the deadline of the cell has passed, the clock is only read for cells with a deadline
+func (this *ConcurrentMap) expired(c *valueCell) bool {
+	return c.expires != 0 && c.expires <= this.nanotime()
+}
+
+//nanotime returns the current time of the map in UnixNano
+func (this *ConcurrentMap) nanotime() int64 {
+	if this.clock != nil {
+		return this.clock()
+	}
+	return time.Now().UnixNano()
+}
+
+//newCell returns the cell of a value written now with the given TTL, ttl <= 0 never expires
+func (this *ConcurrentMap) newCell(v interface{}, ttl time.Duration) *valueCell {
+	c := &valueCell{v: v}
+	if ttl > 0 {
+		c.expires = this.nanotime() + int64(ttl)
+		if atomic.LoadInt32(&this.expiring) == 0 {
+			atomic.StoreInt32(&this.expiring, 1)
+		}
+	}
+	return c
+}
+
+/**
+* Maps the key to the value like Put, but the mapping expires after ttl.
+* A ttl of 0 or less means the mapping never expires, even if the map has
+* a default TTL.
+*
+* @return the previous value associated with key, or nil if there was no
+*         mapping for key or it has expired
+*/
+func (this *ConcurrentMap) PutWithTTL(key interface{}, value interface{}, ttl time.Duration) (oldVal interface{}, err error) {
+	if isNil(key) {
+		return nil, NilKeyError
+	}
+	if isNil(value) {
+		return nil, NilValueError
+	}
+	if ttl <= 0 {
+		ttl = noTTL
+	}
+	hash, err := hashKey(key, this)
+	if err != nil {
+		return nil, err
+	}
+	return this.segmentFor(hash).put(key, hash, value, ttl, false), nil
+}
+
+//noTTL is passed by PutWithTTL to Segment.put for a value that never expires, unlike 0 it overrides the default TTL
+const noTTL time.Duration = -1
+
+/**
+* Removes all entries whose deadline has passed, locking one segment at a
+* time. The janitor started by WithJanitor calls it periodically.
+*
+* @return the number of removed entries
+*/
+func (this *ConcurrentMap) RemoveExpired() int64 {
+	if atomic.LoadInt32(&this.expiring) == 0 {
+		return 0
+	}
+	this.resegmentLock.Lock()
+	defer this.resegmentLock.Unlock()
+	var n int64
+	for _, s := range this.segmentList() {
+		n += s.removeExpired()
+	}
+	return n
+}
+
+/**
+* Removes the expired entries of the segment under its lock.
+*/
+func (this *Segment) removeExpired() (n int64) {
+	if atomic.LoadInt64(&this.count) == 0 {
+		return 0
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.m.nanotime()
+	var expired []*Entry
+	tab := this.loadTable()
+	for i := 0; i < len(tab); i++ {
+		forEachInBin((*Entry)(tab[i]), func(e *Entry) {
+			if (*valueCell)(e.value).expiredAt(now) {
+				expired = append(expired, e)
+			}
+		})
+	}
+	if len(expired) == 0 {
+		return 0
+	}
+
+	for _, e := range expired {
+		tab, index := this.writableBin(e.hash)
+		//unlinking may have replaced the entries before e, find e again by its key
+		first := (*Entry)(tab[index])
+		if e = findInBin(first, e.key, e.hash); e != nil {
+			this.unlinkEntry(tab, index, first, e)
+			this.m.counter.add(e.hash, -1)
+			this.m.emit(EventExpire, e.key, e.hash, e.fastValue(), nil)
+			n++
+		}
+	}
+	atomic.AddInt64(&this.modCount, 1)
+	atomic.StoreInt64(&this.count, this.count-n)
+	this.shrinkIfNeeded()
+	return
+}
+
+/**
+* The janitor goroutine started by WithJanitor.
+*/
+type janitor struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (this *ConcurrentMap) startJanitor(interval time.Duration) {
+	j := &janitor{stop: make(chan struct{}), done: make(chan struct{})}
+	this.janitor = j
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				this.RemoveExpired()
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+/**
+* Close stops the janitor started by WithJanitor and waits until it has
+* stopped. The map stays usable, expired entries are only no longer
+* removed in the background. Close can be called more than once, it
+* implements io.Closer and always returns nil.
+*/
+func (this *ConcurrentMap) Close() error {
+	if j := this.janitor; j != nil {
+		j.stopOnce.Do(func() { close(j.stop) })
+		<-j.done
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package concurrent
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//fakeClock is a clock for tests that only moves when advanced
+type fakeClock struct {
+	now int64
+}
+
+func (this *fakeClock) nanotime() int64 {
+	return atomic.LoadInt64(&this.now)
+}
+
+func (this *fakeClock) advance(d time.Duration) {
+	atomic.AddInt64(&this.now, int64(d))
+}
+
+func withClock(c *fakeClock) Option {
+	return func(o *mapOptions) error {
+		o.clock = c.nanotime
+		return nil
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	clock := &fakeClock{now: 1}
+	m, _ := New(withClock(clock))
+	m.PutWithTTL("short", 1, time.Second)
+	m.PutWithTTL("long", 2, time.Minute)
+	m.Put("forever", 3)
+
+	clock.advance(2 * time.Second)
+	if v, ok := m.Get("short"); ok {
+		t.Errorf("Get expired key, return %v, %v", v, ok)
+	}
+	if found, _ := m.ContainsKey("short"); found {
+		t.Errorf("ContainsKey of expired key return true")
+	}
+	if found, _ := m.ContainsValue(1); found {
+		t.Errorf("ContainsValue of expired value return true")
+	}
+	if v, ok := m.Get("long"); !ok || v != 2 {
+		t.Errorf("Get live key, return %v, %v", v, ok)
+	}
+	keys := map[interface{}]bool{}
+	for itr := m.Iterator(); itr.HasNext(); {
+		k, _, _ := itr.Next()
+		keys[k] = true
+	}
+	if len(keys) != 2 || !keys["long"] || !keys["forever"] {
+		t.Errorf("Iterator return keys %v, want long and forever", keys)
+	}
+	n := 0
+	m.ForEach(1, func(key, value interface{}) { n++ })
+	if n != 2 {
+		t.Errorf("ForEach visit %v entries, want 2", n)
+	}
+	if s := m.Size(); s != 3 {
+		t.Errorf("Size before RemoveExpired %v, want 3", s)
+	}
+
+	//writes treat an expired key as absent
+	if old, err := m.PutIfAbsent("short", 4); old != nil || err != nil {
+		t.Errorf("PutIfAbsent of expired key, return %v, %v", old, err)
+	}
+	if v, _ := m.Get("short"); v != 4 {
+		t.Errorf("Get after PutIfAbsent, return %v, want 4", v)
+	}
+
+	clock.advance(time.Hour)
+	if old, _ := m.Remove("long"); old != nil {
+		t.Errorf("Remove expired key, return %v", old)
+	}
+	if old, _ := m.Replace("long", 5); old != nil {
+		t.Errorf("Replace expired key, return %v", old)
+	}
+	if s := m.Size(); s != 2 {
+		t.Errorf("Size %v, want 2", s)
+	}
+	if n := m.RemoveExpired(); n != 0 {
+		t.Errorf("RemoveExpired return %v, want 0", n)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	clock := &fakeClock{now: 1}
+	m, _ := New(withClock(clock), WithDefaultTTL(time.Second), WithConcurrencyLevel(1))
+	n := 1000
+	for i := 0; i < n; i++ {
+		m.Put(i, i)
+	}
+	m.PutWithTTL("pinned", 1, 0)
+
+	clock.advance(500 * time.Millisecond)
+	//every write sets a new deadline
+	for i := 0; i < 10; i++ {
+		m.Put(i, -i)
+	}
+	m.Update(10, func(oldVal interface{}) interface{} { return oldVal })
+
+	clock.advance(600 * time.Millisecond)
+	if v, ok := m.Get(11); ok {
+		t.Errorf("Get expired key, return %v, %v", v, ok)
+	}
+	if v, ok := m.Get(1); !ok || v != -1 {
+		t.Errorf("Get rewritten key, return %v, %v", v, ok)
+	}
+	if removed := m.RemoveExpired(); removed != int64(n-11) {
+		t.Errorf("RemoveExpired return %v, want %v", removed, n-11)
+	}
+	if s := m.Size(); s != 12 {
+		t.Errorf("Size after RemoveExpired %v, want 12", s)
+	}
+	if v, ok := m.Get("pinned"); !ok || v != 1 {
+		t.Errorf("Get key without TTL, return %v, %v", v, ok)
+	}
+}
+
+func TestSnapshotTTL(t *testing.T) {
+	clock := &fakeClock{now: 1}
+	m, _ := New(withClock(clock))
+	m.PutWithTTL(1, 1, time.Second)
+	m.PutWithTTL(2, 2, time.Minute)
+	m.Put(3, 3)
+
+	clock.advance(2 * time.Second)
+	snap := m.Snapshot()
+	if s := snap.Size(); s != 2 {
+		t.Errorf("snapshot Size %v, want 2", s)
+	}
+	if snap.ContainsKey(1) {
+		t.Errorf("snapshot contains expired key")
+	}
+	if s := len(snap.ToSlice()); s != 2 {
+		t.Errorf("snapshot ToSlice return %v entries, want 2", s)
+	}
+
+	//entries stay in the snapshot after they expire
+	clock.advance(time.Hour)
+	if v, ok := snap.Get(2); !ok || v != 2 {
+		t.Errorf("snapshot Get, return %v, %v", v, ok)
+	}
+	if _, ok := m.Get(2); ok {
+		t.Errorf("Get expired key return true")
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	if _, err := New(WithJanitor(0)); !errors.Is(err, IllegalArgError) {
+		t.Errorf("WithJanitor(0) return %v, want IllegalArgError", err)
+	}
+	if _, err := New(WithDefaultTTL(-1)); !errors.Is(err, IllegalArgError) {
+		t.Errorf("WithDefaultTTL(-1) return %v, want IllegalArgError", err)
+	}
+
+	m, _ := New(WithJanitor(time.Millisecond))
+	for i := 0; i < 100; i++ {
+		m.PutWithTTL(i, i, time.Millisecond)
+	}
+	m.Put("kept", 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Size() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s := m.Size(); s != 1 {
+		t.Errorf("Size after the janitor ran %v, want 1", s)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("Close return %v", err)
+	}
+	m.Close()
+	if v, ok := m.Get("kept"); !ok || v != 1 {
+		t.Errorf("Get after Close, return %v, %v", v, ok)
+	}
+}
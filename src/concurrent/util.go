@@ -1,12 +1,12 @@
 package concurrent
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"fmt"
-	"hash/fnv"
-	"io"
 	"math/rand"
 	"reflect"
-	"sync/atomic"
+	"sync"
 	"unsafe"
 )
 
@@ -17,248 +17,180 @@ const (
 )
 
 var (
-	hasherT           = reflect.TypeOf((*Hashable)(nil)).Elem()
+	hashableT         = reflect.TypeOf((*Hashable)(nil)).Elem()
+	bytesHashableT    = reflect.TypeOf((*BytesHashable)(nil)).Elem()
 	defaultEqualsfunc func(k1 interface{}, k2 interface{}) bool
-	hasherEng         *hashEnginer
-	boolEng           *hashEnginer
-	intEng            *hashEnginer
-	int8Eng           *hashEnginer
-	int16Eng          *hashEnginer
-	int32Eng          *hashEnginer
-	int64Eng          *hashEnginer
-	uintEng           *hashEnginer
-	uint8Eng          *hashEnginer
-	uint16Eng         *hashEnginer
-	uint32Eng         *hashEnginer
-	uint64Eng         *hashEnginer
-	uintptrEng        *hashEnginer
-	float32Eng        *hashEnginer
-	float64Eng        *hashEnginer
-	complex64Eng      *hashEnginer
-	complex128Eng     *hashEnginer
-	stringEng         *hashEnginer
-	engM              map[reflect.Kind]*hashEnginer
-)
 
-func init() {
-	hasherEng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			w.Write(k.(Hashable).HashBytes())
-		},
-	}
-	boolEng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(bool)
-			w.Write((*((*[1]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	intEng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(int)
-			w.Write((*((*[intSize]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	int8Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(int8)
-			w.Write((*((*[1]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	int16Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(int16)
-			w.Write((*((*[2]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	int32Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(int32)
-			w.Write((*((*[4]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	int64Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(int64)
-			w.Write((*((*[8]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	uintEng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(uint)
-			w.Write((*((*[intSize]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	uint8Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(uint8)
-			w.Write((*((*[1]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	uint16Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(uint16)
-			w.Write((*((*[2]byte)(unsafe.Pointer(&k1))))[:])
-		},
+	//kinds whose values are encoded directly, see keyPlan
+	scalarKinds = map[reflect.Kind]bool{
+		reflect.Bool:       true,
+		reflect.Int:        true,
+		reflect.Int8:       true,
+		reflect.Int16:      true,
+		reflect.Int32:      true,
+		reflect.Int64:      true,
+		reflect.Uint:       true,
+		reflect.Uint8:      true,
+		reflect.Uint16:     true,
+		reflect.Uint32:     true,
+		reflect.Uint64:     true,
+		reflect.Uintptr:    true,
+		reflect.Float32:    true,
+		reflect.Float64:    true,
+		reflect.Complex64:  true,
+		reflect.Complex128: true,
+		reflect.String:     true,
 	}
-	uint32Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(uint32)
-			w.Write((*((*[4]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	uint64Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(uint64)
-			w.Write((*((*[8]byte)(unsafe.Pointer(&k1))))[:])
-		},
-	}
-	uintptrEng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(uintptr)
-			w.Write((*((*[intSize]byte)(unsafe.Pointer(&k1))))[:])
-		},
+)
+
+const (
+	fnvOffset32 uint32 = 2166136261
+	fnvPrime32  uint32 = 16777619
+)
+
+/*
+* keyHasher is the state of the hash function while hashKey hashes a key.
+* Unlike a hash.Hash32 it is a plain value that stays on the stack of
+* hashKey, so hashing a key does not allocate. FNV-1a is computed inline.
+ */
+type keyHasher struct {
+	sip bool
+	fnv uint32
+	sh  sipHash
+}
+
+//initHasher keys h with the map's seed
+func (this *ConcurrentMap) initHasher(h *keyHasher) {
+	if this.hashAlg == SipHash {
+		h.sip = true
+		h.sh.init(this.seed, mix64(this.seed))
+		return
 	}
-	float32Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(float32)
-			//Nan != Nan, so use a rand number to generate hash code
-			if k1 != k1 {
-				k1 = rand.Float32()
-			}
-			w.Write((*((*[4]byte)(unsafe.Pointer(&k1))))[:])
-		},
+	h.fnv = fnvOffset32
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], this.seed)
+	h.write(seed[:])
+}
+
+func (this *keyHasher) write(p []byte) {
+	if this.sip {
+		this.sh.Write(p)
+		return
 	}
-	float64Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(float64)
-			//Nan != Nan, so use a rand number to generate hash code
-			if k1 != k1 {
-				k1 = rand.Float64()
-			}
-			w.Write((*((*[8]byte)(unsafe.Pointer(&k1))))[:])
-		},
+	h := this.fnv
+	for _, b := range p {
+		h ^= uint32(b)
+		h *= fnvPrime32
 	}
-	complex64Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(complex64)
-			w.Write((*((*[8]byte)(unsafe.Pointer(&k1))))[:])
-		},
+	this.fnv = h
+}
+
+//writeString writes the bytes of s without copying them
+func (this *keyHasher) writeString(s string) {
+	if this.sip {
+		this.sh.Write(unsafe.Slice(unsafe.StringData(s), len(s)))
+		return
 	}
-	complex128Eng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(complex128)
-			w.Write((*((*[128]byte)(unsafe.Pointer(&k1))))[:])
-		},
+	h := this.fnv
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= fnvPrime32
 	}
-	stringEng = &hashEnginer{
-		putFunc: func(w io.Writer, k interface{}) {
-			k1 := k.(string)
-			w.Write([]byte(k1))
-		},
+	this.fnv = h
+}
+
+func (this *keyHasher) sum32() uint32 {
+	if this.sip {
+		return this.sh.Sum32()
 	}
-	engM = map[reflect.Kind]*hashEnginer{
-		reflect.Bool:       boolEng,
-		reflect.Int:        intEng,
-		reflect.Int8:       int8Eng,
-		reflect.Int16:      int16Eng,
-		reflect.Int32:      int32Eng,
-		reflect.Int64:      int64Eng,
-		reflect.Uint:       uintEng,
-		reflect.Uint8:      uint8Eng,
-		reflect.Uint16:     uint16Eng,
-		reflect.Uint32:     uint32Eng,
-		reflect.Uint64:     uint64Eng,
-		reflect.Uintptr:    uintptrEng,
-		reflect.Float32:    float32Eng,
-		reflect.Float64:    float64Eng,
-		reflect.Complex64:  complex64Eng,
-		reflect.Complex128: complex128Eng,
-		reflect.String:     stringEng,
+	return this.fnv
+}
+
+//randomSeed draws a hash seed from crypto/rand
+func randomSeed() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return uint64(rand.Int63())<<1 ^ uint64(rand.Int63())
 	}
+	return binary.LittleEndian.Uint64(b[:])
 }
 
-func hashKey(key interface{}, m *ConcurrentMap, isRead bool) (hashCode uint32, err error) {
-	h := fnv.New32a()
+//mix64 is the splitmix64 finalizer, used to derive further key material from a seed
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
 
+func hashKey(key interface{}, m *ConcurrentMap) (hashCode uint32, err error) {
+	var h keyHasher
+	m.initHasher(&h)
+	if s, ok := key.(string); ok {
+		h.writeString(s)
+	} else {
+		//the encoding of most keys fits in scratch, so it stays on the stack
+		var scratch [64]byte
+		var buf []byte
+		if buf, err = appendKey(scratch[:0], key); err != nil {
+			return
+		}
+		h.write(buf)
+	}
+	hashCode = h.sum32()
+	return
+}
+
+//appendKey appends the canonical encoding of key to buf, see encoding.go
+func appendKey(buf []byte, key interface{}) ([]byte, error) {
 	switch v := key.(type) {
 	case bool:
-		h.Write((*((*[1]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendBool(buf, v)
 	case int:
-		h.Write((*((*[intSize]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case int8:
-		h.Write((*((*[1]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case int16:
-		h.Write((*((*[2]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case int32:
-		h.Write((*((*[4]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case int64:
-		h.Write((*((*[8]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case uint:
-		h.Write((*((*[intSize]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case uint8:
-		h.Write((*((*[1]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case uint16:
-		h.Write((*((*[2]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case uint32:
-		h.Write((*((*[4]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case uint64:
-		h.Write((*((*[8]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, v)
 	case uintptr:
-		h.Write((*((*[intSize]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, uint64(v))
 	case float32:
-		//Nan != Nan, so use a rand number to generate hash code
-		if v != v {
-			v = rand.Float32()
-		}
-		h.Write((*((*[4]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, canonicalFloat64(float64(v)))
 	case float64:
-		//Nan != Nan, so use a rand number to generate hash code
-		if v != v {
-			v = rand.Float64()
-		}
-		h.Write((*((*[8]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendUint64(buf, canonicalFloat64(v))
 	case complex64:
-		h.Write((*((*[8]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendComplex128(buf, complex128(v))
 	case complex128:
-		h.Write((*((*[128]byte)(unsafe.Pointer(&v))))[:])
-		hashCode = h.Sum32()
+		buf = appendComplex128(buf, v)
 	case string:
-		h.Write([]byte(v))
-		hashCode = h.Sum32()
+		buf = append(buf, v...)
 	default:
 		//if key is not simple type
-		if her, ok := key.(Hashable); ok {
-			h.Write(her.HashBytes())
+		if ownsHash(key) {
+			buf = appendHashable(buf, key, false)
 		} else {
-			if err = m.parseKey(key); err != nil {
-				return
+			eng, err := engineFor(reflect.TypeOf(key))
+			if err != nil {
+				return buf, err
 			}
-			if isRead {
-				eng := (*hashEnginer)(atomic.LoadPointer(&m.eng))
-				eng.putFunc(h, key)
-			} else {
-				eng := (*hashEnginer)(m.eng)
-				eng.putFunc(h, key)
-			}
-			hashCode = h.Sum32()
+			buf = eng.plan.appendKey(buf, (*emptyInterface)(unsafe.Pointer(&key)).word)
 		}
 	}
-	return
+	return buf, nil
 }
 
 ////hash a interface using FNVa
@@ -438,19 +370,47 @@ func isNil(v interface{}) bool {
 	}
 }
 
-//// emptyInterface is the header for an interface{} value.
-//type emptyInterface struct {
-//	typ  uintptr
-//	word unsafe.Pointer
-//}
+// emptyInterface is the header for an interface{} value.
+type emptyInterface struct {
+	typ  uintptr
+	word unsafe.Pointer
+}
+
+/*
+* engines caches the hashEnginer of every key type that is not handled by the
+* type switch of appendKey, so the keys of one map can have any mix of types.
+* The cache is shared by all maps, because an engine only depends on the type.
+* Types that cannot be keys are cached with a nil engine.
+ */
+var engines sync.Map //reflect.Type -> *hashEnginer
+
+//engineFor returns the engine that encodes keys of type t, or NonSupportKey
+func engineFor(t reflect.Type) (eng *hashEnginer, err error) {
+	if e, ok := engines.Load(t); ok {
+		if eng = e.(*hashEnginer); eng == nil {
+			err = NonSupportKey
+		}
+		return
+	}
+
+	if ki, e := getKeyInfo(t); e != nil {
+		err = e
+	} else {
+		eng = &hashEnginer{plan: compileKeyPlan(ki)}
+	}
+	engines.Store(t, eng)
+	return
+}
 
 type keyInfo struct {
 	isHasher bool
+	/*-- key type --*/
+	typ reflect.Type
 	/*-- kind of key type --*/
 	kind reflect.Kind
 	/*-- index of field if it is a field of struct --*/
-	index []int
-	/*-- field informations of struct --*/
+	index int
+	/*-- exported fields of struct --*/
 	fields []*keyInfo
 	/*-- element information of array --*/
 	elementInfo *keyInfo
@@ -459,112 +419,69 @@ type keyInfo struct {
 
 //获取t对应的类型信息，不支持slice, function, map, pointer, interface, channel
 func getKeyInfo(t reflect.Type) (ki *keyInfo, err error) {
-	return getKeyInfoByParent(t, nil, make([]int, 0, 0))
-}
-
-//获取t对应的类型信息，不支持slice, function, map, pointer, interface, channel
-//如果parentIdx的长度>0，则表示t是strut中的字段的类型信息, t为字段对应的类型
-func getKeyInfoByParent(t reflect.Type, parent *keyInfo, parentIdx []int) (ki *keyInfo, err error) {
-	ki = &keyInfo{}
+	ki = &keyInfo{typ: t}
 	//判断是否实现了hasher接口
-	if t.Implements(hasherT) {
+	if t.Implements(hashableT) || t.Implements(bytesHashableT) {
 		ki.isHasher = true
 		return
 	}
 	ki.kind = t.Kind()
 
-	if _, ok := engM[ki.kind]; ok {
+	if scalarKinds[ki.kind] {
 		//简单类型，不需要再分解元素类型的信息
-		ki.index = parentIdx
-	} else {
-		//some types can be used as key, we can use equals to test
-		switch ki.kind {
-		case reflect.Chan, reflect.Slice, reflect.Func, reflect.Map, reflect.Ptr, reflect.Interface:
-			err = NonSupportKey
-		case reflect.Struct:
-			if parent == nil {
-				//parent==nil表示t不是一个嵌套的struct，所以这里需要初始化fields
-				parent = ki
-				ki.fields = make([]*keyInfo, 0, t.NumField())
-			}
-			for i := 0; i < t.NumField(); i++ {
-				f := t.Field(i)
-				//skip unexported field,
-				if len(f.PkgPath) > 0 {
-					continue
-				}
-
-				idx := make([]int, len(parentIdx), len(parentIdx)+1)
-				copy(idx, parentIdx)
-				idx = append(idx, i)
-				if fi, e := getKeyInfoByParent(f.Type, parent, idx); e != nil {
-					err = e
-					return
-				} else {
-					//fi.index = i
-					parent.fields = append(ki.fields, fi)
-				}
+		return
+	}
+	//some types can be used as key, we can use equals to test
+	switch ki.kind {
+	case reflect.Chan, reflect.Slice, reflect.Func, reflect.Map, reflect.Ptr, reflect.Interface, reflect.UnsafePointer:
+		err = NonSupportKey
+	case reflect.Struct:
+		ki.fields = make([]*keyInfo, 0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			//skip unexported field,
+			if len(f.PkgPath) > 0 {
+				continue
 			}
-		case reflect.Array:
-			if ki.elementInfo, err = getKeyInfo(t.Elem()); err != nil {
-				return
+			fi, e := getKeyInfo(f.Type)
+			if e != nil {
+				return nil, e
 			}
-			ki.size = t.Len()
-			ki.index = parentIdx
+			fi.index = i
+			ki.fields = append(ki.fields, fi)
 		}
+	case reflect.Array:
+		if ki.elementInfo, err = getKeyInfo(t.Elem()); err != nil {
+			return
+		}
+		ki.size = t.Len()
 	}
-
 	return
-
 }
 
-func getPutFunc(ki *keyInfo) func(w io.Writer, k interface{}) {
-	if ki.isHasher {
-		return hasherEng.putFunc
-	}
-
-	//Printf("getPutFunc, ki = %v\n", ki)
-	if eng, ok := engM[ki.kind]; ok {
-		return eng.putFunc
-	} else {
-		if ki.kind == reflect.Struct {
-			//Printf("getPutFunc, ki = %v, other case\n", ki)
-			putFunc := func(w io.Writer, k interface{}) {
-				rv := reflect.ValueOf(k)
-				for _, fieldInfo := range ki.fields {
-					//深度遍历每个field，并将其[]byte写入hash函数
-					putF := getPutFunc(fieldInfo)
-					//Printf("getPutFunc, ki = %#v, fieldInfo = %#v, %#v\n", ki, fieldInfo, rv.Interface())
-					//Printf("getPutFunc, value = %v\n", rv.FieldByIndex(fieldInfo.index).Interface())
-					putF(w, rv.FieldByIndex(fieldInfo.index).Interface())
-				}
-			}
-			//Printf("getPutFunc, ki=%v, putFunc = %v, other case\n", ki, putFunc)
-			return putFunc
-		} else if ki.kind == reflect.Array {
-			putFunc := func(w io.Writer, k interface{}) {
-				rv := reflect.ValueOf(k)
-				putF := getPutFunc(ki.elementInfo)
-				for i := 0; i < ki.size; i++ {
-					//遍历数组元素，并将其[]byte写入hash函数
-					putF(w, rv.Index(i).Interface())
-				}
-			}
-			return putFunc
-		}
-		Printf("getPutFunc, return nil")
+//ownsHash returns true if key is a Hashable or a BytesHashable,
+//which are hashed and compared by their own methods
+func ownsHash(key interface{}) bool {
+	switch key.(type) {
+	case Hashable, BytesHashable:
+		return true
 	}
-	return nil
+	return false
 }
 
+//equals compares keys, keys of different types are never equal
 func equals(k1, k2 interface{}) bool {
-	if h1, ok := k1.(Hashable); ok {
-		return h1.Equals(k2)
-	} else {
-		return k1 == k2
+	switch h1 := k1.(type) {
+	case Hashable:
+		return reflect.TypeOf(k1) == reflect.TypeOf(k2) && h1.Equals(k2)
+	case BytesHashable:
+		return reflect.TypeOf(k1) == reflect.TypeOf(k2) && h1.Equals(k2)
 	}
+	return k1 == k2 || equalNaNs(k1, k2)
 }
 
+//Printf prints if Debug is set. Hot paths check Debug before calling it,
+//as boxing the arguments allocates even when nothing is printed
 func Printf(format string, a ...interface{}) (n int, err error) {
 	if Debug {
 		return fmt.Printf(format, a...)
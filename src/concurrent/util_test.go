@@ -0,0 +1,105 @@
+package concurrent
+
+import (
+	"testing"
+)
+
+func TestSipHashVectors(t *testing.T) {
+	//reference vectors from the SipHash paper, key 00 01 .. 0f, message 00 01 .. len-1
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	cases := []struct {
+		n    int
+		want uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{8, 0x93f5f5799a932462},
+		{15, 0xa129ca6149be45e5},
+	}
+	for _, c := range cases {
+		h := newSipHash(k0, k1)
+		h.Write(msg[:c.n])
+		if got := h.Sum64(); got != c.want {
+			t.Errorf("SipHash of %v bytes = %x, want %x", c.n, got, c.want)
+		}
+
+		//byte by byte writes must give the same result
+		h = newSipHash(k0, k1)
+		for i := 0; i < c.n; i++ {
+			h.Write(msg[i : i+1])
+		}
+		if got := h.Sum64(); got != c.want {
+			t.Errorf("SipHash of %v single byte writes = %x, want %x", c.n, got, c.want)
+		}
+	}
+}
+
+func TestSeededHash(t *testing.T) {
+	for _, alg := range []HashAlgorithm{FNV1a, SipHash} {
+		m1 := NewConcurrentMapWithSeed(42, alg)
+		m2 := NewConcurrentMapWithSeed(42, alg)
+		m3 := NewConcurrentMapWithSeed(43, alg)
+
+		differs := false
+		for i := 0; i < 100; i++ {
+			h1, _ := hashKey(i, m1)
+			h2, _ := hashKey(i, m2)
+			h3, _ := hashKey(i, m3)
+			if h1 != h2 {
+				t.Fatalf("algorithm %v, same seed gives hash codes %v and %v", alg, h1, h2)
+			}
+			differs = differs || h1 != h3
+		}
+		if !differs {
+			t.Errorf("algorithm %v, seeds 42 and 43 give identical hash codes", alg)
+		}
+
+		for i := 0; i < 1000; i++ {
+			m1.Put(i, i)
+		}
+		for i := 0; i < 1000; i++ {
+			if v, ok := m1.Get(i); !ok || v != i {
+				t.Fatalf("algorithm %v, Get %v return %v, %v", alg, i, v, ok)
+			}
+		}
+	}
+}
+
+//with the same seed every key lands in the same segment, with another seed the assignment changes
+func TestSeededSegmentFor(t *testing.T) {
+	m1 := NewConcurrentMapWithSeed(7, FNV1a)
+	m2 := NewConcurrentMapWithSeed(7, FNV1a)
+	m3 := NewConcurrentMapWithSeed(8, FNV1a)
+	moved := false
+	for h := uint32(0); h < 1000; h++ {
+		i1 := indexOfSegment(m1, m1.segmentFor(h))
+		if i2 := indexOfSegment(m2, m2.segmentFor(h)); i1 != i2 {
+			t.Fatalf("hash %v in segment %v and %v with the same seed", h, i1, i2)
+		}
+		moved = moved || i1 != indexOfSegment(m3, m3.segmentFor(h))
+	}
+	if !moved {
+		t.Errorf("segment assignment does not depend on the seed")
+	}
+}
+
+func indexOfSegment(m *ConcurrentMap, s *Segment) int {
+	for i, s1 := range m.segmentList() {
+		if s1 == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestHashableHashCode(t *testing.T) {
+	m := NewConcurrentMapWithSeed(1, FNV1a)
+	h1, _ := hashKey(collidingKey{1, 1000}, m)
+	h2, _ := hashKey(collidingKey{2, 1000}, m)
+	if h1 == h2 {
+		t.Errorf("BytesHashable keys with different HashBytes share hash code %v", h1)
+	}
+}
@@ -0,0 +1,96 @@
+package concurrent
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestContainsValue(t *testing.T) {
+	m := NewConcurrentMap()
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i%10)
+	}
+	if found, err := m.ContainsValue(7); !found || err != nil {
+		t.Errorf("ContainsValue 7, return %v, %v, want true, nil", found, err)
+	}
+	if found, _ := m.ContainsValue(10); found {
+		t.Errorf("ContainsValue 10, return true, want false")
+	}
+	if _, err := m.ContainsValue(nil); err != NilValueError {
+		t.Errorf("ContainsValue nil, return %v, want NilValueError", err)
+	}
+
+	//slices are not comparable with ==
+	m.Put("s", []string{"A", "b"})
+	found, err := m.ContainsValueFunc("a", func(v1, v2 interface{}) bool {
+		s, ok := v1.([]string)
+		return ok && len(s) > 0 && strings.EqualFold(s[0], v2.(string))
+	})
+	if !found || err != nil {
+		t.Errorf("ContainsValueFunc, return %v, %v, want true, nil", found, err)
+	}
+	if _, err := m.ContainsValueFunc(1, nil); err != NilActionError {
+		t.Errorf("ContainsValueFunc nil equal, return %v, want NilActionError", err)
+	}
+}
+
+func TestKeysForValue(t *testing.T) {
+	m := NewConcurrentMap()
+	for i := 0; i < 1000; i++ {
+		m.Put(i, i%10)
+	}
+	keys, err := m.KeysForValue(3)
+	if err != nil || len(keys) != 100 {
+		t.Fatalf("KeysForValue 3, return %v keys, %v, want 100 keys", len(keys), err)
+	}
+	ints := make([]int, len(keys))
+	for i, k := range keys {
+		ints[i] = k.(int)
+	}
+	sort.Ints(ints)
+	for i, k := range ints {
+		if k != i*10+3 {
+			t.Fatalf("KeysForValue 3, key %v is %v, want %v", i, k, i*10+3)
+		}
+	}
+	if keys, _ := m.KeysForValue(10); len(keys) != 0 {
+		t.Errorf("KeysForValue 10, return %v, want no keys", keys)
+	}
+}
+
+func TestKeysForValueDuringWrites(t *testing.T) {
+	m := NewConcurrentMap()
+	for i := 0; i < 1000; i++ {
+		m.Put(i, "fixed")
+	}
+
+	//writers change the size of the map, but never touch the fixed keys
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 1000 + g; ; i += 4 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				m.Put(i, "moving")
+				if i >= 1400 {
+					m.Remove(i - 400)
+				}
+			}
+		}(g)
+	}
+	for k := 0; k < 20; k++ {
+		if keys, _ := m.KeysForValue("fixed"); len(keys) != 1000 {
+			t.Errorf("KeysForValue during writes, return %v keys, want 1000", len(keys))
+		}
+	}
+	close(done)
+	wg.Wait()
+}
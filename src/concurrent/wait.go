@@ -0,0 +1,176 @@
+package concurrent
+
+import (
+	"context"
+)
+
+/* ---------------- Waiting for keys -------------- */
+
+/*
+* A goroutine waiting for a key registers a waiter in the segment of the
+* key, under the segment lock. The writers that map a value, put, replace
+* and compute, wake the waiters of the key while they still hold the lock,
+* so a waiter never misses a value that is mapped after it checked the map.
+ */
+
+type waiter struct {
+	key  interface{}
+	pred func(value interface{}) bool //nil accepts any value
+	ch   chan interface{}             //receives the accepted value, buffered so the writer never blocks
+}
+
+func (this *waiter) accepts(value interface{}) bool {
+	return this.pred == nil || this.pred(value)
+}
+
+//predPanic carries a panic of pred from the writer that called it to the waiting goroutine
+type predPanic struct {
+	v interface{}
+}
+
+//offer sends value to w if w accepts it. A panic of pred is recovered and
+//sent instead, so that it unwinds the waiting goroutine and not the writer
+func (this *waiter) offer(value interface{}) (sent bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			this.ch <- predPanic{r}
+			sent = true
+		}
+	}()
+	if this.accepts(value) {
+		this.ch <- value
+		return true
+	}
+	return false
+}
+
+//received returns a value sent to w, or panics with the panic of pred that was sent instead
+func (this *waiter) received(value interface{}) interface{} {
+	if p, ok := value.(predPanic); ok {
+		panic(p.v)
+	}
+	return value
+}
+
+/**
+* Blocks until key is mapped and returns its value. If the key is already
+* present its value is returned at once.
+*
+* @return the value, or nil and ctx.Err() if ctx is done first,
+*         NilKeyError or NonSupportKey if the key is not supported
+*/
+func (this *ConcurrentMap) WaitFor(ctx context.Context, key interface{}) (value interface{}, err error) {
+	return this.WaitForValue(ctx, key, nil)
+}
+
+/**
+* Blocks until key is mapped to a value for which pred returns true, and
+* returns that value. pred is called with the current value and with
+* every value mapped to the key afterwards, while the segment lock is
+* held, so it must not access the map. A nil pred accepts any value.
+* If pred panics in a writer, the writer recovers and WaitForValue panics
+* with the same value.
+*
+* @return the value, or nil and ctx.Err() if ctx is done first,
+*         NilKeyError or NonSupportKey if the key is not supported
+*/
+func (this *ConcurrentMap) WaitForValue(ctx context.Context, key interface{}, pred func(value interface{}) bool) (value interface{}, err error) {
+	if isNil(key) {
+		return nil, NilKeyError
+	}
+	hash, err := hashKey(key, this)
+	if err != nil {
+		return nil, err
+	}
+	s := this.segmentFor(hash)
+	w := &waiter{key: key, pred: pred}
+	if pred == nil {
+		//no pred to run, so the current value can be read without the lock
+		if v := s.get(key, hash); v != nil {
+			return v, nil
+		}
+	}
+
+	if value = s.await(w, hash); value != nil {
+		return
+	}
+	select {
+	case value = <-w.ch:
+		return w.received(value), nil
+	case <-ctx.Done():
+		if !this.segmentFor(hash).removeWaiter(w, hash) {
+			//woken while ctx was done, the value is in the channel
+			return w.received(<-w.ch), nil
+		}
+		return nil, ctx.Err()
+	}
+}
+
+/**
+* Returns the value of the key of w if w accepts it, otherwise registers w.
+*/
+func (this *Segment) await(w *waiter, hash uint32) (value interface{}) {
+	if !this.lockLive() {
+		return this.m.segmentFor(hash).await(w, hash)
+	}
+	defer this.lock.Unlock()
+	tab := this.table()
+	if e := findInBin((*Entry)(tab[hash&uint32(len(tab)-1)]), w.key, hash); e != nil {
+		if c := e.fastCell(); !this.m.expired(c) && w.accepts(c.v) {
+			return c.v
+		}
+	}
+	w.ch = make(chan interface{}, 1)
+	if this.waiters == nil {
+		this.waiters = make(map[uint32][]*waiter)
+	}
+	this.waiters[hash] = append(this.waiters[hash], w)
+	return nil
+}
+
+/**
+* Unregisters w.
+* @return false if w was already woken
+*/
+func (this *Segment) removeWaiter(w *waiter, hash uint32) bool {
+	if !this.lockLive() {
+		//the waiter moved with its key
+		return this.m.segmentFor(hash).removeWaiter(w, hash)
+	}
+	defer this.lock.Unlock()
+	ws := this.waiters[hash]
+	for i, o := range ws {
+		if o == w {
+			this.setWaiters(hash, append(ws[:i], ws[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
+
+/**
+* Wakes the waiters of key that accept value, key was just mapped to value.
+* The waiters that stay are collected in a new slice, the registered one
+* is never changed.
+* Call only while holding lock.
+*/
+func (this *Segment) wake(key interface{}, hash uint32, value interface{}) {
+	if len(this.waiters) == 0 {
+		return
+	}
+	var rest []*waiter
+	for _, w := range this.waiters[hash] {
+		if !equals(w.key, key) || !w.offer(value) {
+			rest = append(rest, w)
+		}
+	}
+	this.setWaiters(hash, rest)
+}
+
+func (this *Segment) setWaiters(hash uint32, ws []*waiter) {
+	if len(ws) == 0 {
+		delete(this.waiters, hash)
+	} else {
+		this.waiters[hash] = ws
+	}
+}
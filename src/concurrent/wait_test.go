@@ -0,0 +1,135 @@
+package concurrent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitFor(t *testing.T) {
+	m := NewConcurrentMap()
+	m.Put("ready", 1)
+	if v, err := m.WaitFor(context.Background(), "ready"); v != 1 || err != nil {
+		t.Errorf("WaitFor present key, return %v, %v", v, err)
+	}
+
+	result := make(chan interface{})
+	go func() {
+		v, err := m.WaitFor(context.Background(), "job")
+		if err != nil {
+			t.Errorf("WaitFor return %v", err)
+		}
+		result <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.Put("other", 1)
+	m.Put("job", "done")
+	if v := <-result; v != "done" {
+		t.Errorf("WaitFor return %v, want done", v)
+	}
+
+	go func() {
+		v, _ := m.WaitForValue(context.Background(), "counter", func(v interface{}) bool { return v.(int) >= 3 })
+		result <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		m.Compute("counter", func(oldVal interface{}) interface{} {
+			if oldVal == nil {
+				return 1
+			}
+			return oldVal.(int) + 1
+		})
+	}
+	if v := <-result; v != 3 {
+		t.Errorf("WaitForValue return %v, want 3", v)
+	}
+
+	if _, err := m.WaitFor(context.Background(), nil); err != NilKeyError {
+		t.Errorf("WaitFor nil key, return %v", err)
+	}
+}
+
+func TestWaitForCancel(t *testing.T) {
+	m := NewConcurrentMap()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if v, err := m.WaitFor(ctx, "never"); v != nil || err != context.DeadlineExceeded {
+		t.Errorf("WaitFor return %v, %v, want DeadlineExceeded", v, err)
+	}
+	for _, s := range m.segmentList() {
+		if len(s.waiters) != 0 {
+			t.Errorf("waiter is still registered after the deadline")
+		}
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	m.Put("k", 1)
+	if v, err := m.WaitFor(ctx, "k"); v != 1 || err != nil {
+		t.Errorf("WaitFor present key with cancelled context, return %v, %v", v, err)
+	}
+}
+
+func TestWaitForPanickingPred(t *testing.T) {
+	m := NewConcurrentMap()
+	recovered := make(chan interface{})
+	go func() {
+		defer func() { recovered <- recover() }()
+		m.WaitForValue(context.Background(), "k", func(v interface{}) bool {
+			if v == "bad" {
+				panic("bad value")
+			}
+			return false
+		})
+	}()
+	result := make(chan interface{})
+	go func() {
+		v, _ := m.WaitFor(context.Background(), "k")
+		result <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	//the writer is not unwound and the other waiter is still woken
+	m.Put("k", "bad")
+	if r := <-recovered; r != "bad value" {
+		t.Errorf("WaitForValue recovered %v, want the panic of pred", r)
+	}
+	if v := <-result; v != "bad" {
+		t.Errorf("WaitFor return %v, want bad", v)
+	}
+	if v, _ := m.Get("k"); v != "bad" {
+		t.Errorf("Get return %v after the pred panicked, want bad", v)
+	}
+	for _, s := range m.segmentList() {
+		if len(s.waiters) != 0 {
+			t.Errorf("waiters are still registered")
+		}
+	}
+}
+
+func TestWaitForRendezvous(t *testing.T) {
+	m := NewConcurrentMap()
+	n := 200
+	done := make(chan bool)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			v, err := m.WaitFor(context.Background(), i)
+			done <- err == nil && v == i*2
+		}(i)
+	}
+	batch := make(map[interface{}]interface{})
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			m.Put(i, i*2)
+		} else {
+			batch[i] = i * 2
+		}
+	}
+	m.PutAll(batch)
+	for i := 0; i < n; i++ {
+		if !<-done {
+			t.Errorf("a consumer got a wrong value")
+		}
+	}
+}
@@ -5,15 +5,16 @@ import (
 )
 
 type key string
-func (self key) HashCode() uint32 {
-	var rval uint32
+func (self key) HashCode() uint64 {
+	var rval uint64
 	for c := range self {
-		rval = rval + uint32(c)
+		rval = rval + uint64(c)
 	}
 	return rval
 }
 func (self key) Equals(t gotomic.Thing) bool {
-	return t.(key) == self
+	k, ok := t.(key)
+	return ok && k == self
 }
 
 func main() {
@@ -22,6 +22,9 @@ func (this *GotomicMap) GetHashableKey(k interface{}) Hashable {
 	case string:
 		key = StringKey(k.(string))
 		break
+	case Hashable:
+		key = k.(Hashable)
+		break
 	}
 	return key
 }
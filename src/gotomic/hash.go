@@ -3,10 +3,9 @@ package gotomic
 import (
 	"bytes"
 	"fmt"
-	"hash/crc32"
+	"hashkey"
 	"sync/atomic"
 	"unsafe"
-	"encoding/binary"
 )
 
 const max_exponent = 32
@@ -48,54 +47,29 @@ type Equalable interface {
 
 /*
  Hashable types can be in a Hash.
+
+ It is the hashkey.Key contract shared with package concurrent, so the same key types work in a concurrent.ConcurrentMap.
 */
-type Hashable interface {
-	Equalable
-	HashCode() uint32
-}
+type Hashable = hashkey.Key
 
 /*
  Convenience type to simplify using ints as keys in a Hash
 */
-type IntKey int
-
-func (self IntKey) HashCode() uint32 {
-	return uint32(self)
-}
-func (self IntKey) Equals(t Thing) bool {
-	if ik, ok := t.(IntKey); ok {
-		return int(self) == int(ik)
-	}
-	return false
-}
-
-type Int64Key int64
+type IntKey = hashkey.Int
 
-func (self Int64Key) HashCode() uint32 {
-	var buf = make([]byte, 8)
-  binary.BigEndian.PutUint64(buf, uint64(self))
-	return crc32.ChecksumIEEE(buf)
-}
-func (self Int64Key) Equals(t Thing) bool {
-	if ik, ok := t.(Int64Key); ok {
-		return int64(self) == int64(ik)
-	}
-	return false
-}
+type Int64Key = hashkey.Int64
 
 /*
  Convenience type to simplify using strings as keys in a Hash
 */
-type StringKey string
+type StringKey = hashkey.String
 
-func (self StringKey) HashCode() uint32 {
-	return crc32.ChecksumIEEE([]byte(self))
-}
-func (self StringKey) Equals(t Thing) bool {
-	if sk, ok := t.(StringKey); ok {
-		return string(self) == string(sk)
-	}
-	return false
+/*
+ hashCode folds the 64 bit hash code of k into the 32 bits a Hash uses.
+*/
+func hashCode(k Hashable) uint32 {
+	h := k.HashCode()
+	return uint32(h ^ (h >> 32))
 }
 
 type entry struct {
@@ -109,7 +83,7 @@ func newRealEntryWithHashCode(k Hashable, v Thing, hc uint32) *entry {
 	return &entry{hc, reverse(hc) | 1, k, unsafe.Pointer(&v)}
 }
 func newRealEntry(k Hashable, v Thing) *entry {
-	return newRealEntryWithHashCode(k, v, k.HashCode())
+	return newRealEntryWithHashCode(k, v, hashCode(k))
 }
 func newMockEntry(hashCode uint32) *entry {
 	return &entry{hashCode, reverse(hashCode) &^ 1, nil, nil}
@@ -272,7 +246,7 @@ func (self *Hash) GetHC(hashCode uint32, k Hashable) (rval Thing, ok bool) {
  Get returns the value at k and whether it was present in the Hash.
 */
 func (self *Hash) Get(k Hashable) (Thing, bool) {
-	return self.GetHC(k.HashCode(), k)
+	return self.GetHC(hashCode(k), k)
 }
 
 /*
@@ -303,7 +277,7 @@ func (self *Hash) DeleteHC(hashCode uint32, k Hashable) (rval Thing, ok bool) {
  Delete removes k from the Hash and returns any value it removed.
 */
 func (self *Hash) Delete(k Hashable) (Thing, bool) {
-	return self.DeleteHC(k.HashCode(), k)
+	return self.DeleteHC(hashCode(k), k)
 }
 
 /*
@@ -384,7 +358,7 @@ func (self *Hash) PutHC(hashCode uint32, k Hashable, v Thing) (rval Thing, ok bo
  Put k and v in the Hash and return the overwritten value and whether any value was overwritten.
 */
 func (self *Hash) Put(k Hashable, v Thing) (rval Thing, ok bool) {
-	return self.PutHC(k.HashCode(), k, v)
+	return self.PutHC(hashCode(k), k, v)
 }
 func (self *Hash) addSize(i int) {
 	atomic.AddInt64(&self.size, int64(i))
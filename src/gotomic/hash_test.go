@@ -2,6 +2,7 @@ package gotomic
 
 import (
 	"fmt"
+	"hashkey"
 	"math/rand"
 	"reflect"
 	"runtime"
@@ -78,10 +79,33 @@ func fiddleHash(t *testing.T, h *Hash, s string, do, done chan bool) {
 	done <- true
 }
 
+func TestSharedKeys(t *testing.T) {
+	type point struct{ X, Y int }
+	h := NewHash()
+	h.Put(IntKey(1), "int")
+	h.Put(Int64Key(1), "int64")
+	h.Put(hashkey.StructOf(point{1, 2}), "struct")
+	assertMappy(t, h, map[Hashable]Thing{
+		hashkey.Int(1):                "int",
+		hashkey.Int64(1):              "int64",
+		hashkey.StructOf(point{1, 2}): "struct",
+	})
+
+	m := NewGotomicMap()
+	m.Put(1, "a")
+	m.Put(hashkey.String("b"), "b")
+	if v, _ := m.Get(hashkey.Int(1)); v != "a" {
+		t.Errorf("Get hashkey.Int(1) after Put 1, return %v, want a", v)
+	}
+	if v, _ := m.Get("b"); v != "b" {
+		t.Errorf("Get b after Put hashkey.String, return %v, want b", v)
+	}
+}
+
 type hashInt int
 
-func (self hashInt) HashCode() uint32 {
-	return uint32(self)
+func (self hashInt) HashCode() uint64 {
+	return uint64(self)
 }
 func (self hashInt) Equals(t Thing) bool {
 	if i, ok := t.(hashInt); ok {
@@ -28,7 +28,10 @@ type Comparable interface {
 	Compare(Thing) int
 }
 
-type Thing interface{}
+/*
+ Thing is any value. It is an alias, so that methods taking a Thing, like Equals, match methods taking an interface{}.
+*/
+type Thing = interface{}
 
 var list_head = "LIST_HEAD"
 
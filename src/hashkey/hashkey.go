@@ -0,0 +1,113 @@
+/*
+* Package hashkey defines the contract for map keys that hash and compare
+* themselves, shared by the maps of package concurrent and package gotomic,
+* so that one key type works in both without adapters.
+*
+* Int, Int64 and String hash their value with 64-bit FNV-1a, so their hash
+* codes are the same in every process. Struct wraps any comparable value,
+* for example a struct of several fields. A concurrent.ConcurrentMap hashes
+* the hash code of a Key again with the seed of the map, so the hash code
+* of a Key is not the hash the map computes for the plain value.
+ */
+package hashkey
+
+import (
+	"hash/maphash"
+)
+
+/**
+* Key is implemented by keys that provide their own hash code and equality.
+*
+* Keys that are equal must return the same hash code. Equals is called with
+* keys of any type and must return false for a key of another type. Both
+* methods are called concurrently and must not modify the key.
+*/
+type Key interface {
+	HashCode() uint64
+	Equals(other interface{}) bool
+}
+
+const (
+	fnvOffset64 uint64 = 14695981039346656037
+	fnvPrime64  uint64 = 1099511628211
+)
+
+//fnv64a8 hashes the 8 little-endian bytes of v with 64-bit FNV-1a
+func fnv64a8(v uint64) uint64 {
+	h := fnvOffset64
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= fnvPrime64
+		v >>= 8
+	}
+	return h
+}
+
+//Int is an int key, int keys of package gotomic are Ints.
+type Int int
+
+func (this Int) HashCode() uint64 {
+	return fnv64a8(uint64(this))
+}
+
+func (this Int) Equals(other interface{}) bool {
+	o, ok := other.(Int)
+	return ok && this == o
+}
+
+//Int64 is an int64 key, an Int64 never equals an Int of the same value.
+type Int64 int64
+
+func (this Int64) HashCode() uint64 {
+	return fnv64a8(uint64(this))
+}
+
+func (this Int64) Equals(other interface{}) bool {
+	o, ok := other.(Int64)
+	return ok && this == o
+}
+
+//String is a string key, hashed without copying the string.
+type String string
+
+func (this String) HashCode() uint64 {
+	h := fnvOffset64
+	for i := 0; i < len(this); i++ {
+		h ^= uint64(this[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+func (this String) Equals(other interface{}) bool {
+	o, ok := other.(String)
+	return ok && this == o
+}
+
+//structSeed keys the hash codes of Struct, they are only stable within a process
+var structSeed = maphash.MakeSeed()
+
+/**
+* Struct is a key holding a comparable value, such as a struct of several
+* fields. Two Structs are equal if their values are equal with ==.
+*
+* The hash code is computed by hash/maphash with a seed drawn when the
+* process starts, so unlike the other keys it differs between processes.
+*/
+type Struct[T comparable] struct {
+	Value T
+}
+
+//StructOf returns a Struct key holding v.
+func StructOf[T comparable](v T) Struct[T] {
+	return Struct[T]{v}
+}
+
+func (this Struct[T]) HashCode() uint64 {
+	return maphash.Comparable(structSeed, this.Value)
+}
+
+func (this Struct[T]) Equals(other interface{}) bool {
+	o, ok := other.(Struct[T])
+	return ok && this.Value == o.Value
+}
@@ -0,0 +1,51 @@
+package hashkey
+
+import (
+	"testing"
+)
+
+type point struct{ X, Y int }
+
+func TestHashCode(t *testing.T) {
+	//FNV-1a 64 of the little-endian bytes of 1 and of "key"
+	cases := []struct {
+		key  Key
+		want uint64
+	}{
+		{Int(1), 0x89cd31291d2aefa4},
+		{Int64(1), 0x89cd31291d2aefa4},
+		{String("key"), 0x3dc94a19365b10ec},
+	}
+	for _, c := range cases {
+		if h := c.key.HashCode(); h != c.want {
+			t.Errorf("%T(%v).HashCode() return %#x, want %#x", c.key, c.key, h, c.want)
+		}
+	}
+	if StructOf(point{1, 2}).HashCode() != StructOf(point{1, 2}).HashCode() {
+		t.Errorf("equal Struct keys return different hash codes")
+	}
+}
+
+func TestEquals(t *testing.T) {
+	cases := []struct {
+		k1, k2 Key
+		equal  bool
+	}{
+		{Int(1), Int(1), true},
+		{Int(1), Int(2), false},
+		{Int(1), Int64(1), false},
+		{String("a"), String("a"), true},
+		{String("a"), String("b"), false},
+		{StructOf(point{1, 2}), StructOf(point{1, 2}), true},
+		{StructOf(point{1, 2}), StructOf(point{2, 1}), false},
+		{StructOf(point{1, 2}), StructOf([2]int{1, 2}), false},
+	}
+	for _, c := range cases {
+		if eq := c.k1.Equals(c.k2); eq != c.equal {
+			t.Errorf("%#v.Equals(%#v) return %v, want %v", c.k1, c.k2, eq, c.equal)
+		}
+	}
+	if Int(1).Equals(1) || String("a").Equals("a") {
+		t.Errorf("a key equals a value of its underlying type")
+	}
+}